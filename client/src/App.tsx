@@ -1,6 +1,6 @@
 import { useState, useEffect } from 'react';
 import { BrowserRouter, Routes, Route, Link, useLocation, Navigate } from 'react-router-dom';
-import { SignedIn, SignedOut, UserButton } from '@clerk/clerk-react';
+import { SignedIn, SignedOut, UserButton, useAuth } from '@clerk/clerk-react';
 import { Baby, Upload, BookOpen, Sparkles, Loader2 } from 'lucide-react';
 import { PhotoUpload } from './components/PhotoUpload';
 import { PageDraftEditor } from './components/PageDraftEditor';
@@ -11,7 +11,7 @@ import { SignInPage } from './components/SignInPage';
 import { SignUpPage } from './components/SignUpPage';
 import { LandingPage } from './components/LandingPage';
 import type { Photo, PhotoCluster, PageDraft, Theme } from './types/photo';
-import { getPhotos, analyzePhotos, getPages, savePageDraft } from './api/photoApi';
+import { getPhotos, analyzePhotos, getPages, savePageDraft, setAuthTokenProvider } from './api/photoApi';
 
 function AppContent() {
   const location = useLocation();
@@ -20,6 +20,12 @@ function AppContent() {
   const [pages, setPages] = useState<PageDraft[]>([]);
   const [isAnalyzing, setIsAnalyzing] = useState(false);
   const [isLoading, setIsLoading] = useState(true);
+  const { getToken } = useAuth();
+
+  // Registered before loading so the first requests already carry the session token
+  useEffect(() => {
+    setAuthTokenProvider(() => getToken());
+  }, [getToken]);
 
   useEffect(() => {
     loadData();
@@ -1,29 +1,120 @@
-import type { Photo, UploadResponse, ClusterResponse, PageDraft } from '../types/photo';
+import type { Photo, UploadFileResult, ClusterResponse, PageDraft, DraftListResponse, UserSettings, ErrorResponse, RenditionsResponse } from '../types/photo';
 
-const API_BASE_URL = 'http://localhost:8080/api';
+const API_BASE_URL = 'http://localhost:8080/api/v1';
 
-export async function uploadPhotos(files: File[]): Promise<UploadResponse> {
-  const formData = new FormData();
-  
-  files.forEach((file) => {
-    formData.append('photos', file);
-  });
+type AuthTokenProvider = () => Promise<string | null>;
+
+let getAuthToken: AuthTokenProvider = async () => null;
+
+// Lets API calls identify the signed-in user so uploads are owned by them
+export function setAuthTokenProvider(provider: AuthTokenProvider) {
+  getAuthToken = provider;
+}
 
-  const response = await fetch(`${API_BASE_URL}/photos/upload`, {
+async function authHeaders(): Promise<Record<string, string>> {
+  const token = await getAuthToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+}
+
+// problemMessage explains an error response, listing the fields or files it names
+function problemMessage(problem: ErrorResponse, fallback: string): string {
+  const details = (problem.errors ?? []).map((e) => `${e.field}: ${e.message}`);
+  return details.join('\n') || problem.detail || fallback;
+}
+
+const UPLOAD_CHUNK_SIZE = 1024 * 1024; // 1 MB
+const UPLOAD_CHUNK_RETRIES = 3;
+
+export const MAX_FILES = 10;
+export const MAX_FILE_SIZE = 5 * 1024 * 1024; // 5 MB
+
+async function sha256(data: ArrayBuffer): Promise<ArrayBuffer> {
+  return crypto.subtle.digest('SHA-256', data);
+}
+
+function toBase64(digest: ArrayBuffer): string {
+  return btoa(String.fromCharCode(...new Uint8Array(digest)));
+}
+
+// Uploads one photo in chunks, resuming from the server's offset after a failed chunk. Each
+// chunk carries its own checksum, so the file is never read into memory all at once.
+export async function uploadPhotoResumable(
+  file: File,
+  onProgress?: (sent: number, total: number) => void
+): Promise<UploadFileResult> {
+  if (file.size > MAX_FILE_SIZE) {
+    return { filename: file.name, status: 'rejected', code: 'file_too_large', reason: 'File exceeds the 5MB limit' };
+  }
+
+  const createResponse = await fetch(`${API_BASE_URL}/uploads`, {
     method: 'POST',
-    body: formData,
+    headers: {
+      ...(await authHeaders()),
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify({ filename: file.name, size: file.size }),
   });
-
-  if (!response.ok) {
-    const error = await response.json();
-    throw new Error(error.error || 'Failed to upload photos');
+  if (!createResponse.ok) {
+    throw new Error(problemMessage(await createResponse.json(), 'Failed to start upload'));
+  }
+  const { id } = await createResponse.json();
+  const uploadUrl = `${API_BASE_URL}/uploads/${id}`;
+
+  let offset = 0;
+  let failures = 0;
+  while (offset < file.size) {
+    const chunk = await file.slice(offset, offset + UPLOAD_CHUNK_SIZE).arrayBuffer();
+    try {
+      const response = await fetch(uploadUrl, {
+        method: 'PATCH',
+        headers: {
+          ...(await authHeaders()),
+          'Content-Type': 'application/offset+octet-stream',
+          'Upload-Offset': String(offset),
+          'Upload-Checksum': `sha256 ${toBase64(await sha256(chunk))}`,
+        },
+        body: chunk,
+      });
+      if (!response.ok) {
+        throw new Error(`Chunk upload failed with status ${response.status}`);
+      }
+      offset = Number(response.headers.get('Upload-Offset'));
+      failures = 0;
+      onProgress?.(offset, file.size);
+    } catch (err) {
+      if (++failures > UPLOAD_CHUNK_RETRIES) {
+        throw err;
+      }
+      // Ask the server how much it actually received and carry on from there
+      const head = await fetch(uploadUrl, { method: 'HEAD', headers: await authHeaders() });
+      if (!head.ok) {
+        throw new Error('Upload session was lost');
+      }
+      offset = Number(head.headers.get('Upload-Offset'));
+    }
   }
 
-  return response.json();
+  const finalizeResponse = await fetch(`${uploadUrl}/finalize`, {
+    method: 'POST',
+    headers: await authHeaders(),
+  });
+  const result = await finalizeResponse.json();
+  if (finalizeResponse.status === 422) {
+    // The file arrived but isn't an acceptable photo
+    const problem: ErrorResponse = result;
+    return { filename: file.name, status: 'rejected', code: problem.errors?.[0]?.code, reason: problem.detail };
+  }
+  if (!finalizeResponse.ok) {
+    throw new Error(problemMessage(result, 'Failed to finish upload'));
+  }
+  return result;
 }
 
 export async function getPhotos(): Promise<Photo[]> {
-  const response = await fetch(`${API_BASE_URL}/photos`);
+  const [response] = await Promise.all([
+    fetch(`${API_BASE_URL}/photos`, { headers: await authHeaders() }),
+    loadPhotoWidths(),
+  ]);
 
   if (!response.ok) {
     throw new Error('Failed to fetch photos');
@@ -37,13 +128,13 @@ export async function analyzePhotos(photoIds: string[]): Promise<ClusterResponse
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
+      ...(await authHeaders()),
     },
     body: JSON.stringify({ photoIds }),
   });
 
   if (!response.ok) {
-    const error = await response.json();
-    throw new Error(error.error || 'Failed to analyze photos');
+    throw new Error(problemMessage(await response.json(), 'Failed to analyze photos'));
   }
 
   return response.json();
@@ -54,31 +145,101 @@ export async function savePageDraft(draft: PageDraft): Promise<PageDraft> {
     method: 'PUT',
     headers: {
       'Content-Type': 'application/json',
+      ...(await authHeaders()),
     },
     body: JSON.stringify(draft),
   });
 
   if (!response.ok) {
-    const error = await response.json();
-    throw new Error(error.error || 'Failed to save page');
+    throw new Error(problemMessage(await response.json(), 'Failed to save page'));
   }
 
   return response.json();
 }
 
 export async function getPages(): Promise<PageDraft[]> {
-  const response = await fetch(`${API_BASE_URL}/drafts/`);
+  // Only approved drafts are "pages"; follow the cursor until every page is loaded
+  const pages: PageDraft[] = [];
+  let cursor = '';
+
+  do {
+    const params = new URLSearchParams({ status: 'approved', sort: 'capturedAt' });
+    if (cursor) {
+      params.set('cursor', cursor);
+    }
+
+    const response = await fetch(`${API_BASE_URL}/drafts?${params}`, {
+      headers: await authHeaders(),
+    });
+
+    if (!response.ok) {
+      throw new Error('Failed to fetch pages');
+    }
+
+    const result: DraftListResponse = await response.json();
+    pages.push(...result.drafts);
+    cursor = result.next ?? '';
+  } while (cursor);
+
+  return pages;
+}
+
+export async function getSettings(): Promise<UserSettings> {
+  const response = await fetch(`${API_BASE_URL}/settings`, {
+    headers: await authHeaders(),
+  });
+
+  if (!response.ok) {
+    throw new Error('Failed to fetch settings');
+  }
+
+  return response.json();
+}
+
+export async function updateSettings(settings: UserSettings): Promise<UserSettings> {
+  const response = await fetch(`${API_BASE_URL}/settings`, {
+    method: 'PUT',
+    headers: {
+      ...(await authHeaders()),
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(settings),
+  });
 
   if (!response.ok) {
-    throw new Error('Failed to fetch pages');
+    throw new Error(problemMessage(await response.json(), 'Failed to save settings'));
   }
 
-  const drafts: PageDraft[] = await response.json();
-  // Filter to only return approved drafts as "pages"
-  return drafts.filter(d => d.status === 'approved');
+  return response.json();
+}
+
+// Paths from the API are signed links that already carry a query string
+function withParam(path: string, param: string): string {
+  return `http://localhost:8080${path}${path.includes('?') ? '&' : '?'}${param}`;
 }
 
 export function getPhotoUrl(path: string, thumb: boolean = true): string {
-  const baseUrl = `http://localhost:8080${path}`;
-  return thumb ? `${baseUrl}?thumb=1` : baseUrl;
+  return thumb ? withParam(path, 'thumb=1') : `http://localhost:8080${path}`;
+}
+
+// Widths the server renders photos at; requests for other widths are snapped to these.
+// Loaded before the first photos are listed, so srcset lists match the server's settings.
+let photoWidths: number[] = [];
+let photoWidthsLoad: Promise<void> | null = null;
+
+function loadPhotoWidths(): Promise<void> {
+  photoWidthsLoad ??= fetch(`${API_BASE_URL}/renditions`)
+    .then((response) => (response.ok ? response.json() : { sizes: [] }))
+    .then((renditions: RenditionsResponse) => {
+      photoWidths = renditions.sizes.map((s) => s.width);
+    })
+    .catch(() => {
+      photoWidthsLoad = null; // Try again with the next photo list
+    });
+  return photoWidthsLoad;
+}
+
+export function getPhotoSrcSet(path: string): string | undefined {
+  if (photoWidths.length === 0) return undefined;
+  return photoWidths.map((w) => `${withParam(path, `w=${w}`)} ${w}w`).join(', ');
 }
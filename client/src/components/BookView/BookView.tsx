@@ -1,6 +1,6 @@
 import { Book, Calendar, Heart } from 'lucide-react';
 import type { PageDraft, Theme } from '../../types/photo';
-import { getPhotoUrl } from '../../api/photoApi';
+import { getPhotoUrl, getPhotoSrcSet } from '../../api/photoApi';
 
 interface BookViewProps {
   pages: PageDraft[];
@@ -104,6 +104,8 @@ export function BookView({ pages }: BookViewProps) {
                           >
                             <img
                               src={getPhotoUrl(photo.path)}
+                              srcSet={getPhotoSrcSet(photo.path)}
+                              sizes="(min-width: 768px) 25vw, 50vw"
                               alt=""
                               className="w-full h-full object-cover hover:scale-105 transition-transform duration-300"
                             />
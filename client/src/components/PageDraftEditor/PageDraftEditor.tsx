@@ -1,7 +1,7 @@
 import { useState, useMemo } from 'react';
 import { Edit3, Check, X, Sparkles, Calendar, Trash2 } from 'lucide-react';
 import type { PhotoCluster, PageDraft, Theme, Photo } from '../../types/photo';
-import { getPhotoUrl } from '../../api/photoApi';
+import { getPhotoUrl, getPhotoSrcSet } from '../../api/photoApi';
 
 interface PageDraftEditorProps {
   cluster: PhotoCluster;
@@ -130,9 +130,14 @@ function PhotoItem({
   className?: string;
 }) {
   return (
-    <div className={`relative group ${className}`}>
+    <div
+      className={`relative group ${className}`}
+      style={{ backgroundColor: photo.dominantColor }}
+    >
       <img
         src={getPhotoUrl(photo.path)}
+        srcSet={getPhotoSrcSet(photo.path)}
+        sizes="(min-width: 768px) 33vw, 100vw"
         alt=""
         className="w-full h-full object-cover"
       />
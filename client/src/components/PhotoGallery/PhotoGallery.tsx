@@ -23,10 +23,15 @@ export function PhotoGallery({ photos }: PhotoGalleryProps) {
       <div className="photo-grid">
         {photos.map((photo) => (
           <div key={photo.id} className="photo-card">
-            <div className="photo-wrapper">
+            <div
+              className="photo-wrapper"
+              style={{ backgroundColor: photo.dominantColor }}
+            >
               <img
                 src={getPhotoUrl(photo.path)}
                 alt={photo.filename}
+                width={photo.width}
+                height={photo.height}
                 loading="lazy"
               />
             </div>
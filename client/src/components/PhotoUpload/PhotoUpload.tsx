@@ -1,10 +1,7 @@
 import { useState, useCallback, useRef } from 'react';
 import { Upload, ImagePlus, X, Loader2 } from 'lucide-react';
-import { uploadPhotos } from '../../api/photoApi';
-import type { Photo } from '../../types/photo';
-
-const MAX_FILES = 10;
-const MAX_FILE_SIZE = 5 * 1024 * 1024; // 5 MB
+import { uploadPhotoResumable, MAX_FILES, MAX_FILE_SIZE } from '../../api/photoApi';
+import type { Photo, UploadFileResult } from '../../types/photo';
 
 interface PhotoUploadProps {
   onUploadComplete: (photos: Photo[]) => void;
@@ -13,6 +10,7 @@ interface PhotoUploadProps {
 export function PhotoUpload({ onUploadComplete }: PhotoUploadProps) {
   const [isDragging, setIsDragging] = useState(false);
   const [isUploading, setIsUploading] = useState(false);
+  const [progress, setProgress] = useState(0);
   const [error, setError] = useState<string | null>(null);
   const [previewFiles, setPreviewFiles] = useState<{ file: File; preview: string }[]>([]);
   const fileInputRef = useRef<HTMLInputElement>(null);
@@ -52,25 +50,48 @@ export function PhotoUpload({ onUploadComplete }: PhotoUploadProps) {
 
   const handleUpload = async () => {
     if (previewFiles.length === 0) return;
+    if (previewFiles.length > MAX_FILES) {
+      setError(`Maximum ${MAX_FILES} photos per upload`);
+      return;
+    }
 
     setIsUploading(true);
+    setProgress(0);
     setError(null);
 
-    try {
-      const files = previewFiles.map((p) => p.file);
-      const response = await uploadPhotos(files);
-      
-      if (response.success && response.photos) {
-        onUploadComplete(response.photos);
-        // Cleanup previews
-        previewFiles.forEach((p) => URL.revokeObjectURL(p.preview));
-        setPreviewFiles([]);
+    // Photos are sent one at a time in resumable chunks, so a dropped connection
+    // only resends the rest of the current photo
+    const files = previewFiles.map((p) => p.file);
+    const totalBytes = files.reduce((sum, file) => sum + file.size, 0);
+    const results: UploadFileResult[] = [];
+    let doneBytes = 0;
+    for (const file of files) {
+      try {
+        results.push(await uploadPhotoResumable(file, (sent) => setProgress((doneBytes + sent) / totalBytes)));
+      } catch (err) {
+        results.push({ filename: file.name, status: 'rejected', reason: err instanceof Error ? err.message : 'Upload failed' });
       }
-    } catch (err) {
-      setError(err instanceof Error ? err.message : 'Upload failed');
-    } finally {
-      setIsUploading(false);
+      doneBytes += file.size;
+      setProgress(doneBytes / totalBytes);
+    }
+
+    const photos = results.flatMap((r) => (r.photo ? [r.photo] : []));
+    if (photos.length > 0) {
+      onUploadComplete(photos);
+    }
+
+    // Keep previews of rejected files so the user can see which ones need attention
+    const rejected = results.filter((r) => r.status === 'rejected');
+    const kept = previewFiles.filter((_, i) => results[i].status === 'rejected');
+    previewFiles
+      .filter((p) => !kept.includes(p))
+      .forEach((p) => URL.revokeObjectURL(p.preview));
+    setPreviewFiles(kept);
+
+    if (rejected.length > 0) {
+      setError(rejected.map((r) => `${r.filename}: ${r.reason}`).join('\n'));
     }
+    setIsUploading(false);
   };
 
   const removePreview = (index: number) => {
@@ -202,7 +223,7 @@ export function PhotoUpload({ onUploadComplete }: PhotoUploadProps) {
             {isUploading ? (
               <>
                 <Loader2 className="w-5 h-5 animate-spin" />
-                Uploading...
+                Uploading... {Math.round(progress * 100)}%
               </>
             ) : (
               <>
@@ -216,7 +237,7 @@ export function PhotoUpload({ onUploadComplete }: PhotoUploadProps) {
 
       {/* Error Message */}
       {error && (
-        <div className="mt-4 p-4 bg-red-50 border border-red-200 rounded-xl text-red-600 text-sm">
+        <div className="mt-4 p-4 bg-red-50 border border-red-200 rounded-xl text-red-600 text-sm whitespace-pre-line">
           {error}
         </div>
       )}
@@ -1,3 +1,6 @@
+// These mirror the server's models, described by the OpenAPI document at /api/v1/openapi.json.
+// Fields marked client-only are never sent by the server.
+
 export interface Photo {
   id: string;
   filename: string;
@@ -6,6 +9,14 @@ export interface Photo {
   uploadedAt: string;
   takenAt?: string;
   metadata?: PhotoMetadata;
+  sha256?: string;
+  phash?: string;
+  width?: number;
+  height?: number;
+  blurHash?: string; // Blurred preview to show while the photo loads
+  dominantColor?: string; // #rrggbb
+  similarTo?: string[];
+  duplicate?: boolean;
 }
 
 export interface PhotoMetadata {
@@ -14,6 +25,15 @@ export interface PhotoMetadata {
   camera?: string;
 }
 
+export interface UserSettings {
+  keepMetadata: boolean; // Serve originals with EXIF data such as location
+}
+
+export interface RenditionsResponse {
+  sizes: { name: string; width: number }[]; // Smallest first
+  formats: string[]; // image/jpeg unless the server was built with libwebp
+}
+
 export interface PhotoCluster {
   id: string;
   draftId?: string; // Server-created draft ID for this cluster
@@ -26,10 +46,10 @@ export interface PhotoCluster {
   suggestedTitle?: string;
   suggestedDescription?: string;
   suggestedTheme?: Theme;
-  dateRange?: string;
-  ageString?: string;
+  dateRange?: string; // Client-only
+  ageString?: string; // Client-only
   backgroundPath?: string;
-  status?: 'draft' | 'approved';
+  status?: 'draft' | 'approved'; // Client-only
 }
 
 export interface PageDraft {
@@ -40,14 +60,47 @@ export interface PageDraft {
   description: string;
   theme: Theme;
   photos?: Photo[]; // Populated on client side
-  dateRange?: string;
-  ageString?: string;
+  dateRange?: string; // Client-only
+  ageString?: string; // Client-only
   backgroundPath?: string;
+  coverPhotoId?: string;
+  layout?: PageLayout;
   status: 'draft' | 'approved' | 'rejected';
   createdAt: string;
+  capturedAt?: string;
+  bookId?: string;
   approvedAt?: string;
 }
 
+export interface DraftListResponse {
+  drafts: PageDraft[];
+  total: number;
+  next?: string;
+}
+
+// Rectangle in fractions (0-1) of the page or photo
+export interface LayoutRect {
+  x: number;
+  y: number;
+  w: number;
+  h: number;
+}
+
+export interface PhotoPlacement {
+  photoId: string;
+  slot: string;
+  frame: LayoutRect;
+  crop: LayoutRect;
+  rotation: number;
+  z: number;
+}
+
+export interface PageLayout {
+  template: 'single-hero' | 'two-up' | 'three-grid' | 'collage' | 'polaroid-scatter';
+  auto: boolean;
+  placements: PhotoPlacement[];
+}
+
 export type Theme = 
   | 'adventure'
   | 'cozy'
@@ -64,15 +117,42 @@ export interface UploadResponse {
   success: boolean;
   message: string;
   photos?: Photo[];
+  results: UploadFileResult[];
+}
+
+export interface UploadFileResult {
+  filename: string;
+  status: 'accepted' | 'duplicate' | 'rejected';
+  code?: string;
+  reason?: string;
+  photo?: Photo;
+  duplicateOf?: string;
 }
 
 export interface ClusterResponse {
   success?: boolean;
   clusters: PhotoCluster[];
   drafts: PageDraft[];
+  skipped?: string[];
 }
 
+// Error responses are RFC 7807 problem documents (application/problem+json)
 export interface ErrorResponse {
-  success: boolean;
-  error: string;
+  type: string;
+  title: string;
+  status: number;
+  detail: string;
+  code: string; // Stable error code, e.g. 'draft_not_found'
+  requestId?: string;
+  errors?: FieldError[];
+  retryable?: boolean;
+  retryAfter?: number; // Seconds
+  success: false;
+  error: string; // Same as detail
+}
+
+export interface FieldError {
+  field: string;
+  code?: string;
+  message: string;
 }
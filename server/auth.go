@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// sessionCookieName is the cookie Clerk keeps the session token in
+	sessionCookieName = "__session"
+	// jwksRefreshInterval limits how often unknown key IDs trigger a refetch of the signing keys
+	jwksRefreshInterval = time.Minute
+	// tokenClockSkew is how far the clocks of Clerk and this server may disagree
+	tokenClockSkew = 5 * time.Second
+)
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired or not yet valid")
+	errTokenIssuer    = errors.New("token issued by another Clerk instance")
+	errTokenParty     = errors.New("token issued to an origin that isn't authorized")
+)
+
+// jwksCache holds the public keys Clerk signs session tokens with, by key ID
+type jwksCache struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time          // When the last fetch finished, successful or not
+	fetches singleflight.Group // Requests with unknown key IDs share one fetch
+}
+
+// sessionIssuer is the iss session tokens must carry: the clerkIssuer setting, or else the
+// Clerk frontend API the keys are fetched from
+func (c Config) sessionIssuer() string {
+	if c.ClerkIssuer != "" {
+		return strings.TrimSuffix(c.ClerkIssuer, "/")
+	}
+	u, err := url.Parse(c.ClerkJWKSURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// sessionUserKey is the request context key identifySession stores the signed-in user under
+type sessionUserKey struct{}
+
+// identifySession verifies the session token a request carries once, before any handler runs,
+// and stores the user it belongs to in the request context for requestUser
+func (a *App) identifySession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sessionUserKey{}, a.sessionUser(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireSession answers requests to user-scoped routes that aren't signed in with 401 when
+// sign-in is configured, so anonymous callers can't reach photos and drafts that have no owner.
+// Without sign-in every request is anonymous and they go through.
+func (a *App) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.ClerkJWKSURL != "" && a.requestUser(r) == "" {
+			SendError(w, codeSignInRequired, "Sign in to use your photos and drafts", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestUser returns the ID of the signed-in user making a request, as identifySession found
+// it, or "" when the request is anonymous or sign-in isn't configured. Requests that didn't go
+// through identifySession are anonymous.
+func (a *App) requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(sessionUserKey{}).(string)
+	return user
+}
+
+// sessionUser verifies the Clerk session token of a request and returns its user. The token is
+// read from a bearer token, or, for GET and HEAD, from the session cookie Clerk sets, which image
+// requests from the same site carry. Browsers attach the cookie to requests other sites make too,
+// so it doesn't sign in requests that change anything.
+// Verification needs the clerkJwksUrl setting, e.g. https://<your-app>.clerk.accounts.dev/.well-known/jwks.json
+func (a *App) sessionUser(r *http.Request) string {
+	if a.cfg.ClerkJWKSURL == "" {
+		return ""
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return ""
+		}
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			return ""
+		}
+		token = cookie.Value
+	}
+
+	userID, err := a.verifySessionToken(token)
+	if err != nil {
+		return ""
+	}
+	return userID
+}
+
+// verifySessionToken checks an RS256 session token from the configured Clerk instance and
+// returns its subject
+func (a *App) verifySessionToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	key, err := a.sessionKeys.key(a.cfg.ClerkJWKSURL, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errTokenMalformed
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", errTokenSignature
+	}
+
+	var claims struct {
+		Sub string `json:"sub"`
+		Iss string `json:"iss"`
+		Azp string `json:"azp"` // Origin the token was issued to; absent for tokens not made in a browser
+		Exp int64  `json:"exp"`
+		Nbf int64  `json:"nbf"`
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if now.After(time.Unix(claims.Exp, 0).Add(tokenClockSkew)) || now.Before(time.Unix(claims.Nbf, 0).Add(-tokenClockSkew)) {
+		return "", errTokenExpired
+	}
+	if claims.Iss != a.cfg.sessionIssuer() {
+		return "", errTokenIssuer
+	}
+	if claims.Azp != "" && !a.sessionAzp.allowed(claims.Azp) {
+		return "", errTokenParty
+	}
+	if claims.Sub == "" {
+		return "", errTokenMalformed
+	}
+	return claims.Sub, nil
+}
+
+// decodeTokenPart decodes one base64url JSON segment of a token
+func decodeTokenPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errTokenMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errTokenMalformed
+	}
+	return nil
+}
+
+// key returns the public key with the given ID, refetching the key set when the ID is unknown,
+// e.g. after Clerk rotates its keys. The lock isn't held during the fetch, so tokens signed with
+// known keys are verified while it runs; unknown IDs, which anyone can put in a token, trigger
+// at most one fetch per jwksRefreshInterval.
+func (c *jwksCache) key(jwksURL, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	due := time.Since(c.fetched) >= jwksRefreshInterval
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !due {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	_, err, _ := c.fetches.Do(jwksURL, func() (any, error) {
+		c.mu.Lock()
+		due := time.Since(c.fetched) >= jwksRefreshInterval // A fetch may have finished since
+		c.mu.Unlock()
+		if !due {
+			return nil, nil
+		}
+
+		keys, err := fetchJWKS(jwksURL)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.fetched = time.Now()
+		if err != nil {
+			log.Printf("Warning: failed to fetch session signing keys: %v", err)
+			return nil, err
+		}
+		c.keys = keys
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetchJWKS downloads a JSON Web Key Set and returns its RSA keys by key ID
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse key set: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
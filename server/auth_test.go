@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signTestToken returns a token with the given header and claims, signed with key using RS256
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// testSessionKey generates a signing key and makes it the app's only session key, under kid "test"
+func testSessionKey(t *testing.T, a *App) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.sessionKeys = &jwksCache{keys: map[string]*rsa.PublicKey{"test": &key.PublicKey}, fetched: time.Now()}
+	return key
+}
+
+// useTestSessionKey makes session tokens signed by a test key valid for the app, and returns
+// a function that signs a token for a user
+func useTestSessionKey(t *testing.T, a *App) func(user string) string {
+	t.Helper()
+	key := testSessionKey(t, a)
+	return func(user string) string {
+		return signTestToken(t, key, map[string]any{"alg": "RS256", "kid": "test"}, map[string]any{
+			"sub": user, "iss": a.cfg.sessionIssuer(), "exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ClerkJWKSURL = "https://clerk.example.com/.well-known/jwks.json"
+	a := newTestApp(t, cfg)
+	key := testSessionKey(t, a)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	header := map[string]any{"alg": "RS256", "kid": "test"}
+	claims := map[string]any{
+		"sub": "user_alice",
+		"iss": "https://clerk.example.com",
+		"azp": "http://localhost:5173",
+		"exp": now.Add(time.Minute).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+	with := func(base map[string]any, k string, v any) map[string]any {
+		m := maps.Clone(base)
+		if v == nil {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+		return m
+	}
+
+	errAny := errors.New("any error") // For failures without a sentinel error
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   error // nil when the token is valid
+	}{
+		{"valid", signTestToken(t, key, header, claims), nil},
+		{"no azp", signTestToken(t, key, header, with(claims, "azp", nil)), nil},
+		{"bad signature", signTestToken(t, otherKey, header, claims), errTokenSignature},
+		{"expired", signTestToken(t, key, header, with(claims, "exp", now.Add(-time.Minute).Unix())), errTokenExpired},
+		{"not yet valid", signTestToken(t, key, header, with(claims, "nbf", now.Add(time.Minute).Unix())), errTokenExpired},
+		{"wrong alg", signTestToken(t, key, with(header, "alg", "HS256"), claims), errAny},
+		{"no alg", signTestToken(t, key, with(header, "alg", "none"), claims), errAny},
+		{"wrong iss", signTestToken(t, key, header, with(claims, "iss", "https://evil.example.com")), errTokenIssuer},
+		{"no iss", signTestToken(t, key, header, with(claims, "iss", nil)), errTokenIssuer},
+		{"wrong azp", signTestToken(t, key, header, with(claims, "azp", "https://evil.example.com")), errTokenParty},
+		{"unknown kid", signTestToken(t, key, with(header, "kid", "rotated"), claims), errAny},
+		{"no sub", signTestToken(t, key, header, with(claims, "sub", nil)), errTokenMalformed},
+		{"malformed", "not.a-token", errTokenMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user, err := a.verifySessionToken(tc.token)
+			switch {
+			case tc.err == nil:
+				if err != nil || user != "user_alice" {
+					t.Fatalf("got %q, %v; want user_alice", user, err)
+				}
+			case err == nil:
+				t.Fatalf("got %q; want an error", user)
+			case tc.err != errAny && !errors.Is(err, tc.err):
+				t.Fatalf("got %v; want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSessionIssuerFromConfig(t *testing.T) {
+	for _, tc := range []struct {
+		jwks, issuer, want string
+	}{
+		{"https://app.clerk.accounts.dev/.well-known/jwks.json", "", "https://app.clerk.accounts.dev"},
+		{"https://app.clerk.accounts.dev/.well-known/jwks.json", "https://clerk.example.com/", "https://clerk.example.com"},
+		{"jwks.json", "", ""},
+	} {
+		cfg := Config{ClerkJWKSURL: tc.jwks, ClerkIssuer: tc.issuer}
+		if got := cfg.sessionIssuer(); got != tc.want {
+			t.Errorf("sessionIssuer(%q, %q) = %q; want %q", tc.jwks, tc.issuer, got, tc.want)
+		}
+	}
+}
+
+func TestSessionCookieOnlySignsInReads(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ClerkJWKSURL = "https://clerk.example.com/.well-known/jwks.json"
+	a := newTestApp(t, cfg)
+	token := useTestSessionKey(t, a)("user_alice")
+
+	for _, tc := range []struct {
+		method string
+		cookie bool
+		want   string
+	}{
+		{http.MethodGet, true, "user_alice"},
+		{http.MethodHead, true, "user_alice"},
+		{http.MethodPost, true, ""},
+		{http.MethodPut, true, ""},
+		{http.MethodDelete, true, ""},
+		{http.MethodPost, false, "user_alice"},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/v1/photos", nil)
+		if tc.cookie {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if got := a.sessionUser(req); got != tc.want {
+			t.Errorf("%s with cookie=%v: user %q; want %q", tc.method, tc.cookie, got, tc.want)
+		}
+	}
+}
+
+func TestOwnerlessItemsNeedSignInAndAClaim(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	legacy := Photo{ID: "legacy", Filename: "legacy.png", UploadedAt: time.Now()}
+	if err := a.catalog.Add(t.Context(), catalogEntry{Photo: legacy, Key: "legacy.png"}); err != nil {
+		t.Fatal(err)
+	}
+	a.drafts["dl"] = PageDraft{ID: "dl", PhotoIds: []string{"legacy"}, Status: "draft"}
+
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/photos"},
+		{"POST", "/photos/upload"},
+		{"POST", "/uploads"},
+		{"GET", "/drafts"},
+		{"GET", "/photos/trash"},
+	} {
+		if rec := sendAs(t, router, sign, "", tc.method, tc.path, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s %s = %d; want 401", tc.method, tc.path, rec.Code)
+		}
+	}
+
+	if rec := sendAs(t, router, sign, "user_alice", "GET", "/photos", ""); strings.Contains(rec.Body.String(), "legacy") {
+		t.Errorf("alice's photos include one without an owner: %s", rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "GET", "/drafts/dl", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("alice getting a draft without an owner = %d; want 403", rec.Code)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/legacy", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("alice deleting a photo without an owner = %d; want 403", rec.Code)
+	}
+
+	if n, err := a.claimOwnerless(t.Context(), "user_alice"); err != nil || n != 1 {
+		t.Fatalf("claimOwnerless = %d, %v; want 1 photo", n, err)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "GET", "/photos", ""); !strings.Contains(rec.Body.String(), "legacy") {
+		t.Errorf("alice's photos after claiming: %s; want the claimed photo", rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_bob", "GET", "/photos", ""); strings.Contains(rec.Body.String(), "legacy") {
+		t.Errorf("bob sees alice's claimed photo: %s", rec.Body)
+	}
+}
+
+func TestOwnerlessItemsAreSharedWithoutSignIn(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	if err := a.catalog.Add(t.Context(), catalogEntry{Photo: Photo{ID: "legacy", UploadedAt: time.Now()}, Key: "legacy.png"}); err != nil {
+		t.Fatal(err)
+	}
+	rec := sendAs(t, a.newRouter(), nil, "", "GET", "/photos", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "legacy") {
+		t.Errorf("anonymous listing without sign-in configured: %d %s; want the photo", rec.Code, rec.Body)
+	}
+}
+
+func TestJWKSFetchDoesNotBlockKnownKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "rotated",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	cache := &jwksCache{keys: map[string]*rsa.PublicKey{"known": &key.PublicKey}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.key(srv.URL, "rotated")
+			errs <- err
+		}()
+	}
+
+	// Wait for the fetch to start, then check a known key doesn't wait for it
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.key(srv.URL, "known")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("known key: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known key lookup waited for the key set fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("rotated key: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("key set fetched %d times; want once for all requests", n)
+	}
+
+	if _, err := cache.key(srv.URL, "bogus"); err == nil {
+		t.Error("unknown key accepted")
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("unknown key right after a fetch refetched the key set (%d fetches)", n)
+	}
+}
+
+func TestSessionVerifiedOnceBeforeHandlers(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ClerkJWKSURL = "https://clerk.example.com/.well-known/jwks.json"
+	a := newTestApp(t, cfg)
+	token := useTestSessionKey(t, a)("user_alice")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/photos", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if got := a.requestUser(req); got != "" {
+		t.Errorf("user without identifySession = %q; want the token left unverified", got)
+	}
+
+	var users []string
+	a.identifySession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without the key a second verification would fail
+		a.sessionKeys = &jwksCache{fetched: time.Now()}
+		users = append(users, a.requestUser(r), a.requestUser(r))
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if len(users) != 2 || users[0] != "user_alice" || users[1] != "user_alice" {
+		t.Errorf("users in the handler = %q; want alice each time", users)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// catalogKey is where the photo catalog is persisted in the blob store
+const catalogKey = "catalog.json"
+
+// catalogEntry is a photo plus the storage key of its original and who it belongs to
+type catalogEntry struct {
+	Photo
+	Key   string `json:"key"`
+	Owner string `json:"owner,omitempty"` // User ID of the uploader; empty for photos uploaded without signing in
+	// BackfillFailed marks originals that couldn't be decoded when their details were backfilled,
+	// so they aren't read again on every start
+	BackfillFailed bool `json:"backfillFailed,omitempty"`
+}
+
+// visibleTo reports whether a user may see and manage a photo. Without sign-in configured every
+// request is anonymous and shares the photos uploaded that way. With it, user-scoped routes need a
+// session, so photos without an owner stay hidden until they're claimed with -claim-ownerless.
+func (e catalogEntry) visibleTo(user string) bool {
+	return e.Owner == user
+}
+
+// ownedHash identifies a photo's content within one owner's photos. Duplicates are only
+// detected per owner, so uploading a photo never reveals or returns someone else's copy.
+type ownedHash struct {
+	owner string
+	sha   string
+}
+
+// photoCatalog indexes every stored photo by ID and, per owner, by content hash. Near-duplicates
+// are found when a photo is added rather than each time photos are listed.
+type photoCatalog struct {
+	store   BlobStore  // Where the catalog is persisted
+	saveMu  sync.Mutex // Held from snapshot to write, so an older snapshot never overwrites a newer one
+	mu      sync.RWMutex
+	photos  map[string]catalogEntry
+	bySHA   map[ownedHash]string // Owner and SHA-256 -> photo ID
+	similar map[string][]string  // Photo ID -> sorted IDs of the same owner's near-duplicates
+}
+
+// newPhotoCatalog returns an empty catalog persisted to store
+func newPhotoCatalog(store BlobStore) *photoCatalog {
+	return &photoCatalog{
+		store:   store,
+		photos:  make(map[string]catalogEntry),
+		bySHA:   make(map[ownedHash]string),
+		similar: make(map[string][]string),
+	}
+}
+
+// ownedPhotoID returns the ID a new upload is stored under: a hash of the owner and the content,
+// so each owner has their own copy of a photo others uploaded too
+func ownedPhotoID(owner, sum string) string {
+	id := sha256.Sum256([]byte(owner + "\x00" + sum))
+	return hex.EncodeToString(id[:])
+}
+
+// backgroundCatalog indexes the generated page backgrounds by storage key. It is rebuilt from
+// the store on startup.
+type backgroundCatalog struct {
+	mu   sync.RWMutex
+	keys map[string]bool
+}
+
+// newBackgroundCatalog returns an empty background catalog
+func newBackgroundCatalog() *backgroundCatalog {
+	return &backgroundCatalog{keys: make(map[string]bool)}
+}
+
+// Has reports whether a key is a generated background
+func (c *backgroundCatalog) Has(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keys[key]
+}
+
+// Add registers a generated background
+func (c *backgroundCatalog) Add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[key] = true
+}
+
+// Remove forgets a deleted background
+func (c *backgroundCatalog) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.keys, key)
+}
+
+// Get returns a photo by ID
+func (c *photoCatalog) Get(id string) (catalogEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.photos[id]
+	return e, ok
+}
+
+// FindBySHA returns the owner's photo with the given content hash
+func (c *photoCatalog) FindBySHA(owner, sum string) (catalogEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.bySHA[ownedHash{owner, sum}]
+	if !ok {
+		return catalogEntry{}, false
+	}
+	return c.photos[id], true
+}
+
+// All returns the photos owned by a user, oldest upload first
+func (c *photoCatalog) All(owner string) []Photo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	photos := make([]Photo, 0, len(c.photos))
+	for _, e := range c.photos {
+		if e.visibleTo(owner) {
+			photos = append(photos, c.withSimilar(e))
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].UploadedAt.Equal(photos[j].UploadedAt) {
+			return photos[i].ID < photos[j].ID
+		}
+		return photos[i].UploadedAt.Before(photos[j].UploadedAt)
+	})
+	return photos
+}
+
+// Photo returns the API view of a photo, including its current near-duplicates
+func (c *photoCatalog) Photo(id string) (Photo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.photos[id]
+	if !ok {
+		return Photo{}, false
+	}
+	return c.withSimilar(e), true
+}
+
+// withSimilar returns a photo with SimilarTo filled in with the same owner's photos whose
+// perceptual hash is close. Callers must hold mu.
+func (c *photoCatalog) withSimilar(e catalogEntry) Photo {
+	p := e.Photo
+	p.SimilarTo = slices.Clone(c.similar[e.ID])
+	return p
+}
+
+// put inserts or replaces a photo and links it with its near-duplicates. Callers must hold mu
+// for writing.
+func (c *photoCatalog) put(e catalogEntry) {
+	c.unlinkSimilar(e.ID)
+	c.photos[e.ID] = e
+	if e.PHash == "" {
+		return
+	}
+	for id, other := range c.photos {
+		if id != e.ID && other.Owner == e.Owner && isNearDuplicate(e.PHash, other.PHash) {
+			c.similar[e.ID] = insertSorted(c.similar[e.ID], id)
+			c.similar[id] = insertSorted(c.similar[id], e.ID)
+		}
+	}
+}
+
+// remove deletes a photo and its near-duplicate links. Callers must hold mu for writing.
+func (c *photoCatalog) remove(id string) {
+	c.unlinkSimilar(id)
+	delete(c.photos, id)
+}
+
+// unlinkSimilar removes a photo from the near-duplicates of the photos it was similar to
+func (c *photoCatalog) unlinkSimilar(id string) {
+	for _, other := range c.similar[id] {
+		if rest := slices.DeleteFunc(c.similar[other], func(s string) bool { return s == id }); len(rest) > 0 {
+			c.similar[other] = rest
+		} else {
+			delete(c.similar, other)
+		}
+	}
+	delete(c.similar, id)
+}
+
+// insertSorted adds id to a sorted list of IDs unless it's already there
+func insertSorted(ids []string, id string) []string {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+// Add inserts or replaces a photo and persists the catalog
+func (c *photoCatalog) Add(ctx context.Context, e catalogEntry) error {
+	c.mu.Lock()
+	c.put(e)
+	if e.SHA256 != "" {
+		c.bySHA[ownedHash{e.Owner, e.SHA256}] = e.ID
+	}
+	c.mu.Unlock()
+	return c.save(ctx)
+}
+
+// Remove deletes a photo from the catalog and persists it
+func (c *photoCatalog) Remove(ctx context.Context, id string) error {
+	c.mu.Lock()
+	if e, ok := c.photos[id]; ok {
+		if c.bySHA[ownedHash{e.Owner, e.SHA256}] == id {
+			delete(c.bySHA, ownedHash{e.Owner, e.SHA256})
+		}
+		c.remove(id)
+	}
+	c.mu.Unlock()
+	return c.save(ctx)
+}
+
+// save writes the catalog to the blob store
+func (c *photoCatalog) save(ctx context.Context) error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.RLock()
+	entries := make([]catalogEntry, 0, len(c.photos))
+	for _, e := range c.photos {
+		// The path is derived from the key on load rather than stored signed
+		e.Path = mediaPath{}
+		entries = append(entries, e)
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return putBlob(ctx, c.store, catalogKey, data, "application/json")
+}
+
+// loadCatalog reads the persisted catalog and adds any originals in the store it doesn't know about,
+// such as photos uploaded before the catalog existed. Backgrounds are indexed from the store.
+func (a *App) loadCatalog(ctx context.Context) error {
+	data, err := readBlob(ctx, a.store, catalogKey)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return fmt.Errorf("failed to read catalog: %w", err)
+	}
+
+	var entries []catalogEntry
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("failed to parse catalog: %w", err)
+		}
+	}
+
+	a.catalog.mu.Lock()
+	for _, e := range entries {
+		e.Path = a.uploadPath(e.Key)
+		a.catalog.put(e)
+		if e.SHA256 != "" {
+			a.catalog.bySHA[ownedHash{e.Owner, e.SHA256}] = e.ID
+		}
+	}
+	a.catalog.mu.Unlock()
+
+	blobs, err := a.store.List(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list photos: %w", err)
+	}
+
+	added := 0
+	for _, blob := range blobs {
+		if name, ok := strings.CutPrefix(blob.Key, backgroundPrefix); ok && !strings.Contains(name, "/") {
+			a.backgrounds.Add(blob.Key)
+			continue
+		}
+		if !isOriginalKey(blob.Key) {
+			continue
+		}
+		id := strings.TrimSuffix(blob.Key, filepath.Ext(blob.Key))
+		if _, ok := a.catalog.Get(id); ok {
+			continue
+		}
+
+		data, err := readBlob(ctx, a.store, blob.Key)
+		if err != nil {
+			log.Printf("Warning: failed to read %s for catalog: %v", blob.Key, err)
+			continue
+		}
+
+		e := catalogEntry{
+			Photo: Photo{
+				ID:         id,
+				Filename:   blob.Key,
+				Path:       a.uploadPath(blob.Key),
+				Size:       blob.Size,
+				UploadedAt: blob.ModTime,
+			},
+			Key: blob.Key,
+		}
+		describeImage(&e.Photo, data)
+
+		a.catalog.mu.Lock()
+		a.catalog.put(e)
+		a.catalog.bySHA[ownedHash{e.Owner, e.SHA256}] = id
+		a.catalog.mu.Unlock()
+		added++
+	}
+
+	if added > 0 {
+		log.Printf("Added %d existing photo(s) to the catalog", added)
+		return a.catalog.save(ctx)
+	}
+	return nil
+}
+
+// claimOwnerless gives the photos and trashed photos that have no owner to a user. Servers that
+// turn on sign-in after photos were uploaded without it run it once, since ownerless photos are
+// hidden from signed-in users. Drafts aren't persisted, so there are none to claim.
+func (a *App) claimOwnerless(ctx context.Context, owner string) (int, error) {
+	if !validUserID.MatchString(owner) {
+		return 0, fmt.Errorf("invalid user ID %q", owner)
+	}
+
+	claimed := 0
+	a.catalog.mu.Lock()
+	for id, e := range a.catalog.photos {
+		if e.Owner != "" {
+			continue
+		}
+		if a.catalog.bySHA[ownedHash{"", e.SHA256}] == id {
+			delete(a.catalog.bySHA, ownedHash{"", e.SHA256})
+		}
+		e.Owner = owner
+		a.catalog.put(e)
+		if _, taken := a.catalog.bySHA[ownedHash{owner, e.SHA256}]; e.SHA256 != "" && !taken {
+			a.catalog.bySHA[ownedHash{owner, e.SHA256}] = id
+		}
+		claimed++
+	}
+	a.catalog.mu.Unlock()
+	if claimed > 0 {
+		if err := a.catalog.save(ctx); err != nil {
+			return 0, fmt.Errorf("failed to save catalog: %w", err)
+		}
+	}
+
+	entries, err := a.listTrash(ctx)
+	if err != nil {
+		return claimed, fmt.Errorf("failed to read trash: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Owner != "" {
+			continue
+		}
+		entry.Owner = owner
+		if err := a.writeTrashEntry(ctx, entry); err != nil {
+			return claimed, fmt.Errorf("failed to claim trashed photo %s: %w", entry.PhotoID, err)
+		}
+		claimed++
+	}
+	return claimed, nil
+}
+
+// isOriginalKey reports whether a storage key is an original photo rather than a rendition,
+// background or other file
+func isOriginalKey(key string) bool {
+	return !strings.Contains(key, "/") && !strings.Contains(key, "_") && isValidImageType(key)
+}
+
+// describeImage fills in the content hash, perceptual hash and dimensions of a photo
+func describeImage(p *Photo, data []byte) {
+	sum := sha256.Sum256(data)
+	p.SHA256 = hex.EncodeToString(sum[:])
+	if format, ok := sniffImageFormat(data); ok {
+		readPhotoMetadata(p, data, format)
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		// Formats we can't decode still get exact duplicate detection
+		return
+	}
+	describeDecoded(p, img)
+}
+
+// describeDecoded fills in the perceptual hash, dimensions and placeholders from an already decoded
+// image, which must have been decoded with imaging.AutoOrientation so they describe the photo upright
+func describeDecoded(p *Photo, img image.Image) {
+	bounds := img.Bounds()
+	p.Width, p.Height = bounds.Dx(), bounds.Dy()
+	p.PHash = perceptualHash(img)
+	p.BlurHash, p.DominantColor = placeholders(img)
+}
+
+// backfillPhotoDetails computes details added to the catalog after some photos were uploaded,
+// such as placeholders and EXIF metadata, by reading the originals again. Originals that can't
+// be decoded are marked and skipped from then on. When ctx is canceled it saves the photos done
+// so far and leaves the rest for the next start.
+func (a *App) backfillPhotoDetails(ctx context.Context) {
+	a.catalog.mu.RLock()
+	var missing []catalogEntry
+	for _, e := range a.catalog.photos {
+		if !e.BackfillFailed && (e.BlurHash == "" || e.Width == 0 || e.Metadata == nil) {
+			missing = append(missing, e)
+		}
+	}
+	a.catalog.mu.RUnlock()
+
+	updated := 0
+	for _, e := range missing {
+		if ctx.Err() != nil {
+			break
+		}
+		data, err := readBlob(ctx, a.store, e.Key)
+		if err != nil {
+			log.Printf("Warning: failed to read %s for backfill: %v", e.Key, err)
+			continue
+		}
+
+		if format, ok := sniffImageFormat(data); ok {
+			readPhotoMetadata(&e.Photo, data, format)
+		}
+		if e.BlurHash == "" || e.Width == 0 {
+			img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+			if err != nil {
+				log.Printf("Warning: failed to decode %s for backfill, skipping it from now on: %v", e.Key, err)
+				e.BackfillFailed = true
+			} else {
+				describeDecoded(&e.Photo, img)
+			}
+		}
+
+		a.catalog.mu.Lock()
+		a.catalog.put(e)
+		a.catalog.mu.Unlock()
+		updated++
+	}
+
+	if updated > 0 {
+		log.Printf("Backfilled details for %d photo(s)", updated)
+		if err := a.catalog.save(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("Warning: failed to save catalog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFirstPutStore delays the first write, so a later write can finish before it
+type slowFirstPutStore struct {
+	BlobStore
+	puts atomic.Int32
+}
+
+func (s *slowFirstPutStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if s.puts.Add(1) == 1 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return s.BlobStore.Put(ctx, key, r, size, contentType)
+}
+
+func TestCatalogSavesAreNotReordered(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	catalog := newPhotoCatalog(&slowFirstPutStore{BlobStore: a.store})
+
+	var wg sync.WaitGroup
+	for i, id := range []string{"first", "second"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 20 * time.Millisecond)
+			if err := catalog.Add(t.Context(), catalogEntry{Photo: Photo{ID: id}, Key: id + ".jpg", Owner: "user_alice"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := readBlob(t.Context(), a.store, catalogKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []catalogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("persisted catalog has %d entries; want both photos", len(entries))
+	}
+}
+
+func TestNearDuplicatesFollowCatalogChanges(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	add := func(id, owner, phash string) {
+		t.Helper()
+		if err := a.catalog.Add(t.Context(), catalogEntry{Photo: Photo{ID: id, PHash: phash}, Key: id + ".png", Owner: owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	similar := func(id string, want ...string) {
+		t.Helper()
+		if p, _ := a.catalog.Photo(id); !slices.Equal(p.SimilarTo, want) {
+			t.Errorf("%s similar to %q; want %q", id, p.SimilarTo, want)
+		}
+	}
+
+	add("p1", "user_alice", "0000000000000000")
+	add("p2", "user_alice", "0000000000000001")
+	add("p3", "user_bob", "0000000000000000")
+	add("p4", "user_alice", "ffffffffffffffff")
+	add("p5", "", "0000000000000003")
+	similar("p1", "p2")
+	similar("p2", "p1")
+	similar("p3")
+	similar("p4")
+
+	// Replacing a photo relinks it by its new hash
+	add("p2", "user_alice", "ffffffffffffff00")
+	similar("p1")
+	similar("p2", "p4")
+	similar("p4", "p2")
+
+	if err := a.catalog.Remove(t.Context(), "p4"); err != nil {
+		t.Fatal(err)
+	}
+	similar("p2")
+
+	// Claimed photos become similar to their new owner's photos
+	if _, err := a.claimOwnerless(t.Context(), "user_alice"); err != nil {
+		t.Fatal(err)
+	}
+	similar("p1", "p5")
+	if got := a.catalog.All("user_alice"); len(got) != 3 || !slices.Equal(got[0].SimilarTo, []string{"p5"}) {
+		t.Errorf("alice's photos = %+v; want p1 similar to p5", got)
+	}
+}
+
+func TestBackfillSkipsPhotosThatFailedToDecode(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	putTestBlob(t, a, "bad.png", "not an image")
+	if err := a.catalog.Add(t.Context(), catalogEntry{Photo: Photo{ID: "bad", Filename: "bad.png"}, Key: "bad.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.backfillPhotoDetails(t.Context())
+	if e, _ := a.catalog.Get("bad"); !e.BackfillFailed {
+		t.Fatalf("entry after backfill = %+v; want the failure recorded", e)
+	}
+
+	// The failure is persisted, so the next start doesn't read the original again
+	a.catalog = newPhotoCatalog(a.store)
+	if err := a.loadCatalog(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{BlobStore: a.store, gets: make(map[string]int)}
+	a.store = store
+	a.backfillPhotoDetails(t.Context())
+	if n := store.gets["bad.png"]; n != 0 {
+		t.Errorf("backfill read the original %d time(s); want none", n)
+	}
+}
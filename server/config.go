@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server's configuration. Each setting is read, in increasing order of
+// precedence, from its default, the YAML config file, the environment and the command line.
+// The tags name the setting in each: yaml for the file, env for the environment variable and
+// flag for the command-line flag. Settings tagged secret are redacted when printed.
+type Config struct {
+	Addr        string `yaml:"addr" env:"ADDR" flag:"addr" usage:"Address to listen on"`
+	TLSCertFile string `yaml:"tlsCertFile" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"Certificate (PEM) to serve HTTPS with; plain HTTP without it"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"Private key (PEM) for tlsCertFile"`
+
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"Time allowed to send request headers"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"READ_TIMEOUT" flag:"read-timeout" usage:"Time allowed to send a whole request, including uploads"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"WRITE_TIMEOUT" flag:"write-timeout" usage:"Time allowed to handle a request and write the response, including clustering"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"IDLE_TIMEOUT" flag:"idle-timeout" usage:"How long idle keep-alive connections stay open"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"How long to wait for requests and background jobs on shutdown"`
+
+	CORSOrigins     []string `yaml:"corsOrigins" env:"CORS_ORIGINS" flag:"cors-origins" usage:"Comma-separated origins allowed to call the API from a browser; https://*.example.com matches subdomains"`
+	CORSCredentials bool     `yaml:"corsCredentials" env:"CORS_CREDENTIALS" flag:"cors-credentials" usage:"Let allowed origins send cookies with requests"`
+
+	UploadDir        string   `yaml:"uploadDir" env:"UPLOAD_DIR" flag:"upload-dir" usage:"Directory for the local storage backend"`
+	UploadSessionDir string   `yaml:"uploadSessionDir" env:"UPLOAD_SESSION_DIR" flag:"upload-session-dir" usage:"Directory for resumable uploads in progress; must be shared by every instance behind one address"`
+	MaxFileSize      byteSize `yaml:"maxFileSize" env:"MAX_FILE_SIZE" flag:"max-file-size" usage:"Largest photo accepted, e.g. 5MB"`
+	MaxTotalSize     byteSize `yaml:"maxTotalSize" env:"MAX_TOTAL_SIZE" flag:"max-total-size" usage:"Largest upload request, e.g. 50MB"`
+	MaxPhotoCount    int      `yaml:"maxPhotoCount" env:"MAX_PHOTO_COUNT" flag:"max-photo-count" usage:"Most photos accepted per upload request"`
+
+	ThumbWidth  int             `yaml:"thumbWidth" env:"THUMB_WIDTH" flag:"thumb-width" usage:"Width thumbnails are fitted to"`
+	ThumbHeight int             `yaml:"thumbHeight" env:"THUMB_HEIGHT" flag:"thumb-height" usage:"Height thumbnails are fitted to"`
+	Renditions  RenditionWidths `yaml:"renditions"`
+
+	GeminiAPIKey     string `yaml:"geminiApiKey" env:"GEMINI_API_KEY" secret:"true" usage:"Gemini API key; mock clusters are used without it"`
+	GeminiModel      string `yaml:"geminiModel" env:"GEMINI_MODEL" flag:"gemini-model" usage:"Gemini model that clusters photos and writes page text"`
+	GeminiImageModel string `yaml:"geminiImageModel" env:"GEMINI_IMAGE_MODEL" flag:"gemini-image-model" usage:"Gemini model that draws page backgrounds"`
+
+	ClerkJWKSURL           string   `yaml:"clerkJwksUrl" env:"CLERK_JWKS_URL" flag:"clerk-jwks-url" usage:"Clerk JWKS endpoint used to identify signed-in users"`
+	ClerkIssuer            string   `yaml:"clerkIssuer" env:"CLERK_ISSUER" flag:"clerk-issuer" usage:"Issuer (iss) session tokens must name; the scheme and host of clerkJwksUrl when unset"`
+	ClerkAuthorizedParties []string `yaml:"clerkAuthorizedParties" env:"CLERK_AUTHORIZED_PARTIES" flag:"clerk-authorized-parties" usage:"Comma-separated origins session tokens may be issued to (azp); corsOrigins when unset"`
+	AdminToken             string   `yaml:"adminToken" env:"ADMIN_TOKEN" secret:"true" usage:"Bearer token for the admin endpoints; they are disabled without it"`
+	PhotoURLSecret         string   `yaml:"photoUrlSecret" env:"PHOTO_URL_SECRET" secret:"true" usage:"Key photo links are signed with"`
+
+	StorageBackend string   `yaml:"storageBackend" env:"STORAGE_BACKEND" flag:"storage-backend" usage:"Blob store: local or s3"`
+	S3             S3Config `yaml:"s3"`
+
+	GCOnStart  bool          `yaml:"gcOnStart" env:"GC_ON_START" flag:"gc-on-start" usage:"Remove orphaned files before serving (backgrounds are left to scheduled GC)"`
+	GCInterval time.Duration `yaml:"gcInterval" env:"GC_INTERVAL" flag:"gc-interval" usage:"Remove orphaned files periodically (e.g. 6h); 0 disables"`
+}
+
+// RenditionWidths are the widths of the named photo sizes served with ?size=
+type RenditionWidths struct {
+	Tile  int `yaml:"tile" env:"RENDITION_TILE_WIDTH" flag:"rendition-tile-width" usage:"Width of grid tiles"`
+	Page  int `yaml:"page" env:"RENDITION_PAGE_WIDTH" flag:"rendition-page-width" usage:"Width of photos in the page view"`
+	Full  int `yaml:"full" env:"RENDITION_FULL_WIDTH" flag:"rendition-full-width" usage:"Width of full-screen photos"`
+	Print int `yaml:"print" env:"RENDITION_PRINT_WIDTH" flag:"rendition-print-width" usage:"Width of photos for printing"`
+}
+
+// defaultConfig returns the settings used when nothing overrides them
+func defaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   time.Minute,
+		CORSOrigins:       []string{"http://localhost:3000", "http://localhost:5173"},
+		CORSCredentials:   true,
+		UploadDir:         "./uploads",
+		UploadSessionDir:  filepath.Join(os.TempDir(), "draw_a_memory-upload-sessions"),
+		MaxFileSize:       5 << 20,
+		MaxTotalSize:      50 << 20,
+		MaxPhotoCount:     10,
+		ThumbWidth:        800,
+		ThumbHeight:       600,
+		Renditions:        RenditionWidths{Tile: 400, Page: 1200, Full: 2048, Print: 3600},
+		GeminiModel:       "gemini-2.5-flash",
+		GeminiImageModel:  "gemini-2.0-flash-exp",
+		StorageBackend:    "local",
+		S3:                S3Config{UseSSL: true},
+	}
+}
+
+// loadConfig reads the configuration. Flags are registered on fs and parsed from args, along
+// with -config naming the YAML file (CONFIG_FILE in the environment). Variables in a .env file
+// are added to the environment first.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using system environment variables")
+	}
+
+	cfg := defaultConfig()
+	fields := configFields(&cfg)
+
+	// Flags are applied after the file and environment, so only collect them while parsing
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (CONFIG_FILE)")
+	flagValues := make(map[*configField]string)
+	for i := range fields {
+		f := &fields[i]
+		if f.Flag == "" {
+			continue
+		}
+		usage := f.Usage
+		if def := formatConfigValue(f.Value); def != "" {
+			usage += " (default " + def + ")"
+		}
+		collect := func(s string) error {
+			flagValues[f] = s
+			return nil
+		}
+		if f.Value.Kind() == reflect.Bool {
+			fs.BoolFunc(f.Flag, usage, collect)
+		} else {
+			fs.Func(f.Flag, usage, collect)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file %s: %w", *configFile, err)
+		}
+	}
+
+	// Empty variables count as unset, so a blank entry in .env doesn't clear a default
+	for _, f := range fields {
+		if v := os.Getenv(f.Env); f.Env != "" && v != "" {
+			if err := setConfigValue(f.Value, v); err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", f.Env, err)
+			}
+		}
+	}
+	for f, v := range flagValues {
+		if err := setConfigValue(f.Value, v); err != nil {
+			return cfg, fmt.Errorf("invalid -%s: %w", f.Flag, err)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every setting that is out of range
+func (c Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr is required"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tlsCertFile and tlsKeyFile must be set together"))
+	}
+	if c.ReadHeaderTimeout <= 0 || c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("timeouts must be positive"))
+	}
+	if _, err := newCORSPolicy(c.CORSOrigins, c.CORSCredentials); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newCORSPolicy(c.ClerkAuthorizedParties, false); err != nil {
+		errs = append(errs, fmt.Errorf("clerkAuthorizedParties: %w", err))
+	}
+	if c.ClerkJWKSURL != "" && c.sessionIssuer() == "" {
+		errs = append(errs, errors.New("clerkIssuer is required when clerkJwksUrl has no host"))
+	}
+	if c.MaxFileSize <= 0 {
+		errs = append(errs, errors.New("maxFileSize must be positive"))
+	}
+	if c.MaxTotalSize < c.MaxFileSize {
+		errs = append(errs, errors.New("maxTotalSize must be at least maxFileSize"))
+	}
+	if c.MaxPhotoCount <= 0 {
+		errs = append(errs, errors.New("maxPhotoCount must be positive"))
+	}
+	if c.ThumbWidth <= 0 || c.ThumbHeight <= 0 {
+		errs = append(errs, errors.New("thumbWidth and thumbHeight must be positive"))
+	}
+	r := c.Renditions
+	if r.Tile <= 0 || r.Tile >= r.Page || r.Page >= r.Full || r.Full >= r.Print {
+		errs = append(errs, errors.New("rendition widths must be positive and increase from tile to print"))
+	}
+	if c.UploadSessionDir == "" {
+		errs = append(errs, errors.New("uploadSessionDir is required"))
+	}
+	switch c.StorageBackend {
+	case "local":
+		if c.UploadDir == "" {
+			errs = append(errs, errors.New("uploadDir is required for the local storage backend"))
+		}
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+			errs = append(errs, errors.New("s3.endpoint and s3.bucket are required for the s3 storage backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown storageBackend %q: use local or s3", c.StorageBackend))
+	}
+	if c.GCInterval < 0 {
+		errs = append(errs, errors.New("gcInterval can't be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Print logs the effective configuration with secrets redacted
+func (c Config) Print() {
+	log.Println("Configuration:")
+	for _, f := range configFields(&c) {
+		v := formatConfigValue(f.Value)
+		if f.Secret && v != "" {
+			v = "[redacted]"
+		}
+		log.Printf("  %s = %s", f.Path, v)
+	}
+}
+
+// configField is one setting of a Config
+type configField struct {
+	Path   string // Dotted YAML path, e.g. s3.bucket
+	Env    string
+	Flag   string
+	Usage  string
+	Secret bool
+	Value  reflect.Value
+}
+
+// configFields lists the settings of a config, descending into nested sections
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := range v.NumField() {
+			sf := v.Type().Field(i)
+			path := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct && !isTextValue(v.Field(i)) {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			fields = append(fields, configField{
+				Path:   path,
+				Env:    sf.Tag.Get("env"),
+				Flag:   sf.Tag.Get("flag"),
+				Usage:  sf.Tag.Get("usage"),
+				Secret: sf.Tag.Get("secret") == "true",
+				Value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return fields
+}
+
+// isTextValue reports whether a setting parses itself from text
+func isTextValue(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+// setConfigValue parses a setting from its text form
+func setConfigValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	if v.Type() == reflect.TypeFor[time.Duration]() {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// formatConfigValue returns the text form of a setting
+func formatConfigValue(v reflect.Value) string {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, _ := m.MarshalText()
+		return string(text)
+	}
+	if items, ok := v.Interface().([]string); ok {
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// byteSize is a size in bytes, written as a number with an optional KB, MB or GB suffix
+// (powers of 1024)
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   byteSize
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// UnmarshalText parses a size such as 5MB or 5242880
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	unit := byteSize(1)
+	for _, u := range byteSizeUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	*b = byteSize(n) * unit
+	return nil
+}
+
+// MarshalText writes the size in the largest unit that divides it
+func (b byteSize) MarshalText() ([]byte, error) {
+	for _, u := range byteSizeUnits {
+		if b != 0 && b%u.size == 0 {
+			return []byte(strconv.FormatInt(int64(b/u.size), 10) + u.suffix), nil
+		}
+	}
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+func (b byteSize) String() string {
+	text, _ := b.MarshalText()
+	return string(text)
+}
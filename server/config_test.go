@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads the configuration from a YAML file with the given contents and args,
+// away from any .env file in the working directory
+func loadTestConfig(t *testing.T, yaml string, args ...string) (Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if yaml != "" {
+		file := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", file}, args...)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return loadConfig(fs, args)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("ADDR", ":2000")
+	t.Setenv("MAX_FILE_SIZE", "8MB")
+	t.Setenv("THUMB_WIDTH", "") // Blank variables don't clear the file's setting
+	t.Setenv("S3_BUCKET", "from-env")
+
+	cfg, err := loadTestConfig(t, `
+addr: ":1000"
+maxFileSize: 6MB
+thumbWidth: 640
+gcInterval: 6h
+s3:
+  bucket: from-file
+  region: eu-west-1
+`, "-addr", ":3000", "-cors-origins", "https://a.example.com, https://b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct{ got, want any }{
+		"flag over env":     {cfg.Addr, ":3000"},
+		"env over file":     {cfg.MaxFileSize, byteSize(8 << 20)},
+		"nested env":        {cfg.S3.Bucket, "from-env"},
+		"file over default": {cfg.ThumbWidth, 640},
+		"nested file":       {cfg.S3.Region, "eu-west-1"},
+		"file duration":     {cfg.GCInterval, 6 * time.Hour},
+		"default":           {cfg.MaxTotalSize, byteSize(50 << 20)},
+		"flag list":         {strings.Join(cfg.CORSOrigins, " "), "https://a.example.com https://b.example.com"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %v; want %v", name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsBadInput(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	for name, tc := range map[string]struct {
+		yaml string
+		args []string
+		want string
+	}{
+		"unknown key":        {yaml: "adress: \":1000\"\n", want: "adress"},
+		"unknown nested key": {yaml: "s3:\n  buckit: photos\n", want: "buckit"},
+		"bad size in file":   {yaml: "maxFileSize: lots\n", want: "invalid size"},
+		"bad flag":           {args: []string{"-thumb-width", "wide"}, want: "-thumb-width"},
+		"invalid result":     {args: []string{"-storage-backend", "ftp"}, want: "unknown storageBackend"},
+	} {
+		if _, err := loadTestConfig(t, tc.yaml, tc.args...); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v; want one mentioning %q", name, err, tc.want)
+		}
+	}
+
+	t.Setenv("MAX_TOTAL_SIZE", "a lot")
+	if _, err := loadTestConfig(t, ""); err == nil || !strings.Contains(err.Error(), "MAX_TOTAL_SIZE") {
+		t.Errorf("bad environment variable: error = %v; want one naming it", err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for text, want := range map[string]byteSize{
+		"10MB":     10 << 20,
+		"10mb":     10 << 20,
+		" 2 GB ":   2 << 30,
+		"3KB":      3 << 10,
+		"512B":     512,
+		"5242880":  5 << 20,
+		"1536":     1536,
+		"0":        0,
+		"1048577B": 1<<20 + 1,
+	} {
+		var b byteSize
+		if err := b.UnmarshalText([]byte(text)); err != nil || b != want {
+			t.Errorf("UnmarshalText(%q) = %d, %v; want %d", text, b, err, want)
+		}
+	}
+	for _, text := range []string{"", "MB", "lots", "5.5MB", "5TB", "10 M B", "9223372036854775807KB"} {
+		var b byteSize
+		if err := b.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %d; want an error", text, b)
+		}
+	}
+
+	// Sizes are written in the largest whole unit and read back unchanged
+	for b, want := range map[byteSize]string{10 << 20: "10MB", 3 << 30: "3GB", 1536: "1536B", 1<<20 + 1: "1048577B", 0: "0"} {
+		text, err := b.MarshalText()
+		if err != nil || string(text) != want {
+			t.Errorf("MarshalText(%d) = %q, %v; want %q", b, text, err, want)
+		}
+		var back byteSize
+		if err := back.UnmarshalText(text); err != nil || back != b {
+			t.Errorf("round trip of %d gave %d, %v", b, back, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := defaultConfig().Validate(); err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	for want, change := range map[string]func(*Config){
+		"addr is required":               func(c *Config) { c.Addr = "" },
+		"tlsCertFile and tlsKeyFile":     func(c *Config) { c.TLSCertFile = "cert.pem" },
+		"timeouts must be positive":      func(c *Config) { c.ShutdownTimeout = 0 },
+		"corsCredentials":                func(c *Config) { c.CORSOrigins = []string{"*"} },
+		"clerkAuthorizedParties":         func(c *Config) { c.ClerkAuthorizedParties = []string{"app.example.com"} },
+		"clerkIssuer is required":        func(c *Config) { c.ClerkJWKSURL = "/jwks.json" },
+		"maxFileSize must be positive":   func(c *Config) { c.MaxFileSize = 0 },
+		"maxTotalSize must be at least":  func(c *Config) { c.MaxTotalSize = c.MaxFileSize - 1 },
+		"maxPhotoCount must be positive": func(c *Config) { c.MaxPhotoCount = 0 },
+		"thumbWidth and thumbHeight":     func(c *Config) { c.ThumbHeight = -1 },
+		"rendition widths":               func(c *Config) { c.Renditions.Page = c.Renditions.Full },
+		"uploadSessionDir is required":   func(c *Config) { c.UploadSessionDir = "" },
+		"uploadDir is required":          func(c *Config) { c.UploadDir = "" },
+		"s3.endpoint and s3.bucket":      func(c *Config) { c.StorageBackend = "s3" },
+		"unknown storageBackend":         func(c *Config) { c.StorageBackend = "ftp" },
+		"gcInterval can't be negative":   func(c *Config) { c.GCInterval = -time.Hour },
+	} {
+		cfg := defaultConfig()
+		change(&cfg)
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v; want one mentioning %q", err, want)
+		}
+	}
+
+	// Every problem is reported at once
+	cfg := defaultConfig()
+	cfg.Addr, cfg.MaxPhotoCount = "", 0
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "addr") || !strings.Contains(err.Error(), "maxPhotoCount") {
+		t.Errorf("error = %v; want both problems", err)
+	}
+}
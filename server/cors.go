@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, Content-Length, Accept, Authorization, If-None-Match, If-Match, Upload-Offset, Upload-Checksum, X-Request-ID"
+	// corsExposeHeaders are the response headers browser code may read besides the safelisted ones
+	corsExposeHeaders = "ETag, Location, Content-Length, Upload-Offset, Upload-Length, Retry-After, X-Request-ID"
+)
+
+// corsPolicy decides which browser origins may call the API
+type corsPolicy struct {
+	anyOrigin   bool // "*" was listed; only allowed without credentials
+	origins     map[string]bool
+	wildcards   []*regexp.Regexp
+	credentials bool
+}
+
+// newCORSPolicy parses allowed origins. Each is an exact origin such as https://app.example.com,
+// a wildcard such as https://*.example.com matching any subdomain (but not example.com itself),
+// or "*" for every origin.
+func newCORSPolicy(origins []string, credentials bool) (*corsPolicy, error) {
+	p := &corsPolicy{origins: make(map[string]bool), credentials: credentials}
+	for _, origin := range origins {
+		if origin == "*" {
+			if credentials {
+				return nil, errors.New(`corsOrigins can't contain "*" when corsCredentials is on; list the origins instead`)
+			}
+			p.anyOrigin = true
+			continue
+		}
+
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		u, err := url.Parse(strings.Replace(origin, "*.", "wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid CORS origin %q: use scheme://host[:port], e.g. https://app.example.com", origin)
+		}
+
+		scheme, host, _ := strings.Cut(origin, "://")
+		if !strings.Contains(host, "*") {
+			p.origins[origin] = true
+			continue
+		}
+		rest, ok := strings.CutPrefix(host, "*.")
+		if !ok || strings.Contains(rest, "*") {
+			return nil, fmt.Errorf("invalid CORS origin %q: * may only stand for the leading subdomains, as in https://*.example.com", origin)
+		}
+		p.wildcards = append(p.wildcards, regexp.MustCompile(`^`+regexp.QuoteMeta(scheme+"://")+`[a-z0-9-]+(\.[a-z0-9-]+)*`+regexp.QuoteMeta("."+rest)+`$`))
+	}
+	return p, nil
+}
+
+// allowed reports whether requests from an origin may be read by the browser
+func (p *corsPolicy) allowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, re := range p.wildcards {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CorsMiddleware adds CORS headers for allowed origins and answers preflight requests.
+// The matching Origin is echoed back rather than a fixed value, so responses carry
+// Vary: Origin to keep caches from serving one origin's headers to another.
+func CorsMiddleware(policy *corsPolicy) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			allowed := policy.allowed(origin)
+
+			if allowed {
+				if policy.anyOrigin {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+				}
+				if policy.credentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			}
+
+			// Preflight requests are answered here; disallowed origins get no CORS headers,
+			// which the browser treats as a refusal
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				if allowed {
+					w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+					w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+					w.Header().Set("Access-Control-Max-Age", "86400")
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
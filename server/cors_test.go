@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCORSPolicyMatchesOrigins(t *testing.T) {
+	policy, err := newCORSPolicy([]string{"http://localhost:5173", "https://*.staging.example.com", "https://App.example.com/"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		"http://localhost:5173":                  true,
+		"https://app.example.com":                true,
+		"HTTPS://APP.EXAMPLE.COM":                true,
+		"https://pr-12.staging.example.com":      true,
+		"https://a.b.staging.example.com":        true,
+		"https://staging.example.com":            false, // The wildcard needs a subdomain
+		"http://pr-12.staging.example.com":       false, // Scheme must match
+		"https://evil-staging.example.com":       false,
+		"https://pr-12.staging.example.com.evil": false,
+		"https://pr-12.staging.example.com:8443": false,
+		"http://localhost:3000":                  false,
+		"null":                                   false,
+		"":                                       false,
+	} {
+		if got := policy.allowed(origin); got != want {
+			t.Errorf("allowed(%q) = %v; want %v", origin, got, want)
+		}
+	}
+}
+
+func TestCORSPolicyRejectsInvalidOrigins(t *testing.T) {
+	for _, origin := range []string{"localhost:5173", "ftp://example.com", "https://example.com/app", "https://*", "https://app.*.example.com", "https://**.example.com"} {
+		if _, err := newCORSPolicy([]string{origin}, false); err == nil {
+			t.Errorf("newCORSPolicy(%q) succeeded", origin)
+		}
+	}
+	if _, err := newCORSPolicy([]string{"*"}, true); err == nil {
+		t.Error(`"*" accepted with credentials`)
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	policy, err := newCORSPolicy([]string{"https://*.example.com"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := CorsMiddleware(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+	}))
+	send := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/photos", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("GET", "https://app.example.com")
+	h := rec.Header()
+	if h.Get("Access-Control-Allow-Origin") != "https://app.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin got headers %v; want the origin echoed with credentials", h)
+	}
+	if !slices.Contains(h.Values("Vary"), "Origin") {
+		t.Errorf("Vary = %v; want Origin", h.Values("Vary"))
+	}
+	if expose := h.Get("Access-Control-Expose-Headers"); !strings.Contains(expose, "ETag") || !strings.Contains(expose, "Location") {
+		t.Errorf("exposed headers = %q; want ETag and Location", expose)
+	}
+
+	rec = send("GET", "https://example.org")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || !slices.Contains(rec.Header().Values("Vary"), "Origin") {
+		t.Errorf("other origin got headers %v; want none but Vary: Origin", rec.Header())
+	}
+
+	rec = send("OPTIONS", "https://app.example.com")
+	if rec.Code != http.StatusNoContent || !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), "PUT") || rec.Header().Get("ETag") != "" {
+		t.Errorf("preflight = %d %v; want 204 with the allowed methods, answered without the handler", rec.Code, rec.Header())
+	}
+	rec = send("OPTIONS", "https://example.org")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("preflight from another origin got %v; want no CORS headers", rec.Header())
+	}
+
+	anyOrigin, err := newCORSPolicy([]string{"*"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/photos", nil)
+	req.Header.Set("Origin", "https://example.org")
+	CorsMiddleware(anyOrigin)(http.NotFoundHandler()).ServeHTTP(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf(`"*" policy got %v; want a wildcard without credentials`, rec.Header())
+	}
+}
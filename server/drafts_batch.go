@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// maxBatchOperations caps the size of a single batch request
+const maxBatchOperations = 500
+
+// handleBatchDrafts applies a list of operations to drafts in one request.
+// All operations run under a single lock; atomic batches are validated against a
+// working copy and only committed when every operation succeeds.
+func (a *App) handleBatchDrafts(w http.ResponseWriter, r *http.Request) {
+	var req BatchDraftsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Operations) == 0 {
+		sendValidationError(w, invalidField("operations", "No operations provided"))
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		sendValidationError(w, invalidField("operations", fmt.Sprintf("Too many operations. Maximum is %d per batch", maxBatchOperations)))
+		return
+	}
+
+	user := a.requestUser(r)
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	// Working copy of every draft touched by the batch; nil marks a deleted draft
+	working := make(map[string]*PageDraft)
+	lookup := func(id string) (*PageDraft, bool) {
+		if d, ok := working[id]; ok {
+			return d, d != nil
+		}
+		d, ok := a.drafts[id]
+		if !ok {
+			return nil, false
+		}
+		working[id] = &d
+		return &d, true
+	}
+
+	results := make([]DraftOperationResult, len(req.Operations))
+	failed := 0
+	for i, op := range req.Operations {
+		result := DraftOperationResult{Index: i, Op: op.Op, DraftID: op.DraftID}
+
+		draft, ok := lookup(op.DraftID)
+		if !ok {
+			result.Code, result.Error = codeDraftNotFound, "Draft not found"
+		} else if !draft.visibleTo(user) {
+			result.Code, result.Error = codeForbidden, "Draft belongs to another user"
+		} else if err := applyDraftOperation(draft, op); err != nil {
+			result.Code, result.Error = codeValidationFailed, err.Error()
+		} else {
+			result.Success = true
+			if op.Op == "delete" {
+				working[op.DraftID] = nil
+			} else {
+				updated := *draft
+				result.Draft = &updated
+			}
+		}
+
+		if !result.Success {
+			failed++
+		}
+		results[i] = result
+	}
+
+	if req.Atomic && failed > 0 {
+		// Nothing is committed; report the operations that failed
+		var fields []FieldError
+		for _, result := range results {
+			if !result.Success {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("operations[%d]", result.Index), Code: result.Code, Message: result.Error})
+			}
+		}
+		SendProblem(w, ErrorResponse{
+			Status: http.StatusConflict,
+			Code:   codeBatchRolledBack,
+			Detail: fmt.Sprintf("%d of %d operations failed; none were applied", failed, len(req.Operations)),
+			Errors: fields,
+		})
+		return
+	}
+
+	for id, d := range working {
+		if d == nil {
+			delete(a.drafts, id)
+		} else {
+			a.drafts[id] = *d
+		}
+	}
+	response := BatchDraftsResponse{Results: results}
+
+	log.Printf("Applied batch of %d draft operations (%d failed)", len(req.Operations), failed)
+
+	if failed > 0 {
+		SendJSONStatus(w, response, http.StatusMultiStatus)
+		return
+	}
+	SendJSON(w, response)
+}
+
+// applyDraftOperation changes a draft in place according to a single batch operation
+func applyDraftOperation(draft *PageDraft, op DraftOperation) error {
+	switch op.Op {
+	case "approve":
+		approveDraft(draft)
+	case "reject":
+		draft.Status = "rejected"
+		draft.ApprovedAt = ""
+	case "delete":
+		// Removal is handled by the caller
+	case "setTheme":
+		if !validTheme(op.Theme) {
+			return fmt.Errorf("unknown theme %q", op.Theme)
+		}
+		draft.Theme = op.Theme
+	case "addToBook":
+		if op.BookID == "" {
+			return fmt.Errorf("book ID required")
+		}
+		draft.BookID = op.BookID
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return nil
+}
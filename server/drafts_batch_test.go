@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAtomicBatchRollsBack(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	body := `{"atomic":true,"operations":[` +
+		`{"op":"approve","draftId":"da1"},` +
+		`{"op":"delete","draftId":"da2"},` +
+		`{"op":"setTheme","draftId":"da2","theme":"vintage"},` +
+		`{"op":"setTheme","draftId":"da1","theme":"no-such-theme"}]}`
+	rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/batch", body)
+	var problem ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil || rec.Code != http.StatusConflict || problem.Code != codeBatchRolledBack {
+		t.Fatalf("atomic batch = %d %s; want 409 %s", rec.Code, rec.Body, codeBatchRolledBack)
+	}
+	if len(problem.Errors) != 2 || problem.Errors[0].Field != "operations[2]" || problem.Errors[1].Field != "operations[3]" ||
+		problem.Errors[0].Code != codeDraftNotFound || problem.Errors[1].Code != codeValidationFailed {
+		t.Errorf("errors = %+v; want operations[2] (deleted earlier in the batch) and operations[3], with their codes", problem.Errors)
+	}
+	if a.drafts["da1"].Status != "draft" {
+		t.Errorf("da1 status = %q after rollback; want draft", a.drafts["da1"].Status)
+	}
+	if _, ok := a.drafts["da2"]; !ok {
+		t.Error("da2 deleted despite the rollback")
+	}
+
+	// Without atomic the operations that succeed are applied
+	rec = sendAs(t, router, sign, "user_alice", "POST", "/drafts/batch", `{"operations":[`+
+		`{"op":"approve","draftId":"da1"},{"op":"setTheme","draftId":"da1","theme":"no-such-theme"}]}`)
+	var response BatchDraftsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusMultiStatus {
+		t.Fatalf("non-atomic batch = %d %s; want 207", rec.Code, rec.Body)
+	}
+	if len(response.Results) != 2 || !response.Results[0].Success || response.Results[1].Success || response.Results[1].Code != codeValidationFailed {
+		t.Errorf("results = %+v; want the approve to succeed and the theme to fail with %s", response.Results, codeValidationFailed)
+	}
+	if a.drafts["da1"].Status != "approved" {
+		t.Errorf("da1 status = %q; want approved", a.drafts["da1"].Status)
+	}
+}
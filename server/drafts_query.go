@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDraftPageSize = 50
+	maxDraftPageSize     = 200
+)
+
+// draftQuery holds the filters, sort order and page position for listing drafts
+type draftQuery struct {
+	Status string
+	Theme  string
+	BookID string
+	Text   string
+	From   time.Time // Inclusive, compared against the capture date (or creation date when unknown)
+	To     time.Time // Exclusive
+	Sort   string    // "createdAt" | "capturedAt" | "title"
+	Desc   bool
+	Limit  int
+	Cursor *draftCursor
+}
+
+// draftCursor marks the last draft returned on the previous page
+type draftCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+// parseDraftQuery reads listing options from the query string:
+// status, theme, book, q, from, to, sort, order, limit and cursor. Errors are FieldErrors.
+func parseDraftQuery(values url.Values) (draftQuery, error) {
+	q := draftQuery{
+		Status: values.Get("status"),
+		Theme:  values.Get("theme"),
+		BookID: values.Get("book"),
+		Text:   strings.ToLower(strings.TrimSpace(values.Get("q"))),
+		Sort:   values.Get("sort"),
+		Limit:  defaultDraftPageSize,
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = "createdAt"
+	case "createdAt", "capturedAt", "title":
+	default:
+		return q, invalidField("sort", fmt.Sprintf("invalid sort %q: use createdAt, capturedAt or title", q.Sort))
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, invalidField("order", fmt.Sprintf("invalid order %q: use asc or desc", values.Get("order")))
+	}
+
+	var err error
+	if v := values.Get("from"); v != "" {
+		if q.From, err = parseQueryDate(v); err != nil {
+			return q, invalidField("from", "invalid from date: "+err.Error())
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = parseQueryDate(v); err != nil {
+			return q, invalidField("to", "invalid to date: "+err.Error())
+		}
+		// A bare date includes the whole day
+		if len(v) == len("2006-01-02") {
+			q.To = q.To.AddDate(0, 0, 1)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return q, invalidField("limit", fmt.Sprintf("invalid limit %q", v))
+		}
+		q.Limit = min(limit, maxDraftPageSize)
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeDraftCursor(v)
+		if err != nil || cursor.Sort != q.sortID() {
+			return q, invalidField("cursor", "invalid cursor")
+		}
+		q.Cursor = &cursor
+	}
+
+	return q, nil
+}
+
+// parseQueryDate accepts either an RFC 3339 timestamp or a plain YYYY-MM-DD date
+func parseQueryDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// sortID identifies the sort order a cursor was issued for
+func (q draftQuery) sortID() string {
+	if q.Desc {
+		return q.Sort + ":desc"
+	}
+	return q.Sort + ":asc"
+}
+
+// matches reports whether a draft passes all filters
+func (q draftQuery) matches(d PageDraft) bool {
+	if q.Status != "" && d.Status != q.Status {
+		return false
+	}
+	if q.Theme != "" && d.Theme != q.Theme {
+		return false
+	}
+	if q.BookID != "" && d.BookID != q.BookID {
+		return false
+	}
+	if q.Text != "" &&
+		!strings.Contains(strings.ToLower(d.Title), q.Text) &&
+		!strings.Contains(strings.ToLower(d.Description), q.Text) {
+		return false
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		date, ok := draftDate(d)
+		if !ok {
+			return false
+		}
+		if !q.From.IsZero() && date.Before(q.From) {
+			return false
+		}
+		if !q.To.IsZero() && !date.Before(q.To) {
+			return false
+		}
+	}
+	return true
+}
+
+// draftDate returns the capture date of a draft, falling back to when it was created
+func draftDate(d PageDraft) (time.Time, bool) {
+	for _, v := range []string{d.CapturedAt, d.CreatedAt} {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sortKey returns a string that orders drafts by the query's sort field
+func (q draftQuery) sortKey(d PageDraft) string {
+	var v string
+	switch q.Sort {
+	case "title":
+		return strings.ToLower(d.Title)
+	case "capturedAt":
+		v = d.CapturedAt
+	default:
+		v = d.CreatedAt
+	}
+	// Normalize to UTC with a fixed width so keys compare as strings; unparsable dates sort first
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// before reports whether the draft identified by (keyA, idA) comes before (keyB, idB).
+// Ties are broken by ID so the order is stable across requests.
+func (q draftQuery) before(keyA, idA, keyB, idB string) bool {
+	if q.Desc {
+		keyA, idA, keyB, idB = keyB, idB, keyA, idA
+	}
+	return keyA < keyB || (keyA == keyB && idA < idB)
+}
+
+// listDrafts filters, sorts and paginates the drafts a user may see. Callers must hold draftsMu.
+func (a *App) listDrafts(q draftQuery, user string) DraftListResponse {
+	type keyed struct {
+		key   string
+		draft PageDraft
+	}
+
+	var matched []keyed
+	for _, d := range a.drafts {
+		if d.visibleTo(user) && q.matches(d) {
+			matched = append(matched, keyed{key: q.sortKey(d), draft: d})
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return q.before(matched[i].key, matched[i].draft.ID, matched[j].key, matched[j].draft.ID)
+	})
+
+	start := 0
+	if q.Cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.before(q.Cursor.Key, q.Cursor.ID, matched[i].key, matched[i].draft.ID)
+		})
+	}
+	end := min(start+q.Limit, len(matched))
+
+	response := DraftListResponse{
+		Drafts: make([]PageDraft, 0, end-start),
+		Total:  len(matched),
+	}
+	for _, m := range matched[start:end] {
+		response.Drafts = append(response.Drafts, m.draft)
+	}
+
+	if end < len(matched) {
+		last := matched[end-1]
+		response.Next = encodeDraftCursor(draftCursor{Sort: q.sortID(), Key: last.key, ID: last.draft.ID})
+	}
+
+	return response
+}
+
+// encodeDraftCursor turns a cursor into an opaque URL-safe token
+func encodeDraftCursor(c draftCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeDraftCursor parses a token produced by encodeDraftCursor
+func decodeDraftCursor(token string) (draftCursor, error) {
+	var c draftCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
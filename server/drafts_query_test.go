@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// draftListTestApp returns an app holding the given drafts, owned by user_alice unless they
+// name another owner
+func draftListTestApp(t *testing.T, list ...PageDraft) *App {
+	t.Helper()
+	a := newTestApp(t, defaultConfig())
+	for _, d := range list {
+		if d.Owner == "" {
+			d.Owner = "user_alice"
+		}
+		a.drafts[d.ID] = d
+	}
+	return a
+}
+
+// listTestDrafts lists user_alice's drafts with a query string, failing the test if it doesn't parse
+func listTestDrafts(t *testing.T, a *App, query string) DraftListResponse {
+	t.Helper()
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := parseDraftQuery(values)
+	if err != nil {
+		t.Fatalf("?%s: %v", query, err)
+	}
+	return a.listDrafts(q, "user_alice")
+}
+
+func draftIDs(list []PageDraft) []string {
+	ids := make([]string, len(list))
+	for i, d := range list {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestListDraftsFiltersAndSorts(t *testing.T) {
+	a := draftListTestApp(t,
+		PageDraft{ID: "d1", Title: "Beach day", Theme: "summer", Status: "draft", CapturedAt: "2024-07-02T10:00:00Z", CreatedAt: "2024-08-01T00:00:00Z"},
+		PageDraft{ID: "d2", Title: "first steps", Theme: "milestone", Status: "approved", CapturedAt: "2024-03-10T09:00:00+02:00", CreatedAt: "2024-08-03T00:00:00Z", BookID: "book1"},
+		PageDraft{ID: "d3", Title: "Snow", Theme: "winter", Status: "draft", CapturedAt: "2024-01-15T12:00:00Z", CreatedAt: "2024-08-02T00:00:00Z", Description: "first snow at the beach house"},
+		PageDraft{ID: "d4", Title: "Beach again", Theme: "summer", Status: "draft", CreatedAt: "2024-08-04T00:00:00Z", Owner: "user_bob"},
+	)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"d1", "d3", "d2"}},
+		{"order=desc", []string{"d2", "d3", "d1"}},
+		{"sort=capturedAt", []string{"d3", "d2", "d1"}},
+		{"sort=title", []string{"d1", "d2", "d3"}},
+		{"status=draft", []string{"d1", "d3"}},
+		{"theme=milestone", []string{"d2"}},
+		{"book=book1", []string{"d2"}},
+		{"q=BEACH", []string{"d1", "d3"}},
+		{"from=2024-03-01&to=2024-07-02", []string{"d1", "d2"}},
+		{"from=2024-03-10T07:00:00Z&sort=capturedAt", []string{"d2", "d1"}},
+		{"from=2024-03-10T08:00:00Z&sort=capturedAt", []string{"d1"}}, // d2 was taken at 07:00 UTC
+		{"book=missing", []string{}},
+	} {
+		list := listTestDrafts(t, a, tc.query)
+		if got := draftIDs(list.Drafts); !slices.Equal(got, tc.want) || list.Total != len(tc.want) || list.Next != "" {
+			t.Errorf("?%s = %v (total %d, next %q); want %v", tc.query, got, list.Total, list.Next, tc.want)
+		}
+	}
+
+	// An empty listing is an empty array, not null
+	data, err := json.Marshal(listTestDrafts(t, a, "theme=none"))
+	if err != nil || !strings.Contains(string(data), `"drafts":[]`) {
+		t.Errorf("empty listing = %s, %v; want an empty drafts array", data, err)
+	}
+
+	for _, query := range []string{"sort=size", "order=up", "from=yesterday", "to=2024-13-01", "limit=0", "limit=x", "cursor=bogus"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseDraftQuery(values); err == nil {
+			t.Errorf("?%s parsed; want an error", query)
+		}
+	}
+}
+
+func TestListDraftsPaginatesWithCursor(t *testing.T) {
+	var list []PageDraft
+	for _, id := range []string{"d1", "d2", "d3", "d4", "d5", "d6", "d7"} {
+		// Same creation time throughout, so the order relies on the ID tie-break
+		list = append(list, PageDraft{ID: id, Status: "draft", CreatedAt: "2024-08-01T00:00:00Z"})
+	}
+	a := draftListTestApp(t, list...)
+
+	var got []string
+	query := url.Values{"limit": {"3"}, "order": {"desc"}}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination didn't end")
+		}
+		page := listTestDrafts(t, a, query.Encode())
+		if page.Total != 7 {
+			t.Errorf("total = %d; want 7 on every page", page.Total)
+		}
+		got = append(got, draftIDs(page.Drafts)...)
+		if page.Next == "" {
+			break
+		}
+		query.Set("cursor", page.Next)
+	}
+	if want := []string{"d7", "d6", "d5", "d4", "d3", "d2", "d1"}; !slices.Equal(got, want) {
+		t.Errorf("pages = %v; want %v", got, want)
+	}
+
+	// A cursor only continues the sort order it was issued for
+	first := listTestDrafts(t, a, "limit=1")
+	if _, err := parseDraftQuery(url.Values{"sort": {"title"}, "cursor": {first.Next}}); err == nil {
+		t.Error("cursor reused with another sort parsed; want an error")
+	}
+}
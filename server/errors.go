@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// problemContentType is the media type of error responses (RFC 7807)
+const problemContentType = "application/problem+json"
+
+// Error codes returned in the code member of error responses. Messages may change; clients
+// should match on these.
+const (
+	codeInvalidBody        = "invalid_body"
+	codeValidationFailed   = "validation_failed"
+	codeRouteNotFound      = "route_not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeUnauthorized       = "unauthorized"
+	codeSignInRequired     = "sign_in_required"
+	codeForbidden          = "forbidden"
+	codeAdminDisabled      = "admin_disabled"
+	codeInternal           = "internal_error"
+	codeDraftNotFound      = "draft_not_found"
+	codeDraftConflict      = "draft_conflict"
+	codeDraftWouldBeEmpty  = "draft_would_be_empty"
+	codePhotoNotFound      = "photo_not_found"
+	codePhotoNotOnDraft    = "photo_not_on_draft"
+	codePhotoAlreadyOnPage = "photo_already_on_draft"
+	codePhotoApproved      = "photo_on_approved_page"
+	codePhotoBusy          = "photo_busy"
+	codePhotoUploaded      = "photo_uploaded_again"
+	codeInvalidPhotoID     = "invalid_photo_id"
+	codeInvalidUserID      = "invalid_user_id"
+	codeTrashNotFound      = "trash_not_found"
+	codeTrashExpired       = "trash_expired"
+	codeFileNotFound       = "file_not_found"
+	codeNoValidPhotos      = "no_valid_photos"
+	codeAnalysisFailed     = "analysis_failed"
+	codeTemplateMismatch   = "template_does_not_fit"
+	codeNotMultipart       = "not_multipart"
+	codeNoFiles            = "no_files"
+	codeUploadRejected     = "upload_rejected"
+	codeRequestTooLarge    = "request_too_large"
+	codeUploadNotFound     = "upload_not_found"
+	codeUploadExpired      = "upload_expired"
+	codeUploadIncomplete   = "upload_incomplete"
+	codeOffsetMismatch     = "offset_mismatch"
+	codeChecksumMismatch   = "checksum_mismatch"
+	codeBatchRolledBack    = "batch_rolled_back"
+)
+
+// retryableCodes lists the errors a client may retry unchanged, with how long to wait first.
+// Offset mismatches are retried from the offset the response reports.
+var retryableCodes = map[string]time.Duration{
+	codeInternal:       5 * time.Second,
+	codeAnalysisFailed: 30 * time.Second,
+	codeDraftConflict:  0,
+	codePhotoBusy:      time.Second,
+	codeOffsetMismatch: 0,
+}
+
+// SendProblem sends an error response as an RFC 7807 problem document. The title, request ID,
+// retry hint and legacy members are filled in from the status and code.
+func SendProblem(w http.ResponseWriter, p ErrorResponse) {
+	p.Type = "about:blank" // The code identifies the problem; the title is the status text
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = w.Header().Get(requestIDHeader)
+	p.Success = false
+	p.Error = p.Detail
+
+	if wait, ok := retryableCodes[p.Code]; ok {
+		p.Retryable = true
+		p.RetryAfter = int(wait.Seconds())
+		if p.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(p.RetryAfter))
+		}
+	}
+	if p.Status >= http.StatusInternalServerError {
+		log.Printf("Request %s failed with %s: %s", p.RequestID, p.Code, p.Detail)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// sendValidationError reports request fields that failed validation
+func sendValidationError(w http.ResponseWriter, fields ...FieldError) {
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = f.Message
+	}
+	SendProblem(w, ErrorResponse{
+		Status: http.StatusBadRequest,
+		Code:   codeValidationFailed,
+		Detail: strings.Join(messages, "; "),
+		Errors: fields,
+	})
+}
+
+// sendQueryError reports an invalid query parameter; parsers return FieldErrors naming it
+func sendQueryError(w http.ResponseWriter, err error) {
+	var field FieldError
+	if errors.As(err, &field) {
+		sendValidationError(w, field)
+		return
+	}
+	SendError(w, codeValidationFailed, err.Error(), http.StatusBadRequest)
+}
+
+// invalidField returns a validation error for one field
+func invalidField(field, message string) FieldError {
+	return FieldError{Field: field, Message: message}
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
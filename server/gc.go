@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gcGracePeriod protects files that are still being written or are about to be
+// referenced, e.g. a background generated before its draft is saved
+const gcGracePeriod = time.Hour
+
+// GCItem is a file found by the garbage collector
+type GCItem struct {
+	Path    string    `json:"path"` // Storage key, or a local path for temp files
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	remove func(ctx context.Context) error
+}
+
+// GCReport lists what a garbage collection pass found and, unless it was a dry run, removed
+type GCReport struct {
+	DryRun                  bool     `json:"dryRun"`
+	OrphanedRenditions      []GCItem `json:"orphanedRenditions"`
+	UnreferencedBackgrounds []GCItem `json:"unreferencedBackgrounds"`
+	StaleTempFiles          []GCItem `json:"staleTempFiles"`
+	ExpiredTrash            []GCItem `json:"expiredTrash"`
+	ExpiredUploads          []GCItem `json:"expiredUploads"`
+	TotalBytes              int64    `json:"totalBytes"`
+	SkippedBackgrounds      string   `json:"skippedBackgrounds,omitempty"` // Why backgrounds weren't collected, if they weren't
+	Errors                  []string `json:"errors,omitempty"`
+}
+
+// collectGarbage finds files nothing references and deletes them unless dryRun is set.
+// When ctx is canceled it stops between files; whatever is left is found again next time.
+//
+// Whether a background is referenced is only known to the process holding the drafts, so
+// backgrounds are only collected when ownsDrafts is set: by the scheduled and admin passes of a
+// running server, not by the -gc command or before the server has started.
+func (a *App) collectGarbage(ctx context.Context, dryRun, ownsDrafts bool) GCReport {
+	report := GCReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-gcGracePeriod)
+
+	report.OrphanedRenditions = a.findOrphanedRenditions(ctx, cutoff, &report)
+	if ownsDrafts {
+		report.UnreferencedBackgrounds = a.findUnreferencedBackgrounds(ctx, cutoff, &report)
+	} else {
+		report.UnreferencedBackgrounds = []GCItem{}
+		report.SkippedBackgrounds = "this process doesn't hold the drafts, so it can't tell which backgrounds they use"
+	}
+	report.StaleTempFiles = findStaleTempFiles(cutoff, &report)
+	report.ExpiredTrash = a.findExpiredTrash(ctx, &report)
+	report.ExpiredUploads = a.findExpiredUploads(ctx, &report)
+
+	groups := [][]GCItem{
+		report.OrphanedRenditions,
+		report.UnreferencedBackgrounds,
+		report.StaleTempFiles,
+		report.ExpiredTrash,
+		report.ExpiredUploads,
+	}
+	for _, items := range groups {
+		for _, item := range items {
+			report.TotalBytes += item.Size
+			if dryRun {
+				continue
+			}
+			if ctx.Err() != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("stopped before removing %s: %v", item.Path, ctx.Err()))
+				return report
+			}
+			if err := item.remove(ctx); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to remove %s: %v", item.Path, err))
+			}
+		}
+	}
+
+	return report
+}
+
+// findOrphanedRenditions returns thumbnails and other renditions whose original is gone
+func (a *App) findOrphanedRenditions(ctx context.Context, cutoff time.Time, report *GCReport) []GCItem {
+	items := []GCItem{}
+	blobs, err := a.store.List(ctx, "")
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list photos: %v", err))
+		return items
+	}
+
+	originals := make(map[string]bool)
+	for _, blob := range blobs {
+		if isOriginalKey(blob.Key) {
+			originals[strings.TrimSuffix(blob.Key, filepath.Ext(blob.Key))] = true
+		}
+	}
+
+	for _, blob := range blobs {
+		idx := strings.Index(blob.Key, "_")
+		if strings.Contains(blob.Key, "/") || idx <= 0 || originals[blob.Key[:idx]] {
+			continue
+		}
+		if item, ok := a.blobGCItem(blob, cutoff); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findUnreferencedBackgrounds returns generated backgrounds that no draft uses
+func (a *App) findUnreferencedBackgrounds(ctx context.Context, cutoff time.Time, report *GCReport) []GCItem {
+	items := []GCItem{}
+	blobs, err := a.store.List(ctx, backgroundPrefix)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list backgrounds: %v", err))
+		return items
+	}
+
+	referenced := make(map[string]bool)
+	a.draftsMu.Lock()
+	for _, d := range a.drafts {
+		if key, ok := d.BackgroundPath.key(); ok {
+			referenced[key] = true
+		}
+	}
+	a.draftsMu.Unlock()
+
+	for _, blob := range blobs {
+		if referenced[blob.Key] {
+			continue
+		}
+		if item, ok := a.blobGCItem(blob, cutoff); ok {
+			key, remove := blob.Key, item.remove
+			item.remove = func(ctx context.Context) error {
+				a.backgrounds.Remove(key)
+				return remove(ctx)
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findStaleTempFiles returns leftovers from multipart uploads that were interrupted
+// before the request could clean up after itself
+func findStaleTempFiles(cutoff time.Time, report *GCReport) []GCItem {
+	items := []GCItem{}
+	tempDir := os.TempDir()
+	files, err := os.ReadDir(tempDir)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to read %s: %v", tempDir, err))
+		return items
+	}
+
+	for _, file := range files {
+		// Only our own spool files; the temp directory is shared with other processes
+		if file.IsDir() || !strings.HasPrefix(file.Name(), strings.TrimSuffix(uploadSpoolPattern, "*")) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		p := filepath.Join(tempDir, file.Name())
+		items = append(items, GCItem{
+			Path:    p,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			remove:  func(context.Context) error { return os.Remove(p) },
+		})
+	}
+	return items
+}
+
+// findExpiredTrash returns trashed photos past their retention window
+func (a *App) findExpiredTrash(ctx context.Context, report *GCReport) []GCItem {
+	items := []GCItem{}
+	entries, err := a.listTrash(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to read trash: %v", err))
+		return items
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before(entry.ExpiresAt) {
+			continue
+		}
+		item := GCItem{
+			Path:    trashPrefix(entry.PhotoID),
+			ModTime: entry.DeletedAt,
+			remove:  func(ctx context.Context) error { return a.deleteTrashEntry(ctx, entry) },
+		}
+		for _, name := range entry.Files {
+			if info, err := a.store.Stat(ctx, item.Path+name); err == nil {
+				item.Size += info.Size
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// findExpiredUploads returns resumable uploads that were abandoned
+func (a *App) findExpiredUploads(_ context.Context, report *GCReport) []GCItem {
+	items := []GCItem{}
+	sessions, err := a.expiredUploadSessions()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to read upload sessions: %v", err))
+		return items
+	}
+
+	for _, session := range sessions {
+		metaPath, _ := a.uploadSessionPaths(session.ID)
+		id := session.ID
+		items = append(items, GCItem{
+			Path:    metaPath,
+			Size:    session.Offset,
+			ModTime: session.ExpiresAt,
+			remove: func(context.Context) error {
+				a.removeExpiredUploadSession(id)
+				return nil
+			},
+		})
+	}
+	return items
+}
+
+// blobGCItem describes a stored object if it is older than the cutoff
+func (a *App) blobGCItem(blob BlobInfo, cutoff time.Time) (GCItem, bool) {
+	if blob.ModTime.After(cutoff) {
+		return GCItem{}, false
+	}
+	key := blob.Key
+	return GCItem{
+		Path:    key,
+		Size:    blob.Size,
+		ModTime: blob.ModTime,
+		remove:  func(ctx context.Context) error { return a.store.Delete(ctx, key) },
+	}, true
+}
+
+// logGCReport prints a summary of a garbage collection pass
+func logGCReport(report GCReport) {
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	log.Printf("GC: %s %d orphaned rendition(s), %d unreferenced background(s), %d stale temp file(s), %d expired trash item(s), %d abandoned upload(s) (%d bytes)",
+		verb, len(report.OrphanedRenditions), len(report.UnreferencedBackgrounds), len(report.StaleTempFiles), len(report.ExpiredTrash), len(report.ExpiredUploads), report.TotalBytes)
+	if report.SkippedBackgrounds != "" {
+		log.Printf("GC: Skipped backgrounds: %s", report.SkippedBackgrounds)
+	}
+	for _, e := range report.Errors {
+		log.Printf("GC: %s", e)
+	}
+}
+
+// startGCSchedule runs garbage collection every gcInterval in the background until ctx is canceled
+func (a *App) startGCSchedule(ctx context.Context) {
+	a.goJob(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(a.cfg.GCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logGCReport(a.collectGarbage(ctx, false, true))
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// requireAdmin only lets requests through that present the admin token as a bearer token.
+// Admin endpoints are disabled when it isn't set.
+func (a *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := a.cfg.AdminToken
+		if adminToken == "" {
+			SendError(w, codeAdminDisabled, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+			SendError(w, codeUnauthorized, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleGCReport reports orphaned files without deleting them
+func (a *App) HandleGCReport(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, a.collectGarbage(r.Context(), true, true))
+}
+
+// HandleRunGC deletes orphaned files (?dryRun=1 to only report)
+func (a *App) HandleRunGC(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "1"
+	report := a.collectGarbage(r.Context(), dryRun, true)
+	logGCReport(report)
+	SendJSON(w, report)
+}
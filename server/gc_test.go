@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ageTestFile backdates a file past the GC grace period
+func ageTestFile(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-2 * gcGracePeriod)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCKeepsBackgroundsOfLiveDrafts(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	for _, key := range []string{backgroundPrefix + "used.png", backgroundPrefix + "unused.png"} {
+		putTestBlob(t, a, key, "background")
+		ageTestFile(t, filepath.Join(a.cfg.UploadDir, filepath.FromSlash(key)))
+		a.backgrounds.Add(key)
+	}
+	a.drafts["d1"] = PageDraft{ID: "d1", BackgroundPath: a.uploadPath(backgroundPrefix + "used.png")}
+
+	// Without the drafts, no background can be told apart from an unused one
+	report := a.collectGarbage(t.Context(), false, false)
+	if len(report.UnreferencedBackgrounds) != 0 || report.SkippedBackgrounds == "" {
+		t.Errorf("GC without drafts: backgrounds %v, skipped %q; want none collected and the skip reported",
+			report.UnreferencedBackgrounds, report.SkippedBackgrounds)
+	}
+	if !a.backgrounds.Has(backgroundPrefix + "unused.png") {
+		t.Error("GC without drafts removed a background")
+	}
+
+	report = a.collectGarbage(t.Context(), false, true)
+	if len(report.UnreferencedBackgrounds) != 1 || report.UnreferencedBackgrounds[0].Path != backgroundPrefix+"unused.png" {
+		t.Errorf("GC with drafts collected %v; want only the unused background", report.UnreferencedBackgrounds)
+	}
+	if _, err := a.store.Stat(t.Context(), backgroundPrefix+"used.png"); err != nil {
+		t.Errorf("background of a live draft: %v", err)
+	}
+	if _, err := a.store.Stat(t.Context(), backgroundPrefix+"unused.png"); err == nil {
+		t.Error("unused background still stored")
+	}
+}
+
+func TestGCOnlyRemovesItsOwnTempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	a := newTestApp(t, defaultConfig())
+
+	for _, name := range []string{"upload-spool-1", "upload-spool-2", "multipart-1", "other"} {
+		p := filepath.Join(tempDir, name)
+		if err := os.WriteFile(p, []byte("spooled"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "upload-spool-2" {
+			ageTestFile(t, p)
+		}
+	}
+
+	report := a.collectGarbage(t.Context(), false, false)
+	if len(report.StaleTempFiles) != 1 || report.StaleTempFiles[0].Path != filepath.Join(tempDir, "upload-spool-1") {
+		t.Errorf("stale temp files = %v; want only the old spool file", report.StaleTempFiles)
+	}
+	for name, want := range map[string]bool{"upload-spool-1": false, "upload-spool-2": true, "multipart-1": true, "other": true} {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v; want %v", name, err == nil, want)
+		}
+	}
+}
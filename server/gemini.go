@@ -5,8 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -15,20 +13,14 @@ import (
 )
 
 // AnalyzeAndClusterPhotos uses Gemini AI to analyze photos and create clusters
-func AnalyzeAndClusterPhotos(photoIds []string, photoPaths []string) ([]PhotoCluster, error) {
-	ctx := context.Background()
-
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
+func (a *App) AnalyzeAndClusterPhotos(ctx context.Context, photoIds []string, photoKeys []string) ([]PhotoCluster, error) {
+	if a.cfg.GeminiAPIKey == "" {
 		log.Println("No GEMINI_API_KEY set, using mock clusters")
 		return CreateMockClusters(photoIds), nil
 	}
 
 	// Create Gemini client
-	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  apiKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+	client, err := a.newGeminiClient(ctx)
 	if err != nil {
 		log.Printf("Failed to create Gemini client: %v", err)
 		return CreateMockClusters(photoIds), nil
@@ -62,22 +54,24 @@ Make sure every photo is included in exactly one cluster.`
 	parts = append(parts, textPart)
 
 	// Add images
-	for _, photoPath := range photoPaths {
-		imageData, err := os.ReadFile(photoPath)
+	for _, photoKey := range photoKeys {
+		imageData, err := readBlob(ctx, a.store, photoKey)
 		if err != nil {
-			log.Printf("Error reading photo %s: %v", photoPath, err)
+			log.Printf("Error reading photo %s: %v", photoKey, err)
 			continue
 		}
 
+		// Label the image by its content. Metadata is stripped from JPEG, PNG and WebP as they are;
+		// HEIC and photos that need their EXIF orientation are re-encoded as JPEG.
 		mimeType := "image/jpeg"
-		ext := strings.ToLower(filepath.Ext(photoPath))
-		switch ext {
-		case ".png":
-			mimeType = "image/png"
-		case ".gif":
-			mimeType = "image/gif"
-		case ".webp":
-			mimeType = "image/webp"
+		if format, ok := sniffImageFormat(imageData); ok {
+			// Where and with what the photo was taken stays with us
+			clean, cleanFormat, err := withoutMetadata(imageData, format)
+			if err != nil {
+				log.Printf("Error removing metadata from photo %s: %v", photoKey, err)
+				continue
+			}
+			imageData, mimeType = clean, cleanFormat.ContentType
 		}
 
 		imagePart := genai.NewPartFromBytes(imageData, mimeType)
@@ -96,8 +90,7 @@ Make sure every photo is included in exactly one cluster.`
 		MaxOutputTokens: 2048,
 	}
 
-	// Generate content using gemini-2.5-flash
-	resp, err := client.Models.GenerateContent(ctx, "gemini-2.5-flash", contents, config)
+	resp, err := client.Models.GenerateContent(ctx, a.cfg.GeminiModel, contents, config)
 	if err != nil {
 		log.Printf("Gemini API error: %v", err)
 		return CreateMockClusters(photoIds), nil
@@ -210,24 +203,34 @@ var themeToPromptStyle = map[string]string{
 	"serene":      "calm clouds, peaceful sky, soft blue tones, dreamy watercolor style",
 }
 
-// GenerateBackgroundImage generates a themed background image using Gemini 2.0 Flash
-func GenerateBackgroundImage(theme, title, description string) (string, error) {
-	ctx := context.Background()
+// validTheme reports whether a theme is one pages can have, with a background style
+func validTheme(theme string) bool {
+	_, ok := themeToPromptStyle[theme]
+	return ok
+}
+
+// newGeminiClient returns a client for the Gemini API using the configured key
+func (a *App) newGeminiClient(ctx context.Context) (*genai.Client, error) {
+	return genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:      a.cfg.GeminiAPIKey,
+		Backend:     genai.BackendGeminiAPI,
+		HTTPOptions: genai.HTTPOptions{BaseURL: a.geminiBaseURL},
+	})
+}
 
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
+// GenerateBackgroundImage generates a themed background image with the Gemini image model.
+// It stops when ctx is canceled, e.g. when the client goes away or the server shuts down.
+func (a *App) GenerateBackgroundImage(ctx context.Context, theme, title, description string) (mediaPath, error) {
+	if a.cfg.GeminiAPIKey == "" {
 		log.Println("No GEMINI_API_KEY set, skipping background generation")
-		return "", nil
+		return mediaPath{}, nil
 	}
 
 	// Create Gemini client
-	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  apiKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+	client, err := a.newGeminiClient(ctx)
 	if err != nil {
 		log.Printf("Failed to create Gemini client for image generation: %v", err)
-		return "", err
+		return mediaPath{}, err
 	}
 
 	// Get style based on theme
@@ -261,16 +264,16 @@ Requirements:
 		genai.NewContentFromText(prompt, "user"),
 	}
 
-	// Generate using gemini-2.0-flash-exp which supports native image generation
-	resp, err := client.Models.GenerateContent(ctx, "gemini-2.0-flash-exp", contents, config)
+	// The image model must support native image generation
+	resp, err := client.Models.GenerateContent(ctx, a.cfg.GeminiImageModel, contents, config)
 	if err != nil {
 		log.Printf("Gemini image generation error: %v", err)
-		return "", err
+		return mediaPath{}, err
 	}
 
 	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
 		log.Println("No response from Gemini for image generation")
-		return "", fmt.Errorf("no response from Gemini")
+		return mediaPath{}, fmt.Errorf("no response from Gemini")
 	}
 
 	// Find the image part in the response
@@ -284,28 +287,87 @@ Requirements:
 
 	if len(imageData) == 0 {
 		log.Println("No image data in Gemini response")
-		return "", fmt.Errorf("no image generated")
-	}
-
-	// Create backgrounds directory if it doesn't exist
-	backgroundDir := "./uploads/backgrounds"
-	if err := os.MkdirAll(backgroundDir, 0755); err != nil {
-		log.Printf("Failed to create backgrounds directory: %v", err)
-		return "", err
+		return mediaPath{}, fmt.Errorf("no image generated")
 	}
 
 	// Save the image
 	filename := fmt.Sprintf("bg_%s_%s.png", theme, uuid.New().String()[:8])
-	filePath := filepath.Join(backgroundDir, filename)
 
-	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
+	if err := putBlob(ctx, a.store, backgroundPrefix+filename, imageData, "image/png"); err != nil {
 		log.Printf("Failed to save background image: %v", err)
-		return "", err
+		return mediaPath{}, err
 	}
+	a.backgrounds.Add(backgroundPrefix + filename)
 
 	// Return the URL path
-	urlPath := fmt.Sprintf("/uploads/backgrounds/%s", filename)
+	urlPath := a.uploadPath(backgroundPrefix + filename)
 	log.Printf("Generated background image: %s", urlPath)
 
 	return urlPath, nil
 }
+
+// RewriteMergedDraft asks Gemini for a single title, description and theme covering several drafts
+func (a *App) RewriteMergedDraft(ctx context.Context, sources []PageDraft) (title, description, theme string, err error) {
+	if a.cfg.GeminiAPIKey == "" {
+		return "", "", "", fmt.Errorf("no GEMINI_API_KEY set")
+	}
+
+	client, err := a.newGeminiClient(ctx)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+
+	var pages strings.Builder
+	for i, d := range sources {
+		fmt.Fprintf(&pages, "Page %d (theme: %s)\nTitle: %s\nDescription: %s\n\n", i+1, d.Theme, d.Title, d.Description)
+	}
+
+	prompt := fmt.Sprintf(`These baby memory book pages describe the same moment and are being merged into one page.
+
+%s
+Write one combined page. Provide:
+- A short, sweet title
+- A heartfelt description that a parent would love to read (2-3 sentences)
+- A theme from: "milestone", "playful", "cozy", "adventure", "love", "growth"
+
+Respond in this exact JSON format:
+{"title": "Title Here", "description": "Description here", "theme": "milestone"}`, pages.String())
+
+	config := &genai.GenerateContentConfig{
+		Temperature:     genai.Ptr(float32(0.7)),
+		MaxOutputTokens: 1024,
+	}
+
+	contents := []*genai.Content{
+		genai.NewContentFromText(prompt, "user"),
+	}
+
+	resp, err := client.Models.GenerateContent(ctx, a.cfg.GeminiModel, contents, config)
+	if err != nil {
+		return "", "", "", fmt.Errorf("gemini API error: %w", err)
+	}
+
+	responseText := resp.Text()
+	jsonStart := strings.Index(responseText, "{")
+	jsonEnd := strings.LastIndex(responseText, "}")
+	if jsonStart == -1 || jsonEnd == -1 {
+		return "", "", "", fmt.Errorf("no JSON found in Gemini response")
+	}
+
+	var rewritten struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Theme       string `json:"theme"`
+	}
+	if err := json.Unmarshal([]byte(responseText[jsonStart:jsonEnd+1]), &rewritten); err != nil {
+		return "", "", "", fmt.Errorf("failed to parse rewrite JSON: %w", err)
+	}
+	if rewritten.Title == "" || rewritten.Theme == "" {
+		return "", "", "", fmt.Errorf("incomplete rewrite from Gemini")
+	}
+	if !validTheme(rewritten.Theme) {
+		return "", "", "", fmt.Errorf("unknown theme %q from Gemini", rewritten.Theme)
+	}
+
+	return rewritten.Title, rewritten.Description, rewritten.Theme, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGeminiRequest is the part of a generateContent request the tests look at
+type fakeGeminiRequest struct {
+	Contents []struct {
+		Parts []struct {
+			Text       string `json:"text"`
+			InlineData *struct {
+				MIMEType string `json:"mimeType"`
+				Data     []byte `json:"data"`
+			} `json:"inlineData"`
+		} `json:"parts"`
+	} `json:"contents"`
+}
+
+// useFakeGemini points a's Gemini calls at a test server that answers each request with the
+// text reply returns. It returns the requests received so far.
+func useFakeGemini(t *testing.T, a *App, reply func(req fakeGeminiRequest) string) func() []fakeGeminiRequest {
+	t.Helper()
+	var mu sync.Mutex
+	var received []fakeGeminiRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req fakeGeminiRequest
+		if !strings.HasSuffix(r.URL.Path, ":generateContent") || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, req)
+		mu.Unlock()
+
+		text := reply(req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"candidates": []any{map[string]any{
+				"content": map[string]any{"role": "model", "parts": []any{map[string]any{"text": text}}},
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	a.cfg.GeminiAPIKey = "test-key"
+	a.geminiBaseURL = srv.URL
+	return func() []fakeGeminiRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]fakeGeminiRequest(nil), received...)
+	}
+}
+
+func TestRewriteMergedDraft(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	reply := `{"title": "Beach Day", "description": "Sand everywhere.", "theme": "adventure"}`
+	requests := useFakeGemini(t, a, func(fakeGeminiRequest) string { return "```json\n" + reply + "\n```" })
+	sources := []PageDraft{{Title: "Sandcastle", Theme: "playful"}, {Title: "Waves", Theme: "serene"}}
+
+	title, description, theme, err := a.RewriteMergedDraft(t.Context(), sources)
+	if err != nil || title != "Beach Day" || description != "Sand everywhere." || theme != "adventure" {
+		t.Errorf("rewrite = %q, %q, %q, %v", title, description, theme, err)
+	}
+	if got := requests(); len(got) != 1 || !strings.Contains(got[0].Contents[0].Parts[0].Text, "Title: Waves") {
+		t.Errorf("requests = %+v; want one describing every page", got)
+	}
+
+	for _, bad := range []string{
+		`{"title": "Beach Day", "description": "", "theme": "spooky"}`,
+		`{"title": "", "description": "No title", "theme": "cozy"}`,
+		`no JSON at all`,
+	} {
+		reply = bad
+		if _, _, theme, err := a.RewriteMergedDraft(t.Context(), sources); err == nil {
+			t.Errorf("reply %s accepted with theme %q; want an error", bad, theme)
+		}
+	}
+}
+
+func TestClusteringSendsEachPhotoWithItsType(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	requests := useFakeGemini(t, a, func(fakeGeminiRequest) string {
+		return `{"clusters": [{"photoIndexes": [0, 1, 2], "title": "Everything", "description": "", "theme": "love"}]}`
+	})
+	keys := []string{"p.png", "p.webp", "p.heic"}
+	putTestBlob(t, a, "p.png", string(testPNG(t, 1)))
+	putTestBlob(t, a, "p.webp", string(readFixture(t, "photo.webp")))
+	putTestBlob(t, a, "p.heic", string(readFixture(t, "photo.heic")))
+
+	if _, err := a.AnalyzeAndClusterPhotos(t.Context(), []string{"p1", "p2", "p3"}, keys); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	if len(got) != 1 || len(got[0].Contents) != 1 {
+		t.Fatalf("requests = %+v; want one", got)
+	}
+
+	// Browsers' formats go as they are; HEIC is re-encoded as JPEG
+	var images []string
+	for _, part := range got[0].Contents[0].Parts {
+		if part.InlineData == nil {
+			continue
+		}
+		images = append(images, part.InlineData.MIMEType)
+		format, ok := sniffImageFormat(part.InlineData.Data)
+		if !ok || format.ContentType != part.InlineData.MIMEType {
+			t.Errorf("image labeled %s holds %s", part.InlineData.MIMEType, format.ContentType)
+		}
+	}
+	if strings.Join(images, " ") != "image/png image/webp image/jpeg" {
+		t.Errorf("image types sent = %v; want png, webp and jpeg", images)
+	}
+}
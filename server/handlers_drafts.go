@@ -2,98 +2,553 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
 )
 
-// In-memory storage for drafts (in production, use a database)
-var drafts = make(map[string]PageDraft)
-
-// HandleDrafts handles CRUD operations for page drafts
-func HandleDrafts(w http.ResponseWriter, r *http.Request) {
-	// Extract draft ID from path if present
-	path := strings.TrimPrefix(r.URL.Path, "/api/drafts/")
-	parts := strings.Split(path, "/")
-
-	switch r.Method {
-	case http.MethodGet:
-		handleGetDrafts(w, r, parts)
-	case http.MethodPut:
-		handleUpdateDraft(w, r, parts)
-	case http.MethodDelete:
-		handleDeleteDraft(w, r, parts)
-	default:
-		SendError(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-func handleGetDrafts(w http.ResponseWriter, r *http.Request, parts []string) {
-	// Get single draft by ID
-	if len(parts) == 1 && parts[0] != "" {
-		draftID := parts[0]
-		if draft, ok := drafts[draftID]; ok {
-			SendJSON(w, draft)
+// handleListDrafts returns a filtered, sorted page of drafts
+func (a *App) handleListDrafts(w http.ResponseWriter, r *http.Request) {
+	query, err := parseDraftQuery(r.URL.Query())
+	if err != nil {
+		sendQueryError(w, err)
+		return
+	}
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+	SendJSON(w, a.listDrafts(query, a.requestUser(r)))
+}
+
+// visibleTo reports whether a user may see and change a draft, as for catalogEntry.visibleTo
+func (d PageDraft) visibleTo(user string) bool {
+	return d.Owner == user
+}
+
+// ownDraft returns a draft the user may change, or sends the error response when it doesn't
+// exist or belongs to another user. Callers must hold draftsMu.
+func (a *App) ownDraft(w http.ResponseWriter, user, draftID string) (PageDraft, bool) {
+	draft, ok := a.drafts[draftID]
+	if !ok {
+		SendError(w, codeDraftNotFound, "Draft not found: "+draftID, http.StatusNotFound)
+		return PageDraft{}, false
+	}
+	if !draft.visibleTo(user) {
+		SendError(w, codeForbidden, "Draft belongs to another user: "+draftID, http.StatusForbidden)
+		return PageDraft{}, false
+	}
+	return draft, true
+}
+
+// ownPhotos checks that none of the photos belong to another user, sending the error response
+// if one does. Photos that no longer exist are left to the caller.
+func (a *App) ownPhotos(w http.ResponseWriter, user string, photoIDs []string) bool {
+	for _, photoID := range photoIDs {
+		if photo, ok := a.catalog.Get(photoID); ok && !photo.visibleTo(user) {
+			SendError(w, codeForbidden, "Photo belongs to another user: "+photoID, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// handleGetDraft returns a single draft
+func (a *App) handleGetDraft(w http.ResponseWriter, r *http.Request) {
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	if draft, ok := a.ownDraft(w, a.requestUser(r), r.PathValue("id")); ok {
+		SendJSON(w, draft)
+	}
+}
+
+// handleApproveDraft marks a draft as an approved page
+func (a *App) handleApproveDraft(w http.ResponseWriter, r *http.Request) {
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	draft, ok := a.ownDraft(w, a.requestUser(r), r.PathValue("id"))
+	if !ok {
+		return
+	}
+	approveDraft(&draft)
+	a.drafts[draft.ID] = draft
+	SendJSON(w, draft)
+}
+
+// approveDraft marks a draft as an approved page, recording when unless it already was one
+func approveDraft(draft *PageDraft) {
+	if draft.Status != "approved" || draft.ApprovedAt == "" {
+		draft.ApprovedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	draft.Status = "approved"
+}
+
+// handleUpdateDraft replaces a draft with the one in the request body
+func (a *App) handleUpdateDraft(w http.ResponseWriter, r *http.Request) {
+	draftID := r.PathValue("id")
+
+	var updatedDraft PageDraft
+	if err := json.NewDecoder(r.Body).Decode(&updatedDraft); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Paths are signed when drafts are sent back, so only backgrounds generated for a page are
+	// accepted; anything else would be a signed link to a file of the client's choosing
+	if !updatedDraft.BackgroundPath.IsZero() {
+		key, ok := updatedDraft.BackgroundPath.key()
+		if !ok || !a.backgrounds.Has(key) {
+			sendValidationError(w, invalidField("backgroundPath", "Background must be one generated for a page"))
 			return
 		}
-		SendError(w, "Draft not found", http.StatusNotFound)
+		updatedDraft.BackgroundPath = a.uploadPath(key)
+	}
+
+	layout, err := checkClientLayout(updatedDraft)
+	if err != nil {
+		sendValidationError(w, invalidField("layout", err.Error()))
+		return
+	}
+	updatedDraft.Layout = layout
+	if updatedDraft.Theme != "" && !validTheme(updatedDraft.Theme) {
+		sendValidationError(w, invalidField("theme", fmt.Sprintf("Unknown theme %q", updatedDraft.Theme)))
+		return
+	}
+
+	user := a.requestUser(r)
+	if !a.ownPhotos(w, user, updatedDraft.PhotoIds) {
 		return
 	}
 
-	// Return all drafts
-	var allDrafts []PageDraft
-	for _, draft := range drafts {
-		allDrafts = append(allDrafts, draft)
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	existing, ok := a.ownDraft(w, user, draftID)
+	if !ok {
+		return
+	}
+	updatedDraft.ID = draftID
+	updatedDraft.Owner = existing.Owner
+	a.refreshDraft(&updatedDraft)
+	a.drafts[draftID] = updatedDraft
+	SendJSON(w, updatedDraft)
+}
+
+func (a *App) handleDeleteDraft(w http.ResponseWriter, r *http.Request) {
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	if draft, ok := a.ownDraft(w, a.requestUser(r), r.PathValue("id")); ok {
+		delete(a.drafts, draft.ID)
+		SendJSON(w, map[string]bool{"success": true})
 	}
-	SendJSON(w, allDrafts)
 }
 
-func handleUpdateDraft(w http.ResponseWriter, r *http.Request, parts []string) {
-	if len(parts) < 1 || parts[0] == "" {
-		SendError(w, "Draft ID required", http.StatusBadRequest)
+// handleMergeDrafts combines several drafts into the target draft and removes the rest.
+// The target keeps its ID and cluster ID so references to it stay valid.
+func (a *App) handleMergeDrafts(w http.ResponseWriter, r *http.Request) {
+	var req MergeDraftsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.DraftIds) < 2 {
+		sendValidationError(w, invalidField("draftIds", "At least two draft IDs are required to merge"))
+		return
+	}
+	if req.Theme != "" && !validTheme(req.Theme) {
+		sendValidationError(w, invalidField("theme", fmt.Sprintf("Unknown theme %q", req.Theme)))
 		return
 	}
 
-	draftID := parts[0]
+	targetID := req.TargetID
+	if targetID == "" {
+		targetID = req.DraftIds[0]
+	}
 
-	// Check if this is an approve action
-	if len(parts) == 2 && parts[1] == "approve" {
-		if draft, ok := drafts[draftID]; ok {
-			draft.Status = "approved"
-			drafts[draftID] = draft
-			SendJSON(w, draft)
+	// Snapshot the drafts being merged; the AI rewrite below runs without holding the lock
+	user := a.requestUser(r)
+	a.draftsMu.Lock()
+	var sources []PageDraft
+	seen := make(map[string]bool)
+	targetFound := false
+	for _, id := range req.DraftIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		draft, ok := a.ownDraft(w, user, id)
+		if !ok {
+			a.draftsMu.Unlock()
 			return
 		}
-		SendError(w, "Draft not found", http.StatusNotFound)
+		if id == targetID {
+			targetFound = true
+		}
+		sources = append(sources, draft)
+	}
+	a.draftsMu.Unlock()
+
+	if !targetFound {
+		sendValidationError(w, invalidField("targetId", "Target draft must be one of the merged drafts"))
 		return
 	}
 
-	// Regular update
-	var updatedDraft PageDraft
-	if err := json.NewDecoder(r.Body).Decode(&updatedDraft); err != nil {
-		SendError(w, "Invalid request body", http.StatusBadRequest)
+	var target PageDraft
+	for _, d := range sources {
+		if d.ID == targetID {
+			target = d
+		}
+	}
+
+	merged := target
+	merged.PhotoIds = nil
+	inMerged := make(map[string]bool)
+	for _, d := range sources {
+		for _, photoID := range d.PhotoIds {
+			if !inMerged[photoID] {
+				inMerged[photoID] = true
+				merged.PhotoIds = append(merged.PhotoIds, photoID)
+			}
+		}
+	}
+
+	if req.Rewrite {
+		title, description, theme, err := a.RewriteMergedDraft(r.Context(), sources)
+		if err != nil {
+			log.Printf("Failed to rewrite merged draft %s: %v", targetID, err)
+			// Keep the target's text - the merge itself still succeeds
+		} else {
+			merged.Title, merged.Description, merged.Theme = title, description, theme
+		}
+	}
+
+	// Explicit values from the request win over both the target and the AI
+	if req.Title != "" {
+		merged.Title = req.Title
+	}
+	if req.Description != "" {
+		merged.Description = req.Description
+	}
+	if req.Theme != "" {
+		merged.Theme = req.Theme
+	}
+	merged.Status = "draft"
+	a.refreshDraft(&merged)
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	// The merge was computed from the snapshot, so any change made while the AI was working,
+	// such as a reorder, move or edit, would be overwritten; make the client retry instead
+	for _, d := range sources {
+		if current, ok := a.drafts[d.ID]; !ok || !reflect.DeepEqual(current, d) {
+			SendError(w, codeDraftConflict, "Draft was modified during merge: "+d.ID, http.StatusConflict)
+			return
+		}
+	}
+
+	for _, d := range sources {
+		if d.ID != targetID {
+			delete(a.drafts, d.ID)
+		}
+	}
+	a.drafts[targetID] = merged
+
+	log.Printf("Merged %d drafts into %s (%d photos)", len(sources), targetID, len(merged.PhotoIds))
+	SendJSON(w, merged)
+}
+
+// handleSplitDraft moves a subset of a draft's photos into a new draft with its own cluster ID
+func (a *App) handleSplitDraft(w http.ResponseWriter, r *http.Request) {
+	draftID := r.PathValue("id")
+	var req SplitDraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if _, ok := drafts[draftID]; ok {
-		updatedDraft.ID = draftID
-		drafts[draftID] = updatedDraft
-		SendJSON(w, updatedDraft)
+	if len(req.PhotoIds) == 0 {
+		sendValidationError(w, invalidField("photoIds", "No photo IDs provided"))
+		return
+	}
+	if req.Theme != "" && !validTheme(req.Theme) {
+		sendValidationError(w, invalidField("theme", fmt.Sprintf("Unknown theme %q", req.Theme)))
 		return
 	}
-	SendError(w, "Draft not found", http.StatusNotFound)
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	original, ok := a.ownDraft(w, a.requestUser(r), draftID)
+	if !ok {
+		return
+	}
+
+	splitSet := make(map[string]bool)
+	for _, photoID := range req.PhotoIds {
+		splitSet[photoID] = true
+	}
+
+	var kept, moved []string
+	for _, photoID := range original.PhotoIds {
+		if splitSet[photoID] {
+			moved = append(moved, photoID)
+		} else {
+			kept = append(kept, photoID)
+		}
+	}
+
+	if len(moved) != len(splitSet) {
+		sendValidationError(w, invalidField("photoIds", "All photos to split must belong to the draft"))
+		return
+	}
+	if len(kept) == 0 {
+		SendError(w, codeDraftWouldBeEmpty, "Cannot split off every photo in the draft", http.StatusBadRequest)
+		return
+	}
+
+	created := PageDraft{
+		ID:             uuid.New().String(),
+		ClusterID:      uuid.New().String(),
+		PhotoIds:       moved,
+		Title:          original.Title,
+		Description:    original.Description,
+		Theme:          original.Theme,
+		BackgroundPath: original.BackgroundPath,
+		Status:         "draft",
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+		Owner:          original.Owner,
+	}
+	if req.Title != "" {
+		created.Title = req.Title
+	}
+	if req.Description != "" {
+		created.Description = req.Description
+	}
+	if req.Theme != "" {
+		created.Theme = req.Theme
+	}
+
+	if splitSet[original.CoverPhotoID] {
+		created.CoverPhotoID = original.CoverPhotoID
+		original.CoverPhotoID = ""
+	}
+
+	original.PhotoIds = kept
+	a.refreshDraft(&original)
+	a.refreshDraft(&created)
+	a.drafts[original.ID] = original
+	a.drafts[created.ID] = created
+
+	log.Printf("Split %d photos from draft %s into %s", len(moved), original.ID, created.ID)
+	SendJSON(w, SplitDraftResponse{
+		Original: original,
+		Created:  created,
+	})
 }
 
-func handleDeleteDraft(w http.ResponseWriter, r *http.Request, parts []string) {
-	if len(parts) < 1 || parts[0] == "" {
-		SendError(w, "Draft ID required", http.StatusBadRequest)
+// handleReorderPhotos replaces a draft's photo order; the new order must contain exactly the same photos
+func (a *App) handleReorderPhotos(w http.ResponseWriter, r *http.Request) {
+	draftID := r.PathValue("id")
+
+	var req ReorderPhotosRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	draftID := parts[0]
-	if _, ok := drafts[draftID]; ok {
-		delete(drafts, draftID)
-		SendJSON(w, map[string]bool{"success": true})
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	draft, ok := a.ownDraft(w, a.requestUser(r), draftID)
+	if !ok {
+		return
+	}
+
+	if !samePhotoSet(draft.PhotoIds, req.PhotoIds) {
+		sendValidationError(w, invalidField("photoIds", "Photo order must contain exactly the draft's photos"))
+		return
+	}
+
+	draft.PhotoIds = req.PhotoIds
+	a.refreshDraft(&draft)
+	a.drafts[draftID] = draft
+	SendJSON(w, draft)
+}
+
+// handleSetCover marks one of the draft's photos as the page's hero photo
+func (a *App) handleSetCover(w http.ResponseWriter, r *http.Request) {
+	draftID := r.PathValue("id")
+
+	var req SetCoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	draft, ok := a.ownDraft(w, a.requestUser(r), draftID)
+	if !ok {
+		return
+	}
+
+	if req.PhotoID != "" && indexOf(draft.PhotoIds, req.PhotoID) == -1 {
+		sendValidationError(w, invalidField("photoId", "Cover photo must belong to the draft"))
 		return
 	}
-	SendError(w, "Draft not found", http.StatusNotFound)
+
+	draft.CoverPhotoID = req.PhotoID
+	a.refreshDraft(&draft)
+	a.drafts[draftID] = draft
+	SendJSON(w, draft)
+}
+
+// handleMovePhoto moves or copies a photo from one draft to another.
+// Both drafts are updated under the same lock so the change is atomic.
+func (a *App) handleMovePhoto(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.PathValue("id")
+	var req MovePhotoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var missing []FieldError
+	if req.PhotoID == "" {
+		missing = append(missing, invalidField("photoId", "Photo ID is required"))
+	}
+	if req.TargetDraftID == "" {
+		missing = append(missing, invalidField("targetDraftId", "Target draft ID is required"))
+	}
+	if missing != nil {
+		sendValidationError(w, missing...)
+		return
+	}
+	if req.TargetDraftID == sourceID {
+		sendValidationError(w, invalidField("targetDraftId", "Target draft must differ from the source draft"))
+		return
+	}
+
+	user := a.requestUser(r)
+	photo, ok := a.catalog.Get(req.PhotoID)
+	if !ok {
+		SendError(w, codePhotoNotFound, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if !photo.visibleTo(user) {
+		SendError(w, codeForbidden, "Photo belongs to another user: "+req.PhotoID, http.StatusForbidden)
+		return
+	}
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	source, ok := a.ownDraft(w, user, sourceID)
+	if !ok {
+		return
+	}
+	target, ok := a.ownDraft(w, user, req.TargetDraftID)
+	if !ok {
+		return
+	}
+
+	idx := indexOf(source.PhotoIds, req.PhotoID)
+	if idx == -1 {
+		SendError(w, codePhotoNotOnDraft, "Photo does not belong to the source draft", http.StatusBadRequest)
+		return
+	}
+	if indexOf(target.PhotoIds, req.PhotoID) != -1 {
+		SendError(w, codePhotoAlreadyOnPage, "Photo is already on the target draft", http.StatusConflict)
+		return
+	}
+
+	pos := len(target.PhotoIds)
+	if req.Position != nil {
+		if *req.Position < 0 || *req.Position > len(target.PhotoIds) {
+			sendValidationError(w, invalidField("position", "Position out of range"))
+			return
+		}
+		pos = *req.Position
+	}
+
+	if !req.Copy {
+		if len(source.PhotoIds) == 1 {
+			SendError(w, codeDraftWouldBeEmpty, "Cannot move the last photo off a draft; delete the draft instead", http.StatusBadRequest)
+			return
+		}
+		source.PhotoIds = append(source.PhotoIds[:idx:idx], source.PhotoIds[idx+1:]...)
+		if source.CoverPhotoID == req.PhotoID {
+			source.CoverPhotoID = ""
+		}
+	}
+
+	photoIds := make([]string, 0, len(target.PhotoIds)+1)
+	photoIds = append(photoIds, target.PhotoIds[:pos]...)
+	photoIds = append(photoIds, req.PhotoID)
+	photoIds = append(photoIds, target.PhotoIds[pos:]...)
+	target.PhotoIds = photoIds
+
+	a.refreshDraft(&source)
+	a.refreshDraft(&target)
+	a.drafts[source.ID] = source
+	a.drafts[target.ID] = target
+
+	SendJSON(w, MovePhotoResponse{
+		Source: source,
+		Target: target,
+	})
+}
+
+// indexOf returns the position of id in ids, or -1 if absent
+func indexOf(ids []string, id string) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// samePhotoSet reports whether b is a permutation of a
+func samePhotoSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, id := range a {
+		counts[id]++
+	}
+	for _, id := range b {
+		if counts[id] == 0 {
+			return false
+		}
+		counts[id]--
+	}
+	return true
+}
+
+// refreshDraft recomputes the fields derived from a draft's photos after they change
+func (a *App) refreshDraft(draft *PageDraft) {
+	a.refreshLayout(draft)
+
+	var earliest time.Time
+	for _, photoID := range draft.PhotoIds {
+		taken, ok := a.photoCaptureTime(photoID)
+		if ok && (earliest.IsZero() || taken.Before(earliest)) {
+			earliest = taken
+		}
+	}
+	draft.CapturedAt = ""
+	if !earliest.IsZero() {
+		draft.CapturedAt = earliest.UTC().Format(time.RFC3339)
+	}
 }
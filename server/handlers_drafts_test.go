@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// draftTestApp returns an app whose catalog holds alice's photos a1-a3 and bob's photo b1,
+// with drafts da1 and da2 owned by alice and db1 owned by bob
+func draftTestApp(t *testing.T) (a *App, sign func(user string) string) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.ClerkJWKSURL = "http://jwks.invalid/jwks.json"
+	a = newTestApp(t, cfg)
+	sign = useTestSessionKey(t, a)
+
+	for id, owner := range map[string]string{"a1": "user_alice", "a2": "user_alice", "a3": "user_alice", "b1": "user_bob"} {
+		photo := Photo{ID: id, Filename: id + ".png", Width: 8, Height: 6, UploadedAt: time.Now()}
+		if err := a.catalog.Add(t.Context(), catalogEntry{Photo: photo, Key: id + ".png", Owner: owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []PageDraft{
+		{ID: "da1", PhotoIds: []string{"a1", "a2"}, Owner: "user_alice"},
+		{ID: "da2", PhotoIds: []string{"a3"}, Owner: "user_alice"},
+		{ID: "db1", PhotoIds: []string{"b1"}, Owner: "user_bob"},
+	} {
+		d.Status = "draft"
+		d.CreatedAt = time.Now().Format(time.RFC3339)
+		a.drafts[d.ID] = d
+	}
+	return a, sign
+}
+
+// sendAs sends a request through the router with a session token for user, or anonymously
+func sendAs(t *testing.T, h http.Handler, sign func(string) string, user, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.Header.Set("Authorization", "Bearer "+sign(user))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDraftsAreScopedToTheirOwner(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	rec := sendAs(t, router, sign, "user_bob", "GET", "/drafts", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "da1") || !strings.Contains(rec.Body.String(), "db1") {
+		t.Errorf("bob listing drafts: %d %s; want only his own", rec.Code, rec.Body)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/drafts/da1", ""},
+		{"PUT", "/drafts/da1", `{"photoIds":["a1"],"status":"draft"}`},
+		{"DELETE", "/drafts/da1", ""},
+		{"POST", "/drafts/da1/approve", ""},
+		{"PUT", "/drafts/da1/photos", `{"photoIds":["a2","a1"]}`},
+		{"PUT", "/drafts/da1/cover", `{"photoId":"a1"}`},
+		{"PUT", "/drafts/da1/layout", `{"template":"auto"}`},
+		{"POST", "/drafts/da1/split", `{"photoIds":["a1"]}`},
+		{"POST", "/drafts/merge", `{"draftIds":["db1","da1"]}`},
+		{"POST", "/drafts/db1/photos/move", `{"photoId":"b1","targetDraftId":"da2","copy":true}`},
+		{"POST", "/drafts/da1/photos/move", `{"photoId":"a1","targetDraftId":"db1"}`},
+	} {
+		rec := sendAs(t, router, sign, "user_bob", tc.method, tc.path, tc.body)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("bob: %s %s = %d %s; want 403", tc.method, tc.path, rec.Code, rec.Body)
+		}
+	}
+
+	// Bob can't put alice's photos on his own draft either
+	if rec := sendAs(t, router, sign, "user_bob", "PUT", "/drafts/db1", `{"photoIds":["b1","a1"],"status":"draft"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("bob adding alice's photo to his draft = %d; want 403", rec.Code)
+	}
+
+	rec = sendAs(t, router, sign, "user_bob", "POST", "/drafts/batch", `{"operations":[{"op":"approve","draftId":"da1"}]}`)
+	if rec.Code != http.StatusMultiStatus || a.drafts["da1"].Status != "draft" {
+		t.Errorf("bob approving alice's draft in a batch: %d %s; want it to fail", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "", "GET", "/drafts/da1", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET of alice's draft = %d; want 401", rec.Code)
+	}
+
+	if d := a.drafts["da1"]; len(d.PhotoIds) != 2 || d.Status != "draft" {
+		t.Errorf("alice's draft changed: %+v", d)
+	}
+
+	// Alice keeps full access, and ownership survives a replace
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", `{"photoIds":["a2","a1"],"status":"draft"}`); rec.Code != http.StatusOK {
+		t.Fatalf("alice replacing her draft = %d %s", rec.Code, rec.Body)
+	}
+	if owner := a.drafts["da1"].Owner; owner != "user_alice" {
+		t.Errorf("owner after replace = %q; want user_alice", owner)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/da1/split", `{"photoIds":["a1"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("alice splitting her draft = %d %s", rec.Code, rec.Body)
+	}
+	for id, d := range a.drafts {
+		if id != "db1" && d.Owner != "user_alice" {
+			t.Errorf("draft %s is owned by %q after alice's split; want user_alice", id, d.Owner)
+		}
+	}
+}
+
+func TestUpdateDraftOnlyAcceptsGeneratedBackgrounds(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	a.backgrounds.Add(backgroundPrefix + "bg.png")
+
+	for _, path := range []string{"/uploads/a1.png", "/uploads/catalog.json", "/uploads/backgrounds/missing.png", "backgrounds/bg.png"} {
+		body := `{"photoIds":["a1","a2"],"status":"draft","backgroundPath":"` + path + `"}`
+		if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("backgroundPath %q = %d %s; want 400", path, rec.Code, rec.Body)
+		}
+	}
+
+	body := `{"photoIds":["a1","a2"],"status":"draft","backgroundPath":"/uploads/backgrounds/bg.png?exp=1&sig=forged"}`
+	rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("generated background = %d %s; want 200", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `"backgroundPath":"/uploads/backgrounds/bg.png?exp=`) || strings.Contains(rec.Body.String(), "forged") {
+		t.Errorf("response %s; want the background signed by the server", rec.Body)
+	}
+}
+
+func TestUpdateDraftValidatesManualLayouts(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	placements := func(slot2, crop2 string, rotation int) string {
+		return fmt.Sprintf(`[{"photoId":"a1","slot":"photo-1","crop":{"x":0,"y":0,"w":1,"h":1},"frame":{"x":0,"y":0,"w":5,"h":5}},`+
+			`{"photoId":"a2","slot":"%s","crop":%s,"rotation":%d}]`, slot2, crop2, rotation)
+	}
+	full := `{"x":0,"y":0,"w":1,"h":1}`
+	for name, layout := range map[string]string{
+		"unknown template": `{"template":"nope","placements":` + placements("photo-2", full, 0) + `}`,
+		"wrong count":      `{"template":"single-hero","placements":` + placements("photo-2", full, 0) + `}`,
+		"unknown slot":     `{"template":"two-up","placements":` + placements("hero", full, 0) + `}`,
+		"shared slot":      `{"template":"two-up","placements":` + placements("photo-1", full, 0) + `}`,
+		"crop outside":     `{"template":"two-up","placements":` + placements("photo-2", `{"x":0.5,"y":0,"w":1,"h":1}`, 0) + `}`,
+		"rotation":         `{"template":"two-up","placements":` + placements("photo-2", full, 7200) + `}`,
+	} {
+		body := `{"photoIds":["a1","a2"],"status":"draft","layout":` + layout + `}`
+		if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: PUT = %d %s; want 400", name, rec.Code, rec.Body)
+		}
+	}
+
+	body := `{"photoIds":["a1","a2"],"status":"draft","layout":{"template":"two-up","placements":` + placements("photo-2", full, 90) + `}}`
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", body); rec.Code != http.StatusOK {
+		t.Fatalf("valid manual layout = %d %s; want 200", rec.Code, rec.Body)
+	}
+	layout := a.drafts["da1"].Layout
+	if layout == nil || layout.Template != "two-up" || layout.Placements[0].Frame.W >= 1 || layout.Placements[1].Rotation != 90 {
+		t.Errorf("stored layout %+v; want the placements with frames from the template", layout)
+	}
+}
+
+func TestMergeDrafts(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	d := a.drafts["da2"]
+	d.Title, d.Theme = "Bath time", "cozy"
+	a.drafts["da2"] = d
+
+	for name, body := range map[string]string{
+		"one draft":      `{"draftIds":["da1"]}`,
+		"unknown theme":  `{"draftIds":["da1","da2"],"theme":"spooky"}`,
+		"target outside": `{"draftIds":["da1","da2"],"targetId":"db1"}`,
+	} {
+		if rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/merge", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: merge = %d %s; want 400", name, rec.Code, rec.Body)
+		}
+	}
+	if len(a.drafts) != 3 {
+		t.Fatalf("rejected merges changed the drafts: %v", a.drafts)
+	}
+
+	// The AI's theme is used unless the request names one
+	useFakeGemini(t, a, func(fakeGeminiRequest) string {
+		return `{"title": "Splashy morning", "description": "Bubbles.", "theme": "playful"}`
+	})
+	rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/merge", `{"draftIds":["da1","da2"],"targetId":"da2","rewrite":true,"title":"Our morning"}`)
+	var merged PageDraft
+	if err := json.Unmarshal(rec.Body.Bytes(), &merged); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("merge = %d %s", rec.Code, rec.Body)
+	}
+	if merged.ID != "da2" || !slices.Equal(merged.PhotoIds, []string{"a1", "a2", "a3"}) || a.drafts["da2"].Owner != "user_alice" {
+		t.Errorf("merged draft = %+v; want da2 with every photo in order", merged)
+	}
+	if merged.Title != "Our morning" || merged.Description != "Bubbles." || merged.Theme != "playful" {
+		t.Errorf("merged text = %q, %q, %q; want the request's title over the AI's", merged.Title, merged.Description, merged.Theme)
+	}
+	if _, ok := a.drafts["da1"]; ok {
+		t.Error("da1 still exists after being merged")
+	}
+}
+
+func TestMergeConflictsWithChangesDuringRewrite(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	// Another request reorders da1 while the AI is writing the merged page
+	useFakeGemini(t, a, func(fakeGeminiRequest) string {
+		a.draftsMu.Lock()
+		d := a.drafts["da1"]
+		d.PhotoIds = []string{"a2", "a1"}
+		a.drafts["da1"] = d
+		a.draftsMu.Unlock()
+		return `{"title": "Merged", "description": "", "theme": "love"}`
+	})
+	rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/merge", `{"draftIds":["da1","da2"],"rewrite":true}`)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), codeDraftConflict) {
+		t.Fatalf("merge = %d %s; want 409 %s", rec.Code, rec.Body, codeDraftConflict)
+	}
+	if d, ok := a.drafts["da2"]; !ok || !slices.Equal(d.PhotoIds, []string{"a3"}) {
+		t.Errorf("da2 = %+v, %v; want it untouched", d, ok)
+	}
+	if d := a.drafts["da1"]; !slices.Equal(d.PhotoIds, []string{"a2", "a1"}) || d.Title == "Merged" {
+		t.Errorf("da1 = %+v; want the concurrent reorder kept", d)
+	}
+}
+
+func TestSplitDraft(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	d := a.drafts["da1"]
+	d.CoverPhotoID, d.Theme = "a1", "cozy"
+	a.drafts["da1"] = d
+
+	for name, tc := range map[string]struct{ body, code string }{
+		"no photos":     {`{"photoIds":[]}`, codeValidationFailed},
+		"not on draft":  {`{"photoIds":["a3"]}`, codeValidationFailed},
+		"every photo":   {`{"photoIds":["a1","a2"]}`, codeDraftWouldBeEmpty},
+		"unknown theme": {`{"photoIds":["a1"],"theme":"spooky"}`, codeValidationFailed},
+	} {
+		rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/da1/split", tc.body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.code) {
+			t.Errorf("%s: split = %d %s; want 400 %s", name, rec.Code, rec.Body, tc.code)
+		}
+	}
+
+	rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/da1/split", `{"photoIds":["a1"],"title":"First bath","theme":"serene"}`)
+	var split SplitDraftResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &split); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("split = %d %s", rec.Code, rec.Body)
+	}
+	if o := split.Original; !slices.Equal(o.PhotoIds, []string{"a2"}) || o.CoverPhotoID != "" || o.Theme != "cozy" {
+		t.Errorf("original = %+v; want a2 left, without the cover", o)
+	}
+	c := split.Created
+	if !slices.Equal(c.PhotoIds, []string{"a1"}) || c.CoverPhotoID != "a1" || c.Title != "First bath" || c.Theme != "serene" {
+		t.Errorf("created = %+v; want a1 as its cover with the request's title and theme", c)
+	}
+	if c.ID == "da1" || c.ClusterID == "" || c.ClusterID == split.Original.ClusterID {
+		t.Errorf("created IDs = %q, cluster %q; want new ones", c.ID, c.ClusterID)
+	}
+	if created, err := time.Parse(time.RFC3339, c.CreatedAt); err != nil || !strings.HasSuffix(c.CreatedAt, "Z") || time.Since(created) > time.Minute {
+		t.Errorf("createdAt = %q; want the current time in UTC", c.CreatedAt)
+	}
+	if stored := a.drafts[c.ID]; !slices.Equal(stored.PhotoIds, c.PhotoIds) || stored.Owner != "user_alice" {
+		t.Errorf("stored created draft = %+v; want it owned by alice", stored)
+	}
+}
+
+func TestUpdateDraftValidatesTheme(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", `{"photoIds":["a1","a2"],"status":"draft","theme":"spooky"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown theme = %d %s; want 400", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1", `{"photoIds":["a1","a2"],"status":"draft","theme":"growth"}`); rec.Code != http.StatusOK || a.drafts["da1"].Theme != "growth" {
+		t.Errorf("known theme = %d %s; want it saved", rec.Code, rec.Body)
+	}
+}
+
+func TestMoveAndCopyPhotosBetweenDrafts(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	d := a.drafts["da1"]
+	d.CoverPhotoID = "a1"
+	a.drafts["da1"] = d
+
+	move := func(body string) (MovePhotoResponse, *httptest.ResponseRecorder) {
+		t.Helper()
+		rec := sendAs(t, router, sign, "user_alice", "POST", "/drafts/da1/photos/move", body)
+		var resp MovePhotoResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, rec
+	}
+
+	// A copy leaves the source alone and goes where it was asked to
+	resp, rec := move(`{"photoId":"a1","targetDraftId":"da2","copy":true,"position":0}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("copy = %d %s", rec.Code, rec.Body)
+	}
+	if !slices.Equal(resp.Source.PhotoIds, []string{"a1", "a2"}) || resp.Source.CoverPhotoID != "a1" || !slices.Equal(resp.Target.PhotoIds, []string{"a1", "a3"}) {
+		t.Errorf("after copy: source %v (cover %q), target %v; want a1 on both, first on the target", resp.Source.PhotoIds, resp.Source.CoverPhotoID, resp.Target.PhotoIds)
+	}
+	if _, rec := move(`{"photoId":"a1","targetDraftId":"da2","copy":true}`); rec.Code != http.StatusConflict {
+		t.Errorf("copying onto a draft that has the photo = %d; want 409", rec.Code)
+	}
+
+	// A move takes the photo, and its cover role, off the source
+	resp, rec = move(`{"photoId":"a2","targetDraftId":"db1"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("move onto bob's draft = %d; want 403", rec.Code)
+	}
+	if _, rec := move(`{"photoId":"a1","targetDraftId":"da3"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("move onto a missing draft = %d; want 404", rec.Code)
+	}
+	sendAs(t, router, sign, "user_alice", "DELETE", "/drafts/da2", "")
+	a.drafts["da3"] = PageDraft{ID: "da3", PhotoIds: []string{"a3"}, Status: "draft", Owner: "user_alice"}
+	resp, rec = move(`{"photoId":"a1","targetDraftId":"da3"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("move = %d %s", rec.Code, rec.Body)
+	}
+	if !slices.Equal(resp.Source.PhotoIds, []string{"a2"}) || resp.Source.CoverPhotoID != "" || !slices.Equal(resp.Target.PhotoIds, []string{"a3", "a1"}) {
+		t.Errorf("after move: source %v (cover %q), target %v; want a1 moved to the end of da3 and no cover left", resp.Source.PhotoIds, resp.Source.CoverPhotoID, resp.Target.PhotoIds)
+	}
+	if _, rec := move(`{"photoId":"a2","targetDraftId":"da3"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), codeDraftWouldBeEmpty) {
+		t.Errorf("moving the last photo = %d %s; want 400 %s", rec.Code, rec.Body, codeDraftWouldBeEmpty)
+	}
+	if _, rec := move(`{"photoId":"a2","targetDraftId":"da3","copy":true,"position":5}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("position past the end = %d; want 400", rec.Code)
+	}
+	if d := a.drafts["da3"]; !slices.Equal(d.PhotoIds, []string{"a3", "a1"}) {
+		t.Errorf("da3 after rejected moves = %v", d.PhotoIds)
+	}
+}
+
+func TestReorderPhotosAndSetCover(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	for name, body := range map[string]string{
+		"duplicate": `{"photoIds":["a1","a1"]}`,
+		"missing":   `{"photoIds":["a2"]}`,
+		"extra":     `{"photoIds":["a2","a1","a3"]}`,
+		"other":     `{"photoIds":["a2","a3"]}`,
+	} {
+		if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1/photos", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: reorder = %d %s; want 400", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1/photos", `{"photoIds":["a2","a1"]}`); rec.Code != http.StatusOK || !slices.Equal(a.drafts["da1"].PhotoIds, []string{"a2", "a1"}) {
+		t.Errorf("reorder = %d %s; want a2, a1", rec.Code, rec.Body)
+	}
+
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1/cover", `{"photoId":"a3"}`); rec.Code != http.StatusBadRequest || a.drafts["da1"].CoverPhotoID != "" {
+		t.Errorf("cover from another page = %d %s; want 400", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1/cover", `{"photoId":"a1"}`); rec.Code != http.StatusOK || a.drafts["da1"].CoverPhotoID != "a1" {
+		t.Errorf("cover = %d %s; want a1", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/drafts/da1/cover", `{"photoId":""}`); rec.Code != http.StatusOK || a.drafts["da1"].CoverPhotoID != "" {
+		t.Errorf("clearing the cover = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	_ "image/gif"
 	"image/jpeg"
 	_ "image/png"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,272 +26,533 @@ import (
 	"github.com/google/uuid"
 )
 
-const (
-	thumbWidth  = 800 // Width for thumbnails used in page view
-	thumbHeight = 600 // Max height for thumbnails
-)
-
-// generateThumbnail creates a resized version of an image
-func generateThumbnail(srcPath, dstPath string) error {
-	src, err := imaging.Open(srcPath)
+// generateRenditions creates the thumbnail and, if requested, the full-size display JPEG of a stored photo
+func (a *App) generateRenditions(ctx context.Context, srcKey, photoID string, thumb, display bool) error {
+	rc, _, err := a.store.Get(ctx, srcKey)
 	if err != nil {
 		return fmt.Errorf("failed to open image: %w", err)
 	}
+	defer rc.Close()
 
-	// Resize to fit within bounds while maintaining aspect ratio
-	thumb := imaging.Fit(src, thumbWidth, thumbHeight, imaging.Lanczos)
-
-	// Save as JPEG with good quality (smaller file size)
-	out, err := os.Create(dstPath)
+	src, err := imaging.Decode(rc, imaging.AutoOrientation(true))
 	if err != nil {
-		return fmt.Errorf("failed to create thumbnail file: %w", err)
+		return fmt.Errorf("failed to decode image: %w", err)
 	}
-	defer out.Close()
+
+	if thumb {
+		if err := a.putThumbnail(ctx, src, photoID+"_thumb.jpg"); err != nil {
+			return err
+		}
+	}
+	if display {
+		return a.putDisplayRendition(ctx, src, photoID)
+	}
+	return nil
+}
+
+// putThumbnail resizes a decoded image and stores it as a JPEG
+func (a *App) putThumbnail(ctx context.Context, src image.Image, dstKey string) error {
+	// Resize to fit within bounds while maintaining aspect ratio
+	thumb := imaging.Fit(src, a.cfg.ThumbWidth, a.cfg.ThumbHeight, imaging.Lanczos)
 
 	// Encode as JPEG with 85% quality - good balance of size and quality
-	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 85}); err != nil {
-		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	return a.putJPEG(ctx, thumb, dstKey, 85)
+}
+
+// putDisplayRendition stores a full-size JPEG copy of a photo whose format browsers can't display
+func (a *App) putDisplayRendition(ctx context.Context, src image.Image, photoID string) error {
+	return a.putJPEG(ctx, src, displayRenditionKey(photoID), 90)
+}
+
+// putJPEG encodes an image as a JPEG and stores it
+func (a *App) putJPEG(ctx context.Context, img image.Image, dstKey string, quality int) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", dstKey, err)
+	}
+
+	if err := putBlob(ctx, a.store, dstKey, buf.Bytes(), "image/jpeg"); err != nil {
+		return fmt.Errorf("failed to store %s: %w", dstKey, err)
 	}
 
 	return nil
 }
 
-// HandleUpload handles photo upload requests
-func HandleUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		SendError(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// spoolUpload copies an uploaded file to a local temp file, hashing it on the way, so it can
+// be validated and stored without holding it in memory. At most limit+1 bytes are read; a
+// size above limit means the file was too large. The caller must call closeSpool.
+func spoolUpload(src io.Reader, limit int64) (f *os.File, size int64, sum string, err error) {
+	f, err = os.CreateTemp("", uploadSpoolPattern)
+	if err != nil {
+		return nil, 0, "", err
 	}
 
-	// Parse multipart form with max size
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		log.Printf("ParseMultipartForm error: %v", err)
-		SendError(w, "Failed to parse upload. Maximum total size is 50MB", http.StatusBadRequest)
-		return
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, hash), io.LimitReader(src, limit+1))
+	if err != nil {
+		closeSpool(f)
+		return nil, 0, "", err
 	}
-	defer r.MultipartForm.RemoveAll()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		closeSpool(f)
+		return nil, 0, "", err
+	}
+	return f, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	files := r.MultipartForm.File["photos"]
-	if len(files) == 0 {
-		SendError(w, "No files uploaded", http.StatusBadRequest)
-		return
+// closeSpool closes and deletes a temp file created by spoolUpload
+func closeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// storePhoto saves a validated original and adds it to the catalog as owned by the given user.
+// If the user already has identical content, their existing photo is returned with Duplicate set.
+func (a *App) storePhoto(ctx context.Context, owner, filename string, src io.ReadSeeker, size int64, sum string, format imageFormat, img image.Image) (Photo, error) {
+	photo := Photo{SHA256: sum}
+	describeDecoded(&photo, img)
+
+	if existing, ok := a.catalog.FindBySHA(owner, photo.SHA256); ok {
+		photo, _ = a.catalog.Photo(existing.ID)
+		photo.Duplicate = true
+		return photo, nil
 	}
 
-	if len(files) > maxPhotoCount {
-		SendError(w, fmt.Sprintf("Too many files. Maximum is %d photos per upload", maxPhotoCount), http.StatusBadRequest)
-		return
+	if err := readPhotoMetadataFrom(&photo, src, format, int64(a.cfg.MaxFileSize)); err != nil {
+		log.Printf("Warning: failed to read metadata of %s: %v", filename, err)
 	}
 
-	var uploadedPhotos []Photo
+	photoID := ownedPhotoID(owner, photo.SHA256)
+	key := photoID + format.Ext
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return Photo{}, err
+	}
+	if err := a.store.Put(ctx, key, src, size, format.ContentType); err != nil {
+		return Photo{}, err
+	}
 
-	for _, fileHeader := range files {
-		// Validate file type
-		if !isValidImageType(fileHeader.Filename) {
-			continue
+	// Generate thumbnail for faster loading
+	thumbFilename := photoID + "_thumb.jpg"
+	if err := a.putThumbnail(ctx, img, thumbFilename); err != nil {
+		log.Printf("Warning: failed to generate thumbnail for %s: %v", photoID, err)
+		// Continue without thumbnail - original will be used
+	} else {
+		log.Printf("Generated thumbnail: %s", thumbFilename)
+	}
+
+	// Browsers other than Safari can't show HEIC, so keep a JPEG to serve in its place
+	if !browserSafe(format) {
+		if err := a.putDisplayRendition(ctx, img, photoID); err != nil {
+			log.Printf("Warning: failed to generate JPEG rendition for %s: %v", photoID, err)
 		}
+	}
 
-		// Validate individual file size
-		if fileHeader.Size > maxFileSize {
-			log.Printf("File %s exceeds max size (%d > %d bytes)", fileHeader.Filename, fileHeader.Size, maxFileSize)
-			continue
+	photo.ID = photoID
+	photo.Filename = filename
+	photo.Path = a.uploadPath(key)
+	photo.Size = size
+	photo.UploadedAt = time.Now()
+
+	if err := a.catalog.Add(ctx, catalogEntry{Photo: photo, Key: key, Owner: owner}); err != nil {
+		return Photo{}, fmt.Errorf("failed to update catalog: %w", err)
+	}
+	photo, _ = a.catalog.Photo(photoID)
+	return photo, nil
+}
+
+// ingestUploadPart streams one file from a multipart upload and ingests it
+func (a *App) ingestUploadPart(ctx context.Context, owner string, part *multipart.Part) UploadFileResult {
+	filename := part.FileName()
+
+	f, size, sum, err := spoolUpload(part, int64(a.cfg.MaxFileSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return rejectedUpload(filename, rejectFile(rejectTooLarge, "Upload exceeds the %s request limit", a.cfg.MaxTotalSize))
 		}
+		log.Printf("Error receiving %s: %v", filename, err)
+		return rejectedUpload(filename, rejectFile(rejectReadFailed, "File could not be read"))
+	}
+	defer closeSpool(f)
 
-		file, err := fileHeader.Open()
-		if err != nil {
-			log.Printf("Error opening file %s: %v", fileHeader.Filename, err)
-			continue
+	// Validate individual file size
+	if size > int64(a.cfg.MaxFileSize) {
+		return rejectedUpload(filename, rejectFile(rejectTooLarge, "File is larger than the maximum of %d bytes", a.cfg.MaxFileSize))
+	}
+
+	return a.ingestUpload(ctx, owner, filename, f, size, sum)
+}
+
+// ingestUpload validates and stores one uploaded file for a user and reports what happened to it
+func (a *App) ingestUpload(ctx context.Context, owner, filename string, src io.ReadSeeker, size int64, sum string) UploadFileResult {
+	// Check the content is really an image of the type its name claims
+	format, img, uerr := validateUpload(filename, src)
+	if uerr != nil {
+		return rejectedUpload(filename, uerr)
+	}
+
+	photo, err := a.storePhoto(ctx, owner, filename, src, size, sum, format, img)
+	if err != nil {
+		log.Printf("Error saving file %s: %v", filename, err)
+		return rejectedUpload(filename, rejectFile(rejectStoreFailed, "File could not be saved"))
+	}
+
+	result := UploadFileResult{Filename: filename, Status: "accepted", Photo: &photo}
+	if photo.Duplicate {
+		log.Printf("Duplicate: %s is already stored as %s", filename, photo.ID)
+		result.Status = "duplicate"
+		result.DuplicateOf = photo.ID
+	} else {
+		log.Printf("Uploaded: %s -> %s (%d bytes)", filename, photo.ID, photo.Size)
+	}
+	return result
+}
+
+// rejectedUpload reports a file that was not accepted
+func rejectedUpload(filename string, err *uploadError) UploadFileResult {
+	log.Printf("Rejected %s: %s", filename, err.Message)
+	return UploadFileResult{Filename: filename, Status: "rejected", Code: err.Code, Reason: err.Message}
+}
+
+// rejectedFiles lists the files an upload rejected as field errors
+func rejectedFiles(results []UploadFileResult) []FieldError {
+	var fields []FieldError
+	for _, result := range results {
+		if result.Status == "rejected" {
+			fields = append(fields, FieldError{Field: result.Filename, Code: result.Code, Message: result.Reason})
 		}
-		defer file.Close()
+	}
+	return fields
+}
 
-		// Generate unique filename
-		ext := filepath.Ext(fileHeader.Filename)
-		photoID := uuid.New().String()
-		newFilename := photoID + ext
-		filePath := filepath.Join(uploadDir, newFilename)
+// HandleUpload handles photo upload requests
+func (a *App) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	// Stream parts one at a time rather than buffering the whole form
+	r.Body = http.MaxBytesReader(w, r.Body, int64(a.cfg.MaxTotalSize))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		SendError(w, codeNotMultipart, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
 
-		// Create destination file
-		dst, err := os.Create(filePath)
+	owner := a.requestUser(r)
+	var uploadedPhotos []Photo
+	var results []UploadFileResult
+	rejected := 0
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Printf("Error creating file %s: %v", filePath, err)
-			continue
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				// Files before the limit were kept and are reported with their IDs; the rest of the
+				// request wasn't read
+				SendProblem(w, ErrorResponse{
+					Status:  http.StatusRequestEntityTooLarge,
+					Code:    codeRequestTooLarge,
+					Detail:  fmt.Sprintf("Upload exceeds the %s request limit; %d photo(s) before it were kept", a.cfg.MaxTotalSize, len(uploadedPhotos)),
+					Errors:  rejectedFiles(results),
+					Results: results,
+				})
+				return
+			}
+			log.Printf("Multipart read error: %v", err)
+			SendError(w, codeInvalidBody, "Failed to parse upload", http.StatusBadRequest)
+			return
 		}
-		defer dst.Close()
 
-		// Copy file content
-		size, err := io.Copy(dst, file)
-		if err != nil {
-			log.Printf("Error saving file %s: %v", filePath, err)
-			os.Remove(filePath)
+		if part.FormName() != "photos" || part.FileName() == "" {
+			part.Close()
 			continue
 		}
 
-		// Generate thumbnail for faster loading
-		thumbFilename := photoID + "_thumb.jpg"
-		thumbPath := filepath.Join(uploadDir, thumbFilename)
-		if err := generateThumbnail(filePath, thumbPath); err != nil {
-			log.Printf("Warning: failed to generate thumbnail for %s: %v", photoID, err)
-			// Continue without thumbnail - original will be used
+		var result UploadFileResult
+		if len(results) >= a.cfg.MaxPhotoCount {
+			result = rejectedUpload(part.FileName(), rejectFile(rejectTooManyFiles, "Too many files. Maximum is %d photos per upload", a.cfg.MaxPhotoCount))
 		} else {
-			log.Printf("Generated thumbnail: %s", thumbFilename)
+			result = a.ingestUploadPart(r.Context(), owner, part)
 		}
+		part.Close()
 
-		photo := Photo{
-			ID:         photoID,
-			Filename:   fileHeader.Filename,
-			Path:       "/uploads/" + newFilename,
-			Size:       size,
-			UploadedAt: time.Now(),
+		results = append(results, result)
+		if result.Photo != nil {
+			uploadedPhotos = append(uploadedPhotos, *result.Photo)
+		} else {
+			rejected++
 		}
-		log.Printf("Saving photo %s, %s", photoID, fileHeader.Filename)
+	}
 
-		uploadedPhotos = append(uploadedPhotos, photo)
-		log.Printf("Uploaded: %s -> %s (%d bytes)", fileHeader.Filename, newFilename, size)
+	if len(results) == 0 {
+		SendError(w, codeNoFiles, "No files uploaded", http.StatusBadRequest)
+		return
 	}
 
 	if len(uploadedPhotos) == 0 {
-		SendError(w, "No valid images were uploaded", http.StatusBadRequest)
+		SendProblem(w, ErrorResponse{
+			Status: http.StatusBadRequest,
+			Code:   codeUploadRejected,
+			Detail: "No valid images were uploaded",
+			Errors: rejectedFiles(results),
+		})
 		return
 	}
 
+	message := fmt.Sprintf("Successfully uploaded %d photo(s)", len(uploadedPhotos))
+	if rejected > 0 {
+		message += fmt.Sprintf("; %d file(s) rejected", rejected)
+	}
+
 	response := UploadResponse{
 		Success: true,
-		Message: fmt.Sprintf("Successfully uploaded %d photo(s)", len(uploadedPhotos)),
+		Message: message,
 		Photos:  uploadedPhotos,
+		Results: results,
 	}
 
+	// Some files were accepted and some weren't; the results say which
+	if rejected > 0 {
+		SendJSONStatus(w, response, http.StatusMultiStatus)
+		return
+	}
 	SendJSON(w, response)
 }
 
-// HandleGetPhotos returns all uploaded photos
-func HandleGetPhotos(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		SendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+// HandleGetPhotos returns the photos in the catalog the caller may see
+func (a *App) HandleGetPhotos(w http.ResponseWriter, r *http.Request) {
+	photos := a.catalog.All(a.requestUser(r))
+	SendJSON(w, photos)
+}
+
+// HandleServePhoto serves photo files with caching headers to the photo's owner, or to anyone
+// with a signed link (see mediaPath). Backgrounds are only served through signed links.
+// Supports ?thumb=1 for the thumbnail, and ?size=tile|page|full|print or ?w=<pixels>
+// for a resized rendition in the best format the client accepts.
+func (a *App) HandleServePhoto(w http.ResponseWriter, r *http.Request) {
+	photo, key, found := a.resolveServedFile(r.PathValue("path"))
+
+	// Responses vary by user, so they may only be cached by the browser, and only as long as the link is valid.
+	// Access is checked before existence so unsigned requests can't probe for photos.
+	if expires, ok := a.signer.verify(r); ok {
+		maxAge := int(time.Until(expires).Seconds())
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge)+", immutable")
+	} else if user := a.requestUser(r); found && user != "" && user == photo.Owner {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		SendError(w, codeForbidden, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !found {
+		SendError(w, codeFileNotFound, "Not found", http.StatusNotFound)
 		return
 	}
 
-	files, err := os.ReadDir(uploadDir)
+	size, useRendition, err := a.parseRenditionRequest(r)
 	if err != nil {
-		SendError(w, "Failed to read photos directory", http.StatusInternalServerError)
+		sendQueryError(w, err)
 		return
 	}
 
-	var photos []Photo
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+	// Check if thumbnail is requested
+	useThumb := r.URL.Query().Get("thumb") == "1" && !useRendition
+
+	isOriginal := photo.ID != "" && key == photo.Key
+	// Accept only picks the format of renditions when the build has more than one, and whether
+	// HEIC originals are served as they are
+	isHEIC := indexOf(formatHEIC.Extensions, strings.ToLower(filepath.Ext(photo.Key))) != -1
+	if isOriginal && (useRendition && len(renditionEncoders) > 1 || isHEIC) {
+		w.Header().Add("Vary", "Accept")
+	}
 
-		if !isValidImageType(file.Name()) {
-			continue
+	if useRendition && isOriginal {
+		renditionKey, err := a.photoRendition(r.Context(), photo, size, negotiateEncoder(r))
+		if err != nil {
+			// Fall back to the original rather than failing the image
+			log.Printf("Warning: failed to create %s rendition of %s: %v", size.Name, photo.ID, err)
+		} else {
+			key = renditionKey
 		}
+	}
 
-		info, err := file.Info()
-		if err != nil {
-			continue
+	if useThumb && isOriginal {
+		// Try to serve thumbnail version
+		thumbKey := photo.ID + "_thumb.jpg"
+		if _, err := a.store.Stat(r.Context(), thumbKey); err == nil {
+			key = thumbKey
 		}
+	}
 
-		// Extract ID from filename (remove extension)
-		id := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+	// Originals carry EXIF data such as where the photo was taken; unless the owner opted out,
+	// serve a copy without it. Renditions are re-encoded from the pixels and never have any.
+	stripMetadata := isOriginal && key == photo.Key && !a.servesMetadata(r.Context(), photo.Owner)
 
-		photo := Photo{
-			ID:         id,
-			Filename:   file.Name(),
-			Path:       "/uploads/" + file.Name(),
-			Size:       info.Size(),
-			UploadedAt: info.ModTime(),
+	// Serve the JPEG rendition of HEIC originals to browsers that don't accept HEIC
+	if ext := strings.ToLower(filepath.Ext(key)); key == photo.Key && indexOf(formatHEIC.Extensions, ext) != -1 && (!acceptsHEIC(r) || stripMetadata) {
+		displayKey := displayRenditionKey(photo.ID)
+		if _, err := a.store.Stat(r.Context(), displayKey); err == nil {
+			key = displayKey
 		}
-		photos = append(photos, photo)
 	}
 
-	SendJSON(w, photos)
-}
-
-// HandleServePhoto serves photo files with caching headers
-// Supports ?thumb=1 query param to serve thumbnail version
-func HandleServePhoto(w http.ResponseWriter, r *http.Request) {
-	filename := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if stripMetadata && key == photo.Key {
+		publicKey, err := a.publicOriginal(r.Context(), photo)
+		if err != nil {
+			// Never fall back to the original, which would leak what we were asked to hide
+			log.Printf("Error removing metadata from %s: %v", photo.Key, err)
+			SendError(w, codeInternal, "Failed to prepare photo", http.StatusInternalServerError)
+			return
+		}
+		key = publicKey
+	}
 
-	// Security: prevent directory traversal
-	if strings.Contains(filename, "..") {
-		SendError(w, "Invalid path", http.StatusBadRequest)
+	rc, info, err := a.store.Get(r.Context(), key)
+	if err != nil {
+		if !errors.Is(err, ErrBlobNotFound) {
+			log.Printf("Error reading %s: %v", key, err)
+		}
+		SendError(w, codeFileNotFound, "Not found", http.StatusNotFound)
 		return
 	}
+	defer rc.Close()
 
-	// Check if thumbnail is requested
-	useThumb := r.URL.Query().Get("thumb") == "1"
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	filePath := filepath.Join(uploadDir, filename)
+	serveBlob(w, r, rc, info)
+}
 
-	if useThumb {
-		// Try to serve thumbnail version
-		ext := filepath.Ext(filename)
-		baseName := strings.TrimSuffix(filename, ext)
-		// Skip if already a thumbnail
-		if !strings.HasSuffix(baseName, "_thumb") {
-			thumbPath := filepath.Join(uploadDir, baseName+"_thumb.jpg")
-			if _, err := os.Stat(thumbPath); err == nil {
-				filePath = thumbPath
-			}
-		}
+// resolveServedFile looks up the file a path under /uploads/ names: a photo's original or one
+// of its registered renditions, found through the photo ID, or a generated background. The path
+// is only ever compared against known keys, never turned into a file name, so encoded
+// separators, traversal and unregistered files such as the trash and user settings can't be
+// reached. photo is empty for backgrounds.
+func (a *App) resolveServedFile(name string) (photo catalogEntry, key string, ok bool) {
+	if a.backgrounds.Has(name) {
+		return catalogEntry{}, name, true
 	}
 
-	// Set caching headers - photos are immutable (UUID-based names)
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	photoID, _, _ := strings.Cut(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+	photo, ok = a.catalog.Get(photoID)
+	if !ok {
+		return catalogEntry{}, "", false
+	}
+	if name != photo.Key && indexOf(a.photoRenditionKeys(photo.ID), name) == -1 {
+		return catalogEntry{}, "", false
+	}
+	return photo, name, true
+}
 
-	http.ServeFile(w, r, filePath)
+// acceptsHEIC reports whether the client says it can display HEIC images
+func acceptsHEIC(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "image/heic") || strings.Contains(accept, "image/heif")
 }
 
-// HandleClusterPhotos analyzes photos using Gemini AI and groups them into clusters
-func HandleClusterPhotos(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		SendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+// serveBlob writes an object to the response, supporting range requests when the reader can seek
+func serveBlob(w http.ResponseWriter, r *http.Request, rc io.ReadCloser, info BlobInfo) {
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.Key, info.ModTime, rs)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
 		return
 	}
+	io.Copy(w, rc)
+}
 
+// HandleClusterPhotos analyzes photos using Gemini AI and groups them into clusters
+func (a *App) HandleClusterPhotos(w http.ResponseWriter, r *http.Request) {
 	var req ClusterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		SendError(w, "Invalid request body", http.StatusBadRequest)
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	if len(req.PhotoIds) == 0 {
-		SendError(w, "No photo IDs provided", http.StatusBadRequest)
+		sendValidationError(w, invalidField("photoIds", "No photo IDs provided"))
 		return
 	}
 
-	// Get photo file paths
-	var photoPaths []string
+	if req.Bursts != "" && req.Bursts != "collapse" && req.Bursts != "best" {
+		sendValidationError(w, invalidField("bursts", "Invalid bursts mode: use collapse or best"))
+		return
+	}
+
+	// Keep only photos that exist; the caller may only cluster their own
+	user := a.requestUser(r)
+	var photoIDs []string
 	for _, photoID := range req.PhotoIds {
-		files, err := os.ReadDir(uploadDir)
-		if err != nil {
+		photo, ok := a.catalog.Get(photoID)
+		if !ok || indexOf(photoIDs, photoID) != -1 {
 			continue
 		}
-		for _, file := range files {
-			if strings.HasPrefix(file.Name(), photoID) {
-				photoPaths = append(photoPaths, filepath.Join(uploadDir, file.Name()))
-				break
-			}
+		if !photo.visibleTo(user) {
+			SendError(w, codeForbidden, "Photo belongs to another user: "+photoID, http.StatusForbidden)
+			return
 		}
+		photoIDs = append(photoIDs, photoID)
 	}
 
-	if len(photoPaths) == 0 {
-		SendError(w, "No valid photos found", http.StatusBadRequest)
+	if len(photoIDs) == 0 {
+		SendError(w, codeNoValidPhotos, "No valid photos found", http.StatusBadRequest)
 		return
 	}
 
+	// Send one photo per burst for analysis; the others follow it onto its page or are skipped
+	var skipped []string
+	burstOf := make(map[string][]string)
+	if req.Bursts != "" {
+		var representatives []string
+		for _, group := range a.groupBursts(photoIDs) {
+			best := a.bestShot(group)
+			representatives = append(representatives, best)
+			for _, id := range group {
+				if id == best {
+					continue
+				}
+				if req.Bursts == "best" {
+					skipped = append(skipped, id)
+				} else {
+					burstOf[best] = append(burstOf[best], id)
+				}
+			}
+		}
+		photoIDs = representatives
+	}
+
+	// Get photo storage keys
+	photoKeys := make([]string, len(photoIDs))
+	for i, photoID := range photoIDs {
+		photoKeys[i], _ = a.findPhotoKey(photoID)
+	}
+
 	// Use Gemini AI to analyze and cluster photos
-	clusters, err := AnalyzeAndClusterPhotos(req.PhotoIds, photoPaths)
+	clusters, err := a.AnalyzeAndClusterPhotos(r.Context(), photoIDs, photoKeys)
 	if err != nil {
 		log.Printf("Error clustering photos: %v", err)
-		SendError(w, "Failed to analyze photos", http.StatusInternalServerError)
+		SendError(w, codeAnalysisFailed, "Failed to analyze photos", http.StatusInternalServerError)
 		return
 	}
 
+	for i, cluster := range clusters {
+		var expanded []string
+		for _, id := range cluster.PhotoIds {
+			expanded = append(expanded, id)
+			expanded = append(expanded, burstOf[id]...)
+		}
+		clusters[i].PhotoIds = expanded
+	}
+
 	// Generate background images for each cluster and create drafts
 	var pageDrafts []PageDraft
 	for i, cluster := range clusters {
 		// Generate themed background image
-		backgroundPath, err := GenerateBackgroundImage(cluster.Theme, cluster.Title, cluster.Description)
+		backgroundPath, err := a.GenerateBackgroundImage(r.Context(), cluster.Theme, cluster.Title, cluster.Description)
 		if err != nil {
 			log.Printf("Failed to generate background for cluster %s: %v", cluster.ID, err)
 			// Continue without background - it's optional
@@ -300,20 +569,47 @@ func HandleClusterPhotos(w http.ResponseWriter, r *http.Request) {
 			Theme:          cluster.Theme,
 			BackgroundPath: backgroundPath,
 			Status:         "draft",
-			CreatedAt:      time.Now().Format(time.RFC3339),
+			CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+			Owner:          user,
 		}
-		drafts[draft.ID] = draft
+		a.refreshDraft(&draft)
+		a.draftsMu.Lock()
+		a.drafts[draft.ID] = draft
+		a.draftsMu.Unlock()
 		pageDrafts = append(pageDrafts, draft)
 	}
 
 	response := ClusterResponse{
 		Clusters: clusters,
 		Drafts:   pageDrafts,
+		Skipped:  skipped,
 	}
 
 	SendJSON(w, response)
 }
 
+// findPhotoKey returns the storage key of the original file for a photo ID
+func (a *App) findPhotoKey(photoID string) (string, bool) {
+	e, ok := a.catalog.Get(photoID)
+	if !ok {
+		return "", false
+	}
+	return e.Key, true
+}
+
+// photoCaptureTime returns when a photo was taken, from its EXIF data or, for photos without
+// any, when it was uploaded. It only reads the catalog, since callers hold draftsMu.
+func (a *App) photoCaptureTime(photoID string) (time.Time, bool) {
+	photo, ok := a.catalog.Get(photoID)
+	if !ok {
+		return time.Time{}, false
+	}
+	if photo.TakenAt != nil {
+		return *photo.TakenAt, true
+	}
+	return photo.UploadedAt, !photo.UploadedAt.IsZero()
+}
+
 // isValidImageType checks if the file has a valid image extension
 func isValidImageType(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestApp returns an app for cfg whose files are kept in an empty local store in a temp
+// directory, which is a.cfg.UploadDir
+func newTestApp(t testing.TB, cfg Config) *App {
+	t.Helper()
+	cfg.StorageBackend = "local"
+	cfg.UploadDir = t.TempDir()
+	cfg.UploadSessionDir = t.TempDir()
+	cfg.PhotoURLSecret = "test-secret"
+	store, err := newBlobStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newApp(cfg, store)
+}
+
+// putTestBlob stores a small object, failing the test on error
+func putTestBlob(t testing.TB, a *App, key, content string) {
+	t.Helper()
+	if err := putBlob(context.Background(), a.store, key, []byte(content), ""); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+func FuzzResolveServedFile(f *testing.F) {
+	a := newTestApp(f, defaultConfig())
+	dir := a.cfg.UploadDir
+	ctx := context.Background()
+
+	const secret = "not for serving"
+	outside := filepath.Join(f.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte(secret), 0o644); err != nil {
+		f.Fatal(err)
+	}
+
+	photoID := ownedPhotoID("user_alice", strings.Repeat("ab", 32))
+	putTestBlob(f, a, photoID+".jpg", "original")
+	putTestBlob(f, a, photoID+"_thumb.jpg", "thumbnail")
+	putTestBlob(f, a, backgroundPrefix+"bg.png", "background")
+	putTestBlob(f, a, trashPrefix("trashed")+trashEntryFile, secret)
+	putTestBlob(f, a, settingsPrefix+"user_alice.json", secret)
+	a.backgrounds.Add(backgroundPrefix + "bg.png")
+	if err := a.catalog.Add(ctx, catalogEntry{Photo: Photo{ID: photoID}, Key: photoID + ".jpg", Owner: "user_alice"}); err != nil {
+		f.Fatal(err)
+	}
+
+	// Symlinks out of the store, one unregistered and one under a name the photo's renditions use
+	for _, name := range []string{"link.jpg", photoID + "_tile.jpg"} {
+		if err := os.Symlink(outside, filepath.Join(dir, name)); err != nil {
+			f.Skip("symlinks not supported:", err)
+		}
+	}
+
+	for _, seed := range []string{
+		photoID + ".jpg",
+		photoID + "_thumb.jpg",
+		photoID + "_tile.jpg",
+		photoID + "_tile.webp",
+		backgroundPrefix + "bg.png",
+		"link.jpg",
+		catalogKey,
+		trashPrefix("trashed") + trashEntryFile,
+		settingsPrefix + "user_alice.json",
+		"../" + filepath.Base(outside),
+		photoID + ".jpg/../" + catalogKey,
+		photoID + "_thumb.jpg/../../secret.txt",
+		backgroundPrefix + "../" + catalogKey,
+		url.PathEscape("../" + catalogKey),
+		"%2e%2e%2f" + catalogKey,
+		photoID + "%2ejpg",
+		photoID + `_thumb.jpg\..\` + catalogKey,
+		outside,
+		"/" + photoID + ".jpg",
+		photoID + ".jpg\x00",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		names := []string{name}
+		if unescaped, err := url.PathUnescape(name); err == nil && unescaped != name {
+			names = append(names, unescaped)
+		}
+
+		for _, name := range names {
+			photo, key, ok := a.resolveServedFile(name)
+			if !ok {
+				continue
+			}
+			if key != name {
+				t.Fatalf("resolveServedFile(%q) = key %q; want the name itself", name, key)
+			}
+
+			switch {
+			case a.backgrounds.Has(key):
+			case photo.ID != "" && (key == photo.Key || indexOf(a.photoRenditionKeys(photo.ID), key) != -1):
+				if _, registered := a.catalog.Get(photo.ID); !registered {
+					t.Fatalf("resolveServedFile(%q) returned unregistered photo %q", name, photo.ID)
+				}
+			default:
+				t.Fatalf("resolveServedFile(%q) = %q, which is neither a background nor a file of photo %q", name, key, photo.ID)
+			}
+
+			rc, _, err := a.store.Get(ctx, key)
+			if err != nil {
+				continue // Registered but missing, or a symlink the store refused to follow
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err == nil && bytes.Equal(data, []byte(secret)) {
+				t.Fatalf("resolveServedFile(%q) led to a file outside the photos", name)
+			}
+		}
+	})
+}
+
+func TestUploadOverLimitReportsKeptFiles(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxTotalSize = 1024
+	a := newTestApp(t, cfg)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("photos", "kept.png")
+	part.Write(testPNG(t, 1))
+	part, _ = mw.CreateFormFile("photos", "cut.png")
+	part.Write(bytes.Repeat([]byte{0}, 4096))
+	mw.Close()
+
+	req := httptest.NewRequest("POST", apiPrefix+"/photos/upload", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	a.newRouter().ServeHTTP(rec, req)
+
+	var problem ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil || rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload = %d %s; want 413", rec.Code, rec.Body)
+	}
+	if len(problem.Results) == 0 || problem.Results[0].Status != "accepted" || problem.Results[0].Photo == nil {
+		t.Fatalf("results = %+v; want the kept file first", problem.Results)
+	}
+	if _, ok := a.catalog.Get(problem.Results[0].Photo.ID); !ok {
+		t.Errorf("reported photo %s isn't in the catalog", problem.Results[0].Photo.ID)
+	}
+}
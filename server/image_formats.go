@@ -0,0 +1,29 @@
+package main
+
+import (
+	"image"
+
+	"github.com/gen2brain/heic"
+	_ "golang.org/x/image/webp"
+)
+
+func init() {
+	// The heic package only registers the "heic" brand; iPhones and other cameras also
+	// write HEIF stills under these brands
+	for _, brand := range heifBrands {
+		if brand != "heic" {
+			image.RegisterFormat("heif", "????ftyp"+brand, heic.Decode, heic.DecodeConfig)
+		}
+	}
+}
+
+// browserSafe reports whether every major browser can display an image format.
+// Anything else gets a full-size JPEG rendition that is served in its place.
+func browserSafe(format imageFormat) bool {
+	return format.Ext != formatHEIC.Ext
+}
+
+// displayRenditionKey is the storage key of the full-size JPEG served in place of an original browsers can't display
+func displayRenditionKey(photoID string) string {
+	return photoID + "_display.jpg"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Fixtures: testdata/photo.webp is a lossy WebP from golang.org/x/image and testdata/photo.heic
+// a grayscale HEIC from github.com/gen2brain/heic, both from their test data
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeHEICAndWebP(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		want     imageFormat
+	}{
+		{"photo.webp", formatWebP},
+		{"photo.heic", formatHEIC},
+		{"photo.heif", formatHEIC},
+	} {
+		data := readFixture(t, "photo"+tc.want.Ext)
+		format, img, rejection := validateUpload(tc.filename, bytes.NewReader(data))
+		if rejection != nil {
+			t.Errorf("%s: rejected: %v", tc.filename, rejection)
+			continue
+		}
+		if format.Ext != tc.want.Ext || img.Bounds().Empty() {
+			t.Errorf("%s: format %s, bounds %v; want a decoded %s", tc.filename, format.Ext, img.Bounds(), tc.want.Ext)
+		}
+		if browserSafe(format) != (format.Ext == formatWebP.Ext) {
+			t.Errorf("%s: browserSafe = %v; want only WebP served as is", tc.filename, browserSafe(format))
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// pageAspect is the width/height ratio of a book page (landscape, matching the generated backgrounds)
+const pageAspect = 4.0 / 3.0
+
+// defaultPhotoAspect is used when a photo's dimensions can't be read
+const defaultPhotoAspect = 4.0 / 3.0
+
+// LayoutTemplate is a named page arrangement
+type LayoutTemplate struct {
+	Name      string          `json:"name"`
+	Label     string          `json:"label"`
+	MinPhotos int             `json:"minPhotos"`
+	MaxPhotos int             `json:"maxPhotos"` // 0 means no upper limit
+	Variants  []LayoutVariant `json:"variants,omitempty"`
+
+	slots func(n int) []LayoutSlot
+}
+
+// pageMargin is the inset kept free around the edge of every page
+const pageMargin = 0.05
+
+// photoGap is the spacing between neighbouring photos
+const photoGap = 0.02
+
+// layoutTemplates lists the available templates in order of preference for ties
+var layoutTemplates = []LayoutTemplate{
+	{
+		Name:      "single-hero",
+		Label:     "Single hero",
+		MinPhotos: 1,
+		MaxPhotos: 1,
+		slots: func(n int) []LayoutSlot {
+			return []LayoutSlot{{ID: "hero", Frame: insetRect(LayoutRect{0, 0, 1, 1})}}
+		},
+	},
+	{
+		Name:      "two-up",
+		Label:     "Two up",
+		MinPhotos: 2,
+		MaxPhotos: 2,
+		slots: func(n int) []LayoutSlot {
+			return gridSlots(insetRect(LayoutRect{0, 0, 1, 1}), 2, 1, "photo")
+		},
+	},
+	{
+		Name:      "three-grid",
+		Label:     "Three grid",
+		MinPhotos: 3,
+		MaxPhotos: 3,
+		slots: func(n int) []LayoutSlot {
+			area := insetRect(LayoutRect{0, 0, 1, 1})
+			left, right := splitColumns(area, 0.5)
+			slots := []LayoutSlot{{ID: "hero", Frame: left}}
+			return append(slots, gridSlots(right, 1, 2, "photo")...)
+		},
+	},
+	{
+		Name:      "collage",
+		Label:     "Collage",
+		MinPhotos: 4,
+		slots: func(n int) []LayoutSlot {
+			area := insetRect(LayoutRect{0, 0, 1, 1})
+			left, right := splitColumns(area, 0.5)
+			cols := int(math.Ceil(math.Sqrt(float64(n - 1))))
+			rows := int(math.Ceil(float64(n-1) / float64(cols)))
+			slots := []LayoutSlot{{ID: "hero", Frame: left}}
+			return append(slots, gridSlots(right, cols, rows, "photo")[:n-1]...)
+		},
+	},
+	{
+		Name:      "polaroid-scatter",
+		Label:     "Polaroid scatter",
+		MinPhotos: 2,
+		MaxPhotos: len(polaroidPositions),
+		slots: func(n int) []LayoutSlot {
+			slots := make([]LayoutSlot, n)
+			for i := 0; i < n; i++ {
+				p := polaroidPositions[i]
+				slots[i] = LayoutSlot{
+					ID:       fmt.Sprintf("polaroid-%d", i+1),
+					Frame:    LayoutRect{X: p[0] - polaroidW/2, Y: p[1] - polaroidH/2, W: polaroidW, H: polaroidH},
+					Rotation: p[2],
+					Z:        i,
+				}
+			}
+			return slots
+		},
+	},
+}
+
+// Polaroid frames are roughly square on the page; positions are center x, center y and rotation
+const (
+	polaroidW = 0.28
+	polaroidH = 0.36
+)
+
+var polaroidPositions = [][3]float64{
+	{0.27, 0.32, -6},
+	{0.70, 0.30, 5},
+	{0.45, 0.66, -3},
+	{0.78, 0.70, 8},
+	{0.20, 0.72, 4},
+	{0.50, 0.28, -2},
+	{0.58, 0.52, 7},
+	{0.33, 0.50, -8},
+}
+
+// insetRect shrinks a rect by the page margin
+func insetRect(r LayoutRect) LayoutRect {
+	return LayoutRect{X: r.X + pageMargin, Y: r.Y + pageMargin, W: r.W - 2*pageMargin, H: r.H - 2*pageMargin}
+}
+
+// splitColumns divides a rect into a left and right part with a gap between them
+func splitColumns(r LayoutRect, leftFraction float64) (LayoutRect, LayoutRect) {
+	leftW := (r.W - photoGap) * leftFraction
+	left := LayoutRect{X: r.X, Y: r.Y, W: leftW, H: r.H}
+	right := LayoutRect{X: r.X + leftW + photoGap, Y: r.Y, W: r.W - leftW - photoGap, H: r.H}
+	return left, right
+}
+
+// gridSlots lays out cols x rows equally sized slots in reading order
+func gridSlots(r LayoutRect, cols, rows int, prefix string) []LayoutSlot {
+	cellW := (r.W - photoGap*float64(cols-1)) / float64(cols)
+	cellH := (r.H - photoGap*float64(rows-1)) / float64(rows)
+
+	var slots []LayoutSlot
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			slots = append(slots, LayoutSlot{
+				ID: fmt.Sprintf("%s-%d", prefix, len(slots)+1),
+				Frame: LayoutRect{
+					X: r.X + float64(col)*(cellW+photoGap),
+					Y: r.Y + float64(row)*(cellH+photoGap),
+					W: cellW,
+					H: cellH,
+				},
+			})
+		}
+	}
+	return slots
+}
+
+// findLayoutTemplate looks up a template by name
+func findLayoutTemplate(name string) (LayoutTemplate, bool) {
+	for _, t := range layoutTemplates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return LayoutTemplate{}, false
+}
+
+// fits reports whether the template can hold n photos
+func (t LayoutTemplate) fits(n int) bool {
+	return n >= t.MinPhotos && (t.MaxPhotos == 0 || n <= t.MaxPhotos)
+}
+
+// slotAspect returns the width/height ratio of a slot as it appears on the page
+func slotAspect(s LayoutSlot) float64 {
+	return (s.Frame.W * pageAspect) / s.Frame.H
+}
+
+// photoAspect returns the width/height ratio of a photo as displayed. It only reads the catalog,
+// which records dimensions at upload, since callers hold draftsMu; photos it couldn't decode get
+// the default.
+func (a *App) photoAspect(photoID string) float64 {
+	if e, ok := a.catalog.Get(photoID); ok && e.Width > 0 && e.Height > 0 {
+		return float64(e.Width) / float64(e.Height)
+	}
+	return defaultPhotoAspect
+}
+
+// centerCrop returns the largest centered region of a photo that matches the slot's aspect ratio
+func centerCrop(photo, slot float64) LayoutRect {
+	if photo > slot {
+		w := slot / photo
+		return LayoutRect{X: (1 - w) / 2, Y: 0, W: w, H: 1}
+	}
+	h := photo / slot
+	return LayoutRect{X: 0, Y: (1 - h) / 2, W: 1, H: h}
+}
+
+// layoutPhotoOrder returns the draft's photos with the cover photo first so it lands in the hero slot
+func layoutPhotoOrder(draft PageDraft) []string {
+	if draft.CoverPhotoID == "" || indexOf(draft.PhotoIds, draft.CoverPhotoID) == -1 {
+		return draft.PhotoIds
+	}
+	ordered := []string{draft.CoverPhotoID}
+	for _, id := range draft.PhotoIds {
+		if id != draft.CoverPhotoID {
+			ordered = append(ordered, id)
+		}
+	}
+	return ordered
+}
+
+// buildLayout places photos into the template's slots in order, cropping each to fill its slot.
+// It returns the placements and how badly the photo shapes match the slot shapes.
+func buildLayout(t LayoutTemplate, photoIds []string, aspects map[string]float64) ([]PhotoPlacement, float64) {
+	slots := t.slots(len(photoIds))
+	placements := make([]PhotoPlacement, len(photoIds))
+	cost := 0.0
+	for i, photoID := range photoIds {
+		slot := slots[i]
+		aspect := aspects[photoID]
+		sa := slotAspect(slot)
+		cost += math.Abs(math.Log(aspect / sa))
+		placements[i] = PhotoPlacement{
+			PhotoID:  photoID,
+			Slot:     slot.ID,
+			Frame:    slot.Frame,
+			Crop:     centerCrop(aspect, sa),
+			Rotation: slot.Rotation,
+			Z:        slot.Z,
+		}
+	}
+	return placements, cost
+}
+
+// autoLayout picks the template whose slots best match the photos' aspect ratios
+func (a *App) autoLayout(draft PageDraft) *PageLayout {
+	photoIds := layoutPhotoOrder(draft)
+	if len(photoIds) == 0 {
+		return nil
+	}
+
+	aspects := make(map[string]float64)
+	for _, id := range photoIds {
+		aspects[id] = a.photoAspect(id)
+	}
+
+	var best *PageLayout
+	bestCost := math.Inf(1)
+	for _, t := range layoutTemplates {
+		if !t.fits(len(photoIds)) {
+			continue
+		}
+		placements, cost := buildLayout(t, photoIds, aspects)
+		// Compare the average mismatch so templates are judged per photo
+		cost /= float64(len(photoIds))
+		if cost < bestCost {
+			bestCost = cost
+			best = &PageLayout{Template: t.Name, Auto: true, Placements: placements}
+		}
+	}
+	return best
+}
+
+// templateLayout lays the draft's photos out with a specific template
+func (a *App) templateLayout(t LayoutTemplate, draft PageDraft) *PageLayout {
+	photoIds := layoutPhotoOrder(draft)
+	aspects := make(map[string]float64)
+	for _, id := range photoIds {
+		aspects[id] = a.photoAspect(id)
+	}
+	placements, _ := buildLayout(t, photoIds, aspects)
+	return &PageLayout{Template: t.Name, Placements: placements}
+}
+
+// refreshLayout recomputes a draft's layout after its photos changed.
+// Manually arranged layouts are kept as long as they still cover exactly the draft's photos;
+// a manually chosen template is kept as long as it still fits the photo count.
+func (a *App) refreshLayout(draft *PageDraft) {
+	layout := draft.Layout
+	if layout != nil && !layout.Auto {
+		placed := make([]string, len(layout.Placements))
+		for i, p := range layout.Placements {
+			placed[i] = p.PhotoID
+		}
+		if samePhotoSet(placed, draft.PhotoIds) {
+			return
+		}
+		if t, ok := findLayoutTemplate(layout.Template); ok && t.fits(len(draft.PhotoIds)) {
+			draft.Layout = a.templateLayout(t, *draft)
+			return
+		}
+	}
+	draft.Layout = a.autoLayout(*draft)
+}
+
+// validatePlacements checks manually supplied placements against a template and the draft's photos
+func validatePlacements(t LayoutTemplate, draft PageDraft, placements []PhotoPlacement) error {
+	placed := make([]string, len(placements))
+	for i, p := range placements {
+		placed[i] = p.PhotoID
+	}
+	if !samePhotoSet(placed, draft.PhotoIds) {
+		return fmt.Errorf("placements must cover exactly the draft's photos")
+	}
+
+	slots := make(map[string]LayoutSlot)
+	for _, s := range t.slots(len(placements)) {
+		slots[s.ID] = s
+	}
+
+	used := make(map[string]bool)
+	for _, p := range placements {
+		if _, ok := slots[p.Slot]; !ok {
+			return fmt.Errorf("unknown slot %q for template %s", p.Slot, t.Name)
+		}
+		if used[p.Slot] {
+			return fmt.Errorf("slot %q is used more than once", p.Slot)
+		}
+		used[p.Slot] = true
+
+		c := p.Crop
+		if c.W <= 0 || c.H <= 0 || c.X < 0 || c.Y < 0 || c.X+c.W > 1 || c.Y+c.H > 1 {
+			return fmt.Errorf("crop for photo %s must lie within the photo", p.PhotoID)
+		}
+		if !(math.Abs(p.Rotation) <= 360) {
+			return fmt.Errorf("rotation for photo %s must be between -360 and 360 degrees", p.PhotoID)
+		}
+	}
+	return nil
+}
+
+// manualLayout returns a layout of validated placements. Frames always come from the template so
+// every renderer agrees on slot positions.
+func manualLayout(t LayoutTemplate, placements []PhotoPlacement) *PageLayout {
+	slots := make(map[string]LayoutSlot)
+	for _, s := range t.slots(len(placements)) {
+		slots[s.ID] = s
+	}
+	placed := make([]PhotoPlacement, len(placements))
+	for i, p := range placements {
+		p.Frame = slots[p.Slot].Frame
+		p.Z = slots[p.Slot].Z
+		placed[i] = p
+	}
+	return &PageLayout{Template: t.Name, Placements: placed}
+}
+
+// checkClientLayout validates a manual layout sent with a whole draft, which refreshLayout would
+// otherwise keep as is, and returns it with frames from its template. Layouts that no longer cover
+// the draft's photos are left for refreshLayout to redo.
+func checkClientLayout(draft PageDraft) (*PageLayout, error) {
+	layout := draft.Layout
+	if layout == nil || layout.Auto {
+		return layout, nil
+	}
+	placed := make([]string, len(layout.Placements))
+	for i, p := range layout.Placements {
+		placed[i] = p.PhotoID
+	}
+	if !samePhotoSet(placed, draft.PhotoIds) {
+		return layout, nil
+	}
+
+	t, ok := findLayoutTemplate(layout.Template)
+	if !ok {
+		return nil, fmt.Errorf("unknown layout template %q", layout.Template)
+	}
+	if !t.fits(len(draft.PhotoIds)) {
+		return nil, fmt.Errorf("template %s does not fit %d photos", t.Name, len(draft.PhotoIds))
+	}
+	if err := validatePlacements(t, draft, layout.Placements); err != nil {
+		return nil, err
+	}
+	return manualLayout(t, layout.Placements), nil
+}
+
+// HandleGetLayouts lists the layout templates with their slot arrangements
+func HandleGetLayouts(w http.ResponseWriter, r *http.Request) {
+	// Show variants up to a reasonable count for open-ended templates
+	const maxListedPhotos = 9
+
+	templates := make([]LayoutTemplate, len(layoutTemplates))
+	for i, t := range layoutTemplates {
+		maxPhotos := t.MaxPhotos
+		if maxPhotos == 0 {
+			maxPhotos = maxListedPhotos
+		}
+		for n := t.MinPhotos; n <= maxPhotos; n++ {
+			t.Variants = append(t.Variants, LayoutVariant{Photos: n, Slots: t.slots(n)})
+		}
+		templates[i] = t
+	}
+
+	SendJSON(w, templates)
+}
+
+// handleSetLayout changes a draft's template or stores manual placements
+func (a *App) handleSetLayout(w http.ResponseWriter, r *http.Request) {
+	draftID := r.PathValue("id")
+
+	var req SetLayoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	draft, ok := a.ownDraft(w, a.requestUser(r), draftID)
+	if !ok {
+		return
+	}
+
+	if req.Template == "" || req.Template == "auto" {
+		draft.Layout = a.autoLayout(draft)
+		a.drafts[draftID] = draft
+		SendJSON(w, draft)
+		return
+	}
+
+	t, ok := findLayoutTemplate(req.Template)
+	if !ok {
+		sendValidationError(w, invalidField("template", "Unknown layout template"))
+		return
+	}
+	if !t.fits(len(draft.PhotoIds)) {
+		SendError(w, codeTemplateMismatch, fmt.Sprintf("Template %s does not fit %d photos", t.Name, len(draft.PhotoIds)), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Placements) == 0 {
+		draft.Layout = a.templateLayout(t, draft)
+		a.drafts[draftID] = draft
+		SendJSON(w, draft)
+		return
+	}
+
+	if err := validatePlacements(t, draft, req.Placements); err != nil {
+		sendValidationError(w, invalidField("placements", err.Error()))
+		return
+	}
+
+	draft.Layout = manualLayout(t, req.Placements)
+	a.drafts[draftID] = draft
+	SendJSON(w, draft)
+}
@@ -1,89 +1,189 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-
-	"github.com/joho/godotenv"
+	"sync"
+	"syscall"
 )
 
-const (
-	uploadDir     = "./uploads"
-	maxFileSize   = 5 << 20  // 5 MB per file
-	maxTotalSize  = 50 << 20 // 50 MB total (10 files * 5 MB)
-	maxPhotoCount = 10
-	serverPort    = ":8080"
-)
+const backgroundPrefix = "backgrounds/" // Storage key prefix for generated backgrounds
+
+// App holds the configuration and state the handlers share. Handlers are methods on it, so
+// every setting comes from the loaded Config and every file from its store.
+type App struct {
+	cfg           Config
+	renditions    []renditionSize
+	renditionWork *renditionWork
+	cors          *corsPolicy
+	store         BlobStore
+	catalog       *photoCatalog
+	backgrounds   *backgroundCatalog
+	signer        *urlSigner // Signs the photo paths in responses
+	sessionKeys   *jwksCache
+	geminiBaseURL string      // Overrides the Gemini API endpoint; empty uses Google's
+	sessionAzp    *corsPolicy // Origins session tokens may be issued to
+	settings      *settingsCache
+
+	// In-memory storage for drafts (in production, use a database)
+	draftsMu sync.Mutex
+	drafts   map[string]PageDraft
+
+	trashing    sync.Map // IDs of photos being moved to or from the trash
+	uploadLocks *uploadLocks
+
+	jobs sync.WaitGroup // Background jobs started with goJob
+}
+
+// newApp returns the application for a validated configuration, keeping its files in store.
+// The catalogs start empty; loadCatalog fills them from the store.
+func newApp(cfg Config, store BlobStore) *App {
+	// Validate has already checked the origins
+	cors, _ := newCORSPolicy(cfg.CORSOrigins, cfg.CORSCredentials)
+	parties := cors
+	if len(cfg.ClerkAuthorizedParties) > 0 {
+		parties, _ = newCORSPolicy(cfg.ClerkAuthorizedParties, false)
+	}
+	return &App{
+		cfg:           cfg,
+		renditions:    renditionSizes(cfg.Renditions),
+		renditionWork: newRenditionWork(),
+		cors:          cors,
+		store:         store,
+		catalog:       newPhotoCatalog(store),
+		backgrounds:   newBackgroundCatalog(),
+		signer:        newURLSigner(cfg.PhotoURLSecret),
+		sessionKeys:   &jwksCache{},
+		sessionAzp:    parties,
+		settings:      newSettingsCache(),
+		drafts:        make(map[string]PageDraft),
+		uploadLocks:   newUploadLocks(),
+	}
+}
 
-// generateMissingThumbnails creates thumbnails for any existing photos that don't have them
-func generateMissingThumbnails() {
-	files, err := os.ReadDir(uploadDir)
+// generateMissingThumbnails creates thumbnails for any existing photos that don't have them,
+// plus the JPEG renditions HEIC photos are served as, and fills in missing catalog details.
+// When ctx is canceled it stops between photos; the rest are done on the next start.
+func (a *App) generateMissingThumbnails(ctx context.Context) {
+	blobs, err := a.store.List(ctx, "")
 	if err != nil {
-		log.Printf("Warning: could not read upload directory for thumbnail generation: %v", err)
+		log.Printf("Warning: could not list photos for thumbnail generation: %v", err)
 		return
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
+	existing := make(map[string]bool)
+	for _, blob := range blobs {
+		existing[blob.Key] = true
+	}
 
-		name := file.Name()
+	for _, blob := range blobs {
+		if ctx.Err() != nil {
+			return
+		}
+		name := blob.Key
 		ext := strings.ToLower(filepath.Ext(name))
 
-		// Skip non-image files and existing thumbnails
-		if !isValidImageType(name) || strings.Contains(name, "_thumb") {
+		// Skip non-image files, subdirectories and existing renditions
+		if !isOriginalKey(name) {
 			continue
 		}
 
-		// Check if thumbnail already exists
+		// Check if renditions already exist
 		baseName := strings.TrimSuffix(name, ext)
-		thumbName := baseName + "_thumb.jpg"
-		thumbPath := filepath.Join(uploadDir, thumbName)
-
-		if _, err := os.Stat(thumbPath); err == nil {
-			continue // Thumbnail already exists
+		needThumb := !existing[baseName+"_thumb.jpg"]
+		needDisplay := indexOf(formatHEIC.Extensions, ext) != -1 && !existing[displayRenditionKey(baseName)]
+		if !needThumb && !needDisplay {
+			continue
 		}
 
-		// Generate thumbnail
-		srcPath := filepath.Join(uploadDir, name)
-		log.Printf("Generating missing thumbnail for: %s", name)
-		if err := generateThumbnail(srcPath, thumbPath); err != nil {
-			log.Printf("Warning: failed to generate thumbnail for %s: %v", name, err)
+		// Generate renditions
+		log.Printf("Generating missing renditions for: %s", name)
+		if err := a.generateRenditions(ctx, name, baseName, needThumb, needDisplay); err != nil {
+			log.Printf("Warning: failed to generate renditions for %s: %v", name, err)
 		}
 	}
+
+	a.backfillPhotoDetails(ctx)
 }
 
 func main() {
-	// Load environment variables from .env file
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using system environment variables")
+	runGC := flag.Bool("gc", false, "Remove orphaned files except backgrounds and exit")
+	gcDryRun := flag.Bool("gc-dry-run", false, "With -gc or -gc-on-start, only report what would be removed")
+	claimOwnerless := flag.String("claim-ownerless", "", "Give photos uploaded without signing in to this user ID and exit")
+
+	// Settings come from defaults, the config file, the environment (including .env) and flags
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	cfg.Print()
+
+	// SIGINT or SIGTERM starts a graceful shutdown; a second one exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// Set up blob storage (creates the uploads directory for the local backend)
+	store, err := newBlobStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	app := newApp(cfg, store)
+
+	if *runGC {
+		logGCReport(app.collectGarbage(ctx, *gcDryRun, false))
+		return
 	}
 
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Fatalf("Failed to create upload directory: %v", err)
+	// Load the photo catalog, hashing any photos stored before it existed. This isn't
+	// interrupted, since photos skipped here would be missing from the catalog.
+	if err := app.loadCatalog(context.Background()); err != nil {
+		log.Fatalf("Failed to load photo catalog: %v", err)
+	}
+
+	if *claimOwnerless != "" {
+		claimed, err := app.claimOwnerless(context.Background(), *claimOwnerless)
+		if err != nil {
+			log.Fatalf("Failed to claim photos: %v", err)
+		}
+		log.Printf("Gave %d photo(s) without an owner to %s", claimed, *claimOwnerless)
+		return
 	}
 
 	// Generate thumbnails for any existing photos that don't have them
 	log.Println("Checking for missing thumbnails...")
-	generateMissingThumbnails()
+	app.generateMissingThumbnails(ctx)
 	log.Println("Thumbnail check complete")
 
-	// Set up routes
-	http.HandleFunc("/api/photos/upload", CorsMiddleware(HandleUpload))
-	http.HandleFunc("/api/photos/cluster", CorsMiddleware(HandleClusterPhotos))
-	http.HandleFunc("/api/photos", CorsMiddleware(HandleGetPhotos))
-	http.HandleFunc("/api/drafts/", CorsMiddleware(HandleDrafts))
-	http.HandleFunc("/uploads/", CorsMiddleware(HandleServePhoto))
+	// Permanently remove photos that have been in the trash past the retention window
+	if purged, err := app.purgeExpiredTrash(ctx); err != nil {
+		log.Printf("Warning: failed to purge trash: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d expired photo(s) from trash", purged)
+	}
 
-	log.Printf("Server starting on port %s", serverPort)
-	log.Printf("Upload directory: %s", uploadDir)
+	if cfg.GCOnStart {
+		logGCReport(app.collectGarbage(ctx, *gcDryRun, false))
+	}
+	if ctx.Err() != nil {
+		log.Println("Interrupted during startup")
+		return
+	}
+	if cfg.GCInterval > 0 {
+		app.startGCSchedule(ctx)
+	}
 
-	if err := http.ListenAndServe(serverPort, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	log.Printf("Storage backend: %T", store)
+	log.Printf("Rendition formats: %s", strings.Join(renditionFormats(), ", "))
+	if err := app.serve(ctx); err != nil {
+		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -3,37 +3,44 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
 )
 
-// CorsMiddleware adds CORS headers to responses
-func CorsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept, Authorization")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// requestIDHeader carries the ID that ties a response, and any error it reports, to the server logs
+const requestIDHeader = "X-Request-ID"
 
-		next(w, r)
-	}
-}
+// validRequestID matches request IDs accepted from clients or proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
 
-// SendError sends a JSON error response
-func SendError(w http.ResponseWriter, message string, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Success: false,
-		Error:   message,
+// RequestIDMiddleware gives every response an X-Request-ID, keeping the one the client or a
+// proxy sent when it looks valid
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
 	})
 }
 
+// SendError sends an error response with a machine-readable code (see errors.go)
+func SendError(w http.ResponseWriter, code, message string, statusCode int) {
+	SendProblem(w, ErrorResponse{Status: statusCode, Code: code, Detail: message})
+}
+
 // SendJSON sends a JSON response
 func SendJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
+
+// SendJSONStatus sends a JSON response with a non-200 status code
+func SendJSONStatus(w http.ResponseWriter, data interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
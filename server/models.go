@@ -4,57 +4,321 @@ import "time"
 
 // Photo represents an uploaded photo
 type Photo struct {
-	ID         string    `json:"id"`
-	Filename   string    `json:"filename"`
-	Path       string    `json:"path"`
-	Size       int64     `json:"size"`
-	UploadedAt time.Time `json:"uploadedAt"`
+	ID            string         `json:"id"`
+	Filename      string         `json:"filename"`
+	Path          mediaPath      `json:"path"` // Signed URL path; see mediaPath
+	Size          int64          `json:"size"`
+	UploadedAt    time.Time      `json:"uploadedAt"`
+	TakenAt       *time.Time     `json:"takenAt,omitempty"`  // From EXIF; unknown for photos without it
+	Metadata      *PhotoMetadata `json:"metadata,omitempty"` // Extracted on upload; served files don't carry it
+	SHA256        string         `json:"sha256,omitempty"`   // Content hash of the original
+	PHash         string         `json:"phash,omitempty"`    // Perceptual hash used to spot near-duplicates
+	Width         int            `json:"width,omitempty"`
+	Height        int            `json:"height,omitempty"`
+	BlurHash      string         `json:"blurHash,omitempty"`      // Compact blurred preview to show while loading
+	DominantColor string         `json:"dominantColor,omitempty"` // Most common color as #rrggbb
+	SimilarTo     []string       `json:"similarTo,omitempty"`     // Near-duplicates such as other shots from the same burst
+	Duplicate     bool           `json:"duplicate,omitempty"`     // Set on upload when an identical photo already existed
+}
+
+// PhotoMetadata is what was read from a photo's EXIF block
+type PhotoMetadata struct {
+	DateTaken string `json:"dateTaken,omitempty"`
+	Location  string `json:"location,omitempty"` // "latitude,longitude" in degrees
+	Camera    string `json:"camera,omitempty"`
+}
+
+// RenditionInfo is one of the sizes photos are served in with ?size= or ?w=
+type RenditionInfo struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+}
+
+// RenditionsResponse lists the sizes and formats photos are served in
+type RenditionsResponse struct {
+	Sizes   []RenditionInfo `json:"sizes"`   // Smallest first
+	Formats []string        `json:"formats"` // Content types in order of preference; image/jpeg only unless built with libwebp
+}
+
+// UserSettings are a signed-in user's preferences
+type UserSettings struct {
+	// KeepMetadata serves the user's originals with their EXIF data, including location.
+	// By default photos are served with it removed.
+	KeepMetadata bool `json:"keepMetadata"`
 }
 
 // PhotoCluster represents a group of related photos
 type PhotoCluster struct {
-	ID             string   `json:"id"`
-	PhotoIds       []string `json:"photoIds"`
-	Theme          string   `json:"theme"`
-	Title          string   `json:"title"`
-	Description    string   `json:"description"`
-	Date           string   `json:"date"`
-	BackgroundPath string   `json:"backgroundPath,omitempty"`
+	ID             string    `json:"id"`
+	PhotoIds       []string  `json:"photoIds"`
+	Theme          string    `json:"theme"`
+	Title          string    `json:"title"`
+	Description    string    `json:"description"`
+	Date           string    `json:"date"`
+	BackgroundPath mediaPath `json:"backgroundPath,omitzero"`
 }
 
 // PageDraft represents a draft page for the memory book
 type PageDraft struct {
-	ID             string   `json:"id"`
-	ClusterID      string   `json:"clusterId"`
-	PhotoIds       []string `json:"photoIds"`
-	Title          string   `json:"title"`
-	Description    string   `json:"description"`
-	Theme          string   `json:"theme"`
-	BackgroundPath string   `json:"backgroundPath,omitempty"`
-	Status         string   `json:"status"` // "draft" | "approved" | "rejected"
-	CreatedAt      string   `json:"createdAt"`
+	ID             string      `json:"id"`
+	ClusterID      string      `json:"clusterId"`
+	PhotoIds       []string    `json:"photoIds"`
+	Title          string      `json:"title"`
+	Description    string      `json:"description"`
+	Theme          string      `json:"theme"`
+	BackgroundPath mediaPath   `json:"backgroundPath,omitzero"`
+	CoverPhotoID   string      `json:"coverPhotoId,omitempty"` // Hero photo for the page; must be one of PhotoIds
+	Layout         *PageLayout `json:"layout,omitempty"`
+	BookID         string      `json:"bookId,omitempty"`
+	Status         string      `json:"status" enum:"draft,approved,rejected"`
+	CreatedAt      string      `json:"createdAt"`
+	CapturedAt     string      `json:"capturedAt,omitempty"` // When the earliest photo on the page was taken
+	ApprovedAt     string      `json:"approvedAt,omitempty"` // When the draft last became an approved page
+	Owner          string      `json:"-"`                    // User ID of whoever clustered the photos; empty for drafts made without signing in
+}
+
+// LayoutRect is a rectangle in fractions (0-1) of its container
+type LayoutRect struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// LayoutSlot is a photo position on a page
+type LayoutSlot struct {
+	ID       string     `json:"id"`
+	Frame    LayoutRect `json:"frame"`    // Position on the page
+	Rotation float64    `json:"rotation"` // Degrees, clockwise
+	Z        int        `json:"z"`        // Stacking order
+}
+
+// LayoutVariant is the slot arrangement a template uses for a given photo count
+type LayoutVariant struct {
+	Photos int          `json:"photos"`
+	Slots  []LayoutSlot `json:"slots"`
+}
+
+// PhotoPlacement is where and how a single photo is drawn on a page
+type PhotoPlacement struct {
+	PhotoID  string     `json:"photoId"`
+	Slot     string     `json:"slot"`
+	Frame    LayoutRect `json:"frame"`    // Copied from the slot so renderers don't need the template
+	Crop     LayoutRect `json:"crop"`     // Visible region of the photo
+	Rotation float64    `json:"rotation"` // Degrees, clockwise
+	Z        int        `json:"z"`
+}
+
+// PageLayout is the resolved layout stored on a draft
+type PageLayout struct {
+	Template   string           `json:"template"`
+	Auto       bool             `json:"auto"` // Template was picked automatically and may change with the photos
+	Placements []PhotoPlacement `json:"placements"`
+}
+
+// SetLayoutRequest is the request body for changing a draft's layout
+type SetLayoutRequest struct {
+	Template   string           `json:"template"` // Template name or "auto"
+	Placements []PhotoPlacement `json:"placements,omitempty"`
 }
 
 // ClusterRequest is the request body for clustering photos
 type ClusterRequest struct {
 	PhotoIds []string `json:"photoIds"`
+	// Bursts controls near-duplicate handling: "" analyzes every photo, "collapse" analyzes one
+	// photo per burst and keeps the rest on the same page, "best" keeps only the best shot
+	Bursts string `json:"bursts,omitempty" enum:",collapse,best"`
 }
 
 // ClusterResponse is the response for clustering photos
 type ClusterResponse struct {
 	Clusters []PhotoCluster `json:"clusters"`
 	Drafts   []PageDraft    `json:"drafts"`
+	Skipped  []string       `json:"skipped,omitempty"` // Burst shots left out in "best" mode
+}
+
+// DraftListResponse is the response for listing drafts
+type DraftListResponse struct {
+	Drafts []PageDraft `json:"drafts"`
+	Total  int         `json:"total"`          // Number of drafts matching the filters, across all pages
+	Next   string      `json:"next,omitempty"` // Cursor for the next page; empty on the last page
+}
+
+// DraftOperation is a single change in a batch request
+type DraftOperation struct {
+	Op      string `json:"op" enum:"approve,reject,delete,setTheme,addToBook"`
+	DraftID string `json:"draftId"`
+	Theme   string `json:"theme,omitempty"`
+	BookID  string `json:"bookId,omitempty"`
+}
+
+// BatchDraftsRequest is the request body for applying several draft operations at once
+type BatchDraftsRequest struct {
+	Operations []DraftOperation `json:"operations"`
+	Atomic     bool             `json:"atomic,omitempty"` // Apply all operations or none
+}
+
+// DraftOperationResult is the outcome of one operation in a batch
+type DraftOperationResult struct {
+	Index   int        `json:"index"`
+	Op      string     `json:"op"`
+	DraftID string     `json:"draftId"`
+	Success bool       `json:"success"`
+	Code    string     `json:"code,omitempty"` // Error code of a failed operation, as in error responses
+	Error   string     `json:"error,omitempty"`
+	Draft   *PageDraft `json:"draft,omitempty"` // Updated draft; omitted for deletes and failures
+}
+
+// BatchDraftsResponse is the response for a batch of draft operations that was applied. Atomic
+// batches that were rolled back are reported as a batch_rolled_back problem instead.
+type BatchDraftsResponse struct {
+	Results []DraftOperationResult `json:"results"`
+}
+
+// MergeDraftsRequest is the request body for merging several drafts into one
+type MergeDraftsRequest struct {
+	DraftIds    []string `json:"draftIds"`
+	TargetID    string   `json:"targetId,omitempty"` // Draft whose ID, cluster, title and theme are kept; defaults to the first
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Theme       string   `json:"theme,omitempty"`
+	Rewrite     bool     `json:"rewrite,omitempty"` // Ask the AI to write a new title/description/theme for the merged page
+}
+
+// SplitDraftRequest is the request body for splitting photos off a draft into a new draft
+type SplitDraftRequest struct {
+	PhotoIds    []string `json:"photoIds"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Theme       string   `json:"theme,omitempty"`
+}
+
+// SplitDraftResponse is the response for splitting a draft
+type SplitDraftResponse struct {
+	Original PageDraft `json:"original"`
+	Created  PageDraft `json:"created"`
+}
+
+// ReorderPhotosRequest is the request body for reordering a draft's photos
+type ReorderPhotosRequest struct {
+	PhotoIds []string `json:"photoIds"`
+}
+
+// SetCoverRequest is the request body for choosing a draft's cover photo
+type SetCoverRequest struct {
+	PhotoID string `json:"photoId"` // Empty clears the cover
+}
+
+// MovePhotoRequest is the request body for moving or copying a photo to another draft
+type MovePhotoRequest struct {
+	PhotoID       string `json:"photoId"`
+	TargetDraftID string `json:"targetDraftId"`
+	Copy          bool   `json:"copy,omitempty"`     // Keep the photo on the source draft
+	Position      *int   `json:"position,omitempty"` // Index in the target draft; appended when omitted
+}
+
+// MovePhotoResponse is the response for moving or copying a photo
+type MovePhotoResponse struct {
+	Source PageDraft `json:"source"`
+	Target PageDraft `json:"target"`
 }
 
 // UploadResponse is the response for photo uploads
 type UploadResponse struct {
-	Success bool    `json:"success"`
-	Message string  `json:"message"`
-	Photos  []Photo `json:"photos,omitempty"`
+	Success bool               `json:"success"`
+	Message string             `json:"message"`
+	Photos  []Photo            `json:"photos,omitempty"` // Accepted photos, including duplicates
+	Results []UploadFileResult `json:"results"`          // One entry per uploaded file, in upload order
+}
+
+// UploadFileResult reports what happened to one uploaded file
+type UploadFileResult struct {
+	Filename    string `json:"filename"`
+	Status      string `json:"status" enum:"accepted,duplicate,rejected"`
+	Code        string `json:"code,omitempty"`   // Why the file was rejected, e.g. "unsupported_type", "corrupt_image"
+	Reason      string `json:"reason,omitempty"` // Human-readable explanation of the rejection
+	Photo       *Photo `json:"photo,omitempty"`
+	DuplicateOf string `json:"duplicateOf,omitempty"` // ID of the stored photo with identical content
+}
+
+// CreateUploadRequest starts a resumable upload of one file
+type CreateUploadRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"` // Hex hash of the whole file, checked when the upload is finalized
+}
+
+// UploadSession is a resumable upload in progress
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"` // Bytes received so far; the next chunk must start here
+	SHA256    string    `json:"sha256,omitempty"`
+	Owner     string    `json:"owner,omitempty"` // User who started the upload; only they may continue it
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"` // Pushed back whenever a chunk arrives
+}
+
+// DeletePhotosRequest is the request body for deleting several photos
+type DeletePhotosRequest struct {
+	PhotoIds []string `json:"photoIds"`
+	Force    bool     `json:"force,omitempty"` // Delete even when a photo is on an approved page
+}
+
+// PhotoDeleteResult is the outcome of deleting one photo
+type PhotoDeleteResult struct {
+	PhotoID        string   `json:"photoId"`
+	Success        bool     `json:"success"`
+	Code           string   `json:"code,omitempty"` // Error code of a failed delete, as in error responses
+	Error          string   `json:"error,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+	AffectedDrafts []string `json:"affectedDrafts,omitempty"` // Drafts the photo was removed from (or would be)
+	ExpiresAt      string   `json:"expiresAt,omitempty"`      // Restorable from the trash until then
 }
 
-// ErrorResponse is the standard error response
+// DeletePhotosResponse is the response for deleting photos
+type DeletePhotosResponse struct {
+	Results []PhotoDeleteResult `json:"results"`
+}
+
+// TrashDraftRef records where a deleted photo was used so it can be put back on restore
+type TrashDraftRef struct {
+	DraftID  string `json:"draftId"`
+	Position int    `json:"position"`
+	WasCover bool   `json:"wasCover,omitempty"`
+}
+
+// TrashEntry is a deleted photo waiting in the trash
+type TrashEntry struct {
+	PhotoID   string          `json:"photoId"`
+	Files     []string        `json:"files"` // Original and renditions, relative to the upload directory
+	DraftRefs []TrashDraftRef `json:"draftRefs,omitempty"`
+	Photo     *Photo          `json:"photo,omitempty"` // Catalog record, restored with the files
+	Owner     string          `json:"owner,omitempty"` // User who uploaded the photo
+	DeletedAt time.Time       `json:"deletedAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+}
+
+// ErrorResponse is the standard error response, an RFC 7807 problem document
 type ErrorResponse struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error"`
+	Type       string             `json:"type"`  // Always "about:blank"; Code identifies the problem
+	Title      string             `json:"title"` // Status text
+	Status     int                `json:"status"`
+	Detail     string             `json:"detail"` // Human-readable explanation of this occurrence
+	Code       string             `json:"code"`   // Stable machine-readable code, e.g. "draft_not_found"
+	RequestID  string             `json:"requestId,omitempty"`
+	Errors     []FieldError       `json:"errors,omitempty"`     // Fields or files that failed validation
+	Results    []UploadFileResult `json:"results,omitempty"`    // Files an upload stored before it failed, so clients don't upload them again
+	Retryable  bool               `json:"retryable,omitempty"`  // The same request may succeed later
+	RetryAfter int                `json:"retryAfter,omitempty"` // Seconds to wait before retrying, also sent as Retry-After
+	Success    bool               `json:"success"`              // Always false; kept for older clients
+	Error      string             `json:"error"`                // Same as Detail; kept for older clients
+}
+
+// FieldError points at one invalid part of a request
+type FieldError struct {
+	Field   string `json:"field"`          // JSON field, query parameter or uploaded file name
+	Code    string `json:"code,omitempty"` // Finer-grained reason, e.g. an upload rejection code
+	Message string `json:"message"`
 }
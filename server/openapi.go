@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the document follows
+const openAPIVersion = "3.0.3"
+
+// pathParam matches the {name} wildcards of a route path
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+var (
+	timeType      = reflect.TypeFor[time.Time]()
+	mediaPathType = reflect.TypeFor[mediaPath]()
+)
+
+// HandleOpenAPI serves the OpenAPI document describing the API, built once from the routes
+// and the models they reference
+func HandleOpenAPI(routes []route) http.HandlerFunc {
+	doc := buildOpenAPIDocument(routes)
+	return func(w http.ResponseWriter, r *http.Request) {
+		SendJSON(w, doc)
+	}
+}
+
+// buildOpenAPIDocument describes every API route, with schemas generated from the Go types
+// handlers decode and encode, so the document follows the models as they change
+func buildOpenAPIDocument(routes []route) map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]map[string]any)
+
+	for _, rt := range routes {
+		op := map[string]any{"summary": rt.Summary}
+
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, name := range rt.Query {
+			params = append(params, map[string]any{
+				"name": name, "in": "query", "schema": map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		switch {
+		case rt.Body != nil:
+			op["requestBody"] = jsonContent("application/json", schemaFor(reflect.TypeOf(rt.Body), schemas), true)
+		case rt.BodyType != "":
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					rt.BodyType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+				},
+			}
+		}
+
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		responses := make(map[string]any)
+		for _, s := range append([]int{status}, rt.AlsoStatus...) {
+			success := jsonContent("application/json", schemaFor(reflect.TypeOf(rt.Response), schemas), false)
+			success["description"] = http.StatusText(s)
+			responses[strconv.Itoa(s)] = success
+		}
+		errorResponse := jsonContent(problemContentType, schemaFor(reflect.TypeFor[ErrorResponse](), schemas), false)
+		errorResponse["description"] = "Problem document; see code for the kind of error"
+		responses["default"] = errorResponse
+		op["responses"] = responses
+
+		switch {
+		case rt.AdminOnly:
+			op["security"] = []any{map[string]any{"adminToken": []string{}}}
+		case rt.SignedInOnly:
+			op["security"] = []any{map[string]any{"session": []string{}}}
+		case rt.UserScoped:
+			// Anonymous only when the server has no sign-in configured
+			op["security"] = []any{map[string]any{"session": []string{}}, map[string]any{}}
+		}
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = make(map[string]any)
+		}
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "Draw a Memory API",
+			"version":     strings.TrimPrefix(apiPrefix, "/api/"),
+			"description": "Photo files are served outside the API at the signed paths returned in path and backgroundPath.",
+		},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"session":    map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "Clerk session token"},
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+			},
+		},
+	}
+}
+
+// jsonContent wraps a schema as a request or response body of the given media type
+func jsonContent(mediaType string, schema map[string]any, isRequest bool) map[string]any {
+	content := map[string]any{
+		"content": map[string]any{mediaType: map[string]any{"schema": schema}},
+	}
+	if isRequest {
+		content["required"] = true
+	}
+	return content
+}
+
+// schemaFor returns the JSON schema of a Go type as encoding/json encodes it. Named structs are
+// added to schemas and referenced, so each model is described once.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case mediaPathType:
+		return map[string]any{"type": "string", "format": "uri-reference", "description": "Signed path of a served file"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // Reserve the name so recursive types terminate
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+// structSchema describes the exported fields of a struct. Fields without omitempty or omitzero
+// are always encoded and so are listed as required; an enum tag lists a string field's allowed values.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := schemaFor(f.Type, schemas)
+		if enum, ok := f.Tag.Lookup("enum"); ok {
+			prop["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = prop
+		if opts := "," + opts + ","; !strings.Contains(opts, ",omitempty,") && !strings.Contains(opts, ",omitzero,") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contractCase is a request that exercises one route
+type contractCase struct {
+	path    string // Under apiPrefix, with the path parameters filled in
+	body    string
+	header  map[string]string
+	user    string // Signed-in user the request is sent as; empty for anonymous
+	status  int    // Expected status; the route's success status when unset
+	prepare func(t *testing.T, c *contractCase)
+}
+
+// TestRoutesMatchOpenAPI calls every route through the router and checks that the status is
+// documented and the body matches the schema the OpenAPI document gives for it
+func TestRoutesMatchOpenAPI(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UploadSessionDir = t.TempDir()
+	cfg.AdminToken = "test-admin-token"
+	cfg.ClerkJWKSURL = "http://jwks.invalid/jwks.json"
+	a := newTestApp(t, cfg)
+	sign := useTestSessionKey(t, a)
+	router := a.newRouter()
+	routes := a.apiRoutes()
+	doc := roundTripJSON(t, buildOpenAPIDocument(routes)).(map[string]any)
+
+	const alice = "user_alice"
+	pngData := testPNG(t, 1)
+	for _, id := range []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7"} {
+		putTestBlob(t, a, id+".png", string(pngData))
+		photo := Photo{ID: id, Filename: id + ".png", Width: 8, Height: 6, UploadedAt: time.Now()}
+		if err := a.catalog.Add(t.Context(), catalogEntry{Photo: photo, Key: id + ".png", Owner: alice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []PageDraft{
+		{ID: "d1", PhotoIds: []string{"p1", "p2"}, Title: "Beach", Theme: "vintage"},
+		{ID: "d2", PhotoIds: []string{"p3"}, Title: "Hike", Theme: "vintage"},
+		{ID: "d3", PhotoIds: []string{"p4"}, Title: "To delete", Theme: "vintage"},
+		{ID: "d4", PhotoIds: []string{"p5"}, Title: "To approve", Theme: "vintage"},
+	} {
+		d.Status = "draft"
+		d.Owner = alice
+		d.CreatedAt = time.Now().Format(time.RFC3339)
+		a.drafts[d.ID] = d
+	}
+	if _, err := a.trashPhoto(t.Context(), alice, "p7", false); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method, path, body string, header map[string]string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" && header["Content-Type"] == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+sign(user))
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	createUpload := func(t *testing.T, data []byte, complete bool) string {
+		body := fmt.Sprintf(`{"filename":"upload.png","size":%d}`, len(data))
+		rec := send("POST", apiPrefix+"/uploads", body, nil, alice)
+		var session UploadSession
+		if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil || session.ID == "" {
+			t.Fatalf("creating upload: %d %s", rec.Code, rec.Body)
+		}
+		if loc := rec.Header().Get("Location"); loc != apiPrefix+"/uploads/"+session.ID {
+			t.Errorf("Location = %q, want the upload under %s", loc, apiPrefix)
+		}
+		if complete {
+			rec := send("PATCH", apiPrefix+"/uploads/"+session.ID, string(data), map[string]string{
+				"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0",
+			}, alice)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("uploading: %d %s", rec.Code, rec.Body)
+			}
+		}
+		return session.ID
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("photos", "new.png")
+	part.Write(pngData)
+	mw.Close()
+
+	admin := map[string]string{"Authorization": "Bearer " + cfg.AdminToken}
+	cases := map[string]*contractCase{
+		"GET /photos":               {user: alice},
+		"POST /photos/upload":       {body: form.String(), header: map[string]string{"Content-Type": mw.FormDataContentType()}, user: alice},
+		"POST /photos/cluster":      {body: `{"photoIds":["p1","p2"]}`, user: alice}, // Falls back to one cluster without Gemini
+		"POST /photos/delete":       {body: `{"photoIds":["p6","missing"]}`, user: alice, status: http.StatusMultiStatus},
+		"GET /photos/trash":         {user: alice},
+		"DELETE /photos/{id}":       {path: "/photos/p4", user: alice},
+		"POST /photos/{id}/restore": {path: "/photos/p7/restore", user: alice},
+
+		"POST /uploads": {body: `{"filename":"a.png","size":10}`, user: alice},
+		"GET /uploads/{id}": {user: alice, prepare: func(t *testing.T, c *contractCase) {
+			c.path = "/uploads/" + createUpload(t, pngData, false)
+		}},
+		"PATCH /uploads/{id}": {user: alice, body: string(pngData),
+			header: map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"},
+			prepare: func(t *testing.T, c *contractCase) {
+				c.path = "/uploads/" + createUpload(t, pngData, false)
+			}},
+		"DELETE /uploads/{id}": {user: alice, prepare: func(t *testing.T, c *contractCase) {
+			c.path = "/uploads/" + createUpload(t, pngData, false)
+		}},
+		"POST /uploads/{id}/finalize": {user: alice, prepare: func(t *testing.T, c *contractCase) {
+			c.path = "/uploads/" + createUpload(t, testPNG(t, 2), true) + "/finalize"
+		}},
+
+		"GET /drafts":                   {path: "/drafts?status=draft&sort=createdAt&limit=2", user: alice},
+		"POST /drafts/merge":            {body: `{"draftIds":["d1","d2"]}`, user: alice},
+		"POST /drafts/batch":            {body: `{"operations":[{"op":"setTheme","draftId":"d1","theme":"modern"},{"op":"approve","draftId":"missing"}]}`, status: http.StatusMultiStatus, user: alice},
+		"GET /drafts/{id}":              {path: "/drafts/d1", user: alice},
+		"PUT /drafts/{id}":              {path: "/drafts/d1", body: `{"id":"d1","photoIds":["p2","p1"],"title":"Beach day","theme":"playful","status":"draft"}`, user: alice},
+		"DELETE /drafts/{id}":           {path: "/drafts/d3", user: alice},
+		"POST /drafts/{id}/approve":     {path: "/drafts/d4/approve", user: alice},
+		"PUT /drafts/{id}/approve":      {path: "/drafts/nope/approve", status: http.StatusNotFound, user: alice},
+		"PUT /drafts/{id}/photos":       {path: "/drafts/d1/photos", body: `{"photoIds":["p1","p2"]}`, user: alice},
+		"PUT /drafts/{id}/cover":        {path: "/drafts/d1/cover", body: `{"photoId":"p2"}`, user: alice},
+		"PUT /drafts/{id}/layout":       {path: "/drafts/d1/layout", body: `{"template":"auto"}`, user: alice},
+		"POST /drafts/{id}/split":       {path: "/drafts/d1/split", body: `{"photoIds":["p2"]}`, user: alice},
+		"POST /drafts/{id}/photos/move": {path: "/drafts/d1/photos/move", body: `{"photoId":"p1","targetDraftId":"d4","copy":true}`, user: alice},
+		"GET /layouts":                  {},
+		"GET /renditions":               {},
+
+		"GET /settings":  {user: alice},
+		"PUT /settings":  {body: `{"keepMetadata":true}`, user: alice},
+		"GET /admin/gc":  {header: admin},
+		"POST /admin/gc": {path: "/admin/gc?dryRun=1", header: admin},
+	}
+
+	for _, rt := range routes {
+		name := rt.Method + " " + rt.Path
+		t.Run(name, func(t *testing.T) {
+			c, ok := cases[name]
+			if !ok {
+				t.Fatalf("no contract case for %s; add one to exercise the route", name)
+			}
+			if c.prepare != nil {
+				c.prepare(t, c)
+			}
+			path := c.path
+			if path == "" {
+				path = rt.Path
+			}
+			want := c.status
+			if want == 0 {
+				want = cmp.Or(rt.Status, http.StatusOK)
+			}
+
+			rec := send(rt.Method, apiPrefix+path, c.body, c.header, c.user)
+			if rec.Code != want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body)
+			}
+
+			op := doc["paths"].(map[string]any)[rt.Path].(map[string]any)[strings.ToLower(rt.Method)].(map[string]any)
+			responses := op["responses"].(map[string]any)
+			response, ok := responses[strconv.Itoa(rec.Code)].(map[string]any)
+			if !ok {
+				response = responses["default"].(map[string]any)
+			}
+
+			mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+			content, ok := response["content"].(map[string]any)[mediaType].(map[string]any)
+			if !ok {
+				t.Fatalf("status %d is documented without content of type %q", rec.Code, mediaType)
+			}
+			var body any
+			dec := json.NewDecoder(rec.Body)
+			dec.UseNumber()
+			if err := dec.Decode(&body); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+			for _, problem := range checkSchema(doc, content["schema"].(map[string]any), body, "body") {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// checkSchema lists where a decoded JSON value doesn't match a schema of the kinds
+// buildOpenAPIDocument generates
+func checkSchema(doc, schema map[string]any, v any, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := doc["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+		if !ok {
+			return []string{at + ": unknown schema " + ref}
+		}
+		return checkSchema(doc, resolved, v, at)
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %s, want object", at, jsonKind(v))}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+		for name, value := range obj {
+			if prop, ok := properties[name].(map[string]any); ok {
+				problems = append(problems, checkSchema(doc, prop, value, at+"."+name)...)
+			} else if extra, ok := schema["additionalProperties"].(map[string]any); ok {
+				problems = append(problems, checkSchema(doc, extra, value, at+"."+name)...)
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: undocumented property %q", at, name))
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %s, want array", at, jsonKind(v))}
+		}
+		for i, item := range arr {
+			problems = append(problems, checkSchema(doc, schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %s, want string", at, jsonKind(v))}
+		}
+		if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, any(s)) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not one of %v", at, s, enum))
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return []string{fmt.Sprintf("%s: got %s %v, want integer", at, jsonKind(v), v)}
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return []string{fmt.Sprintf("%s: got %s, want number", at, jsonKind(v))}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: got %s, want boolean", at, jsonKind(v))}
+		}
+	}
+	return problems
+}
+
+// jsonKind names the JSON type of a decoded value
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// roundTripJSON encodes and decodes a value, giving the document as clients see it
+func roundTripJSON(t *testing.T, v any) any {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// nearDuplicateDistance is the largest number of differing hash bits for two photos to count
+// as the same shot, e.g. consecutive frames of a burst
+const nearDuplicateDistance = 10
+
+// perceptualHash computes a 64-bit difference hash: the image is shrunk to 9x8 grayscale and
+// each bit records whether a pixel is brighter than its right-hand neighbour. Small edits,
+// re-encoding and slight movement between burst frames change only a few bits.
+func perceptualHash(img image.Image) string {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// isNearDuplicate reports whether two perceptual hashes are close enough to be the same shot
+func isNearDuplicate(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	ha, errA := strconv.ParseUint(a, 16, 64)
+	hb, errB := strconv.ParseUint(b, 16, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bits.OnesCount64(ha^hb) <= nearDuplicateDistance
+}
+
+// groupBursts splits photo IDs into groups of near-duplicates, keeping the input order.
+// Photos that resemble nothing else form a group of one.
+func (a *App) groupBursts(photoIDs []string) [][]string {
+	parent := make([]int, len(photoIDs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	hashes := make([]string, len(photoIDs))
+	for i, id := range photoIDs {
+		if e, ok := a.catalog.Get(id); ok {
+			hashes[i] = e.PHash
+		}
+	}
+	for i := range photoIDs {
+		for j := i + 1; j < len(photoIDs); j++ {
+			if isNearDuplicate(hashes[i], hashes[j]) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	index := make(map[int]int)
+	var groups [][]string
+	for i, id := range photoIDs {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], id)
+	}
+	return groups
+}
+
+// bestShot picks the photo to keep from a burst: the highest resolution, then the largest
+// file (more detail survives compression), then the earliest ID for a stable choice
+func (a *App) bestShot(group []string) string {
+	ranked := append([]string(nil), group...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		x, _ := a.catalog.Get(ranked[i])
+		y, _ := a.catalog.Get(ranked[j])
+		if px, py := x.Width*x.Height, y.Width*y.Height; px != py {
+			return px > py
+		}
+		if x.Size != y.Size {
+			return x.Size > y.Size
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked[0]
+}
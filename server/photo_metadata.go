@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// publicQuality is the JPEG quality used when metadata can only be removed by re-encoding
+const publicQuality = 92
+
+var errNoLosslessStrip = errors.New("metadata can't be removed without re-encoding")
+
+// readPhotoMetadata extracts the capture time, camera and location from a photo's EXIF block
+// into the catalog record. Metadata is left empty rather than nil when there is none, so the
+// photo isn't read again to look for it.
+func readPhotoMetadata(p *Photo, data []byte, format imageFormat) {
+	p.Metadata = &PhotoMetadata{}
+
+	x, err := decodeExif(data, format)
+	if err != nil {
+		return
+	}
+
+	if taken, err := x.DateTime(); err == nil {
+		p.TakenAt = &taken
+		p.Metadata.DateTaken = taken.Format(time.RFC3339)
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		p.Metadata.Location = fmt.Sprintf("%.6f,%.6f", lat, long)
+	}
+
+	maker := exifString(x, exif.Make)
+	model := exifString(x, exif.Model)
+	if maker != "" && !strings.HasPrefix(model, maker) {
+		model = strings.TrimSpace(maker + " " + model)
+	}
+	p.Metadata.Camera = model
+}
+
+// readPhotoMetadataFrom reads a stored or uploaded file of at most maxSize bytes and extracts its metadata
+func readPhotoMetadataFrom(p *Photo, src io.ReadSeeker, format imageFormat, maxSize int64) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(src, maxSize))
+	if err != nil {
+		return err
+	}
+	readPhotoMetadata(p, data, format)
+	return nil
+}
+
+// decodeExif finds and parses the EXIF block of a photo in any supported format
+func decodeExif(data []byte, format imageFormat) (*exif.Exif, error) {
+	var block []byte
+	switch format.Ext {
+	case formatJPEG.Ext:
+		block = data // The exif package finds the APP1 segment itself
+	case formatPNG.Ext:
+		block = pngChunk(data, "eXIf")
+	case formatWebP.Ext:
+		block = webpChunk(data, "EXIF")
+	case formatHEIC.Ext:
+		// The Exif item is stored in the media data with its usual header; find it rather than
+		// walking the item location boxes
+		if i := bytes.Index(data, []byte("Exif\x00\x00")); i != -1 {
+			block = data[i:]
+		}
+	}
+	if len(block) == 0 {
+		return nil, errors.New("no EXIF data")
+	}
+
+	// Unreadable maker notes and similar damage still leave the standard tags usable
+	x, err := exif.Decode(bytes.NewReader(block))
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		return nil, err
+	}
+	return x, nil
+}
+
+// exifString returns a text tag, or "" when it is missing
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// exifOrientation returns the EXIF orientation of a photo, 1 (upright) when unknown
+func exifOrientation(data []byte, format imageFormat) int {
+	x, err := decodeExif(data, format)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil {
+		return 1
+	}
+	return o
+}
+
+// publicRenditionKey is the storage key of the copy of an original served without its metadata
+func publicRenditionKey(photoID string, format imageFormat) string {
+	return photoID + "_public" + format.Ext
+}
+
+// publicOriginal returns the storage key of a copy of a photo's original without location,
+// device and other metadata, creating it on first use
+func (a *App) publicOriginal(ctx context.Context, photo catalogEntry) (string, error) {
+	format, ok := formatForKey(photo.Key)
+	if !ok {
+		return "", fmt.Errorf("unknown format for %s", photo.Key)
+	}
+
+	// The copy keeps the original's format unless it had to be re-encoded as JPEG
+	for _, f := range []imageFormat{format, formatJPEG} {
+		key := publicRenditionKey(photo.ID, f)
+		if _, err := a.store.Stat(ctx, key); err == nil {
+			return key, nil
+		}
+	}
+
+	data, err := readBlob(ctx, a.store, photo.Key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read original: %w", err)
+	}
+	clean, cleanFormat, err := withoutMetadata(data, format)
+	if err != nil {
+		return "", err
+	}
+
+	key := publicRenditionKey(photo.ID, cleanFormat)
+	if err := putBlob(ctx, a.store, key, clean, cleanFormat.ContentType); err != nil {
+		return "", fmt.Errorf("failed to store stripped copy: %w", err)
+	}
+	return key, nil
+}
+
+// withoutMetadata removes metadata from an image. Metadata segments are dropped without touching
+// the pixels where the format allows; other images, and photos that rely on their EXIF
+// orientation to display upright, are re-encoded as JPEG.
+func withoutMetadata(data []byte, format imageFormat) ([]byte, imageFormat, error) {
+	if exifOrientation(data, format) == 1 {
+		var clean []byte
+		var err error
+		switch format.Ext {
+		case formatJPEG.Ext:
+			clean, err = stripJPEGMetadata(data)
+		case formatPNG.Ext:
+			clean, err = stripPNGMetadata(data)
+		case formatWebP.Ext:
+			clean, err = stripWebPMetadata(data)
+		case formatGIF.Ext:
+			clean = data // GIF has no place for EXIF
+		default:
+			err = errNoLosslessStrip
+		}
+		if err == nil {
+			return clean, format, nil
+		}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, imageFormat{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(publicQuality)); err != nil {
+		return nil, imageFormat{}, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), formatJPEG, nil
+}
+
+// stripJPEGMetadata drops the EXIF/XMP, IPTC, comment and vendor segments of a JPEG,
+// keeping the JFIF header, ICC color profile and Adobe color transform
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, errors.New("corrupt JPEG marker")
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // Fill byte
+			i++
+			continue
+		case marker == 0xDA: // Start of scan: the rest is image data
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // Markers without a length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		// APPn segments other than JFIF (APP0), ICC profile (APP2) and Adobe (APP14), and comments
+		isApp := marker >= 0xE0 && marker <= 0xEF
+		isMetadata := isApp && marker != 0xE0 && marker != 0xE2 && marker != 0xEE || marker == 0xFE
+		if !isMetadata {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return nil, errors.New("JPEG has no image data")
+}
+
+// pngMetadataChunks are the PNG chunks holding EXIF, text and timestamps
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// stripPNGMetadata drops the metadata chunks of a PNG
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const sigLen = 8
+	if len(data) < sigLen || string(data[1:4]) != "PNG" {
+		return nil, errors.New("not a PNG")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:sigLen])
+	err := eachPNGChunk(data, func(typ string, chunk []byte) {
+		if !pngMetadataChunks[typ] {
+			out.Write(chunk)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// pngChunk returns the data of the first chunk of a type, or nil
+func pngChunk(data []byte, want string) []byte {
+	var found []byte
+	eachPNGChunk(data, func(typ string, chunk []byte) {
+		if typ == want && found == nil {
+			found = chunk[8 : len(chunk)-4]
+		}
+	})
+	return found
+}
+
+// eachPNGChunk calls fn with the type and full bytes (length, type, data and CRC) of each chunk
+func eachPNGChunk(data []byte, fn func(typ string, chunk []byte)) error {
+	for i := 8; i < len(data); {
+		if i+12 > len(data) {
+			return errors.New("truncated PNG chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end < i+12 || end > len(data) {
+			return errors.New("truncated PNG chunk")
+		}
+		fn(string(data[i+4:i+8]), data[i:end])
+		i = end
+	}
+	return nil
+}
+
+// VP8X feature flags announcing EXIF and XMP chunks
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP and clears the flags announcing them
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	err := eachWebPChunk(data, func(fourCC string, chunk []byte) {
+		switch fourCC {
+		case "EXIF", "XMP ":
+			return
+		case "VP8X":
+			start := out.Len()
+			out.Write(chunk)
+			out.Bytes()[start+8] &^= webpFlagEXIF | webpFlagXMP
+			return
+		}
+		out.Write(chunk)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clean := out.Bytes()
+	binary.LittleEndian.PutUint32(clean[4:], uint32(len(clean)-8))
+	return clean, nil
+}
+
+// webpChunk returns the payload of the first chunk with the given FourCC, or nil
+func webpChunk(data []byte, want string) []byte {
+	var found []byte
+	eachWebPChunk(data, func(fourCC string, chunk []byte) {
+		if fourCC == want && found == nil {
+			size := binary.LittleEndian.Uint32(chunk[4:])
+			found = bytes.TrimPrefix(chunk[8:8+size], []byte("Exif\x00\x00"))
+		}
+	})
+	return found
+}
+
+// eachWebPChunk calls fn with the FourCC and full bytes (header, payload and padding) of each chunk
+func eachWebPChunk(data []byte, fn func(fourCC string, chunk []byte)) error {
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return errors.New("truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end < i+8 || end > len(data) {
+			// Some encoders leave out the final padding byte
+			if end == len(data)+1 {
+				end = len(data)
+			} else {
+				return errors.New("truncated WebP chunk")
+			}
+		}
+		fn(string(data[i:i+4]), data[i:end])
+		i = end
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testExif returns a little-endian TIFF block naming the camera "TestCam" and placing
+// the photo at 51.5 N, 0.125 E
+func testExif() []byte {
+	type entry struct {
+		tag, typ    uint16
+		count, word uint32
+	}
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	writeIFD := func(entries []entry) {
+		binary.Write(&b, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&b, le, e)
+		}
+		binary.Write(&b, le, uint32(0)) // No next IFD
+	}
+	rationals := func(vals ...uint32) {
+		for _, v := range vals {
+			binary.Write(&b, le, [2]uint32{v, 1})
+		}
+	}
+	inline := func(s string) uint32 {
+		var word [4]byte
+		copy(word[:], s)
+		return le.Uint32(word[:])
+	}
+
+	// Offsets from the start of the block: header 8, IFD0 30, camera name 8, GPS IFD 54, rationals 2x24
+	const ifd0, makeAt, gpsIFD, latAt, longAt = 8, 38, 46, 100, 124
+	b.WriteString("II*\x00")
+	binary.Write(&b, le, uint32(ifd0))
+	writeIFD([]entry{
+		{0x010F, 2, 8, makeAt}, // Make
+		{0x8825, 4, 1, gpsIFD}, // GPS IFD pointer
+	})
+	b.WriteString("TestCam\x00")
+	writeIFD([]entry{
+		{0x0001, 2, 2, inline("N")}, // GPSLatitudeRef
+		{0x0002, 5, 3, latAt},       // GPSLatitude
+		{0x0003, 2, 2, inline("E")}, // GPSLongitudeRef
+		{0x0004, 5, 3, longAt},      // GPSLongitude
+	})
+	rationals(51, 30, 0)
+	rationals(0, 7, 30)
+	return b.Bytes()
+}
+
+// testJPEGWithExif returns a small JPEG carrying testExif in an APP1 segment
+func testJPEGWithExif(t *testing.T) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 6)), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte("Exif\x00\x00"), testExif()...)
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+// testPNGWithExif returns testPNG with eXIf and tEXt chunks inserted after the header
+func testPNGWithExif(t *testing.T) []byte {
+	t.Helper()
+	data := testPNG(t, 1)
+	chunk := func(typ string, payload []byte) []byte {
+		var c bytes.Buffer
+		binary.Write(&c, binary.BigEndian, uint32(len(payload)))
+		c.WriteString(typ)
+		c.Write(payload)
+		binary.Write(&c, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), payload...)))
+		return c.Bytes()
+	}
+	const afterIHDR = 8 + 12 + 13
+	var out bytes.Buffer
+	out.Write(data[:afterIHDR])
+	out.Write(chunk("eXIf", testExif()))
+	out.Write(chunk("tEXt", []byte("Comment\x00taken at TestCam's home")))
+	out.Write(data[afterIHDR:])
+	return out.Bytes()
+}
+
+func TestReadPhotoMetadata(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data   []byte
+		format imageFormat
+	}{
+		"jpeg": {testJPEGWithExif(t), formatJPEG},
+		"png":  {testPNGWithExif(t), formatPNG},
+	} {
+		var p Photo
+		readPhotoMetadata(&p, tc.data, tc.format)
+		if p.Metadata.Camera != "TestCam" || p.Metadata.Location != "51.500000,0.125000" {
+			t.Errorf("%s: metadata = %+v; want the camera and location", name, p.Metadata)
+		}
+	}
+}
+
+func TestWithoutMetadata(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data   []byte
+		format imageFormat
+	}{
+		"jpeg": {testJPEGWithExif(t), formatJPEG},
+		"png":  {testPNGWithExif(t), formatPNG},
+	} {
+		clean, format, err := withoutMetadata(tc.data, tc.format)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if format.Ext != tc.format.Ext {
+			t.Errorf("%s: re-encoded as %s; want the original format kept", name, format.Ext)
+		}
+		if bytes.Contains(clean, []byte("TestCam")) {
+			t.Errorf("%s: stripped copy still names the camera", name)
+		}
+		if _, err := decodeExif(clean, format); err == nil {
+			t.Errorf("%s: stripped copy still has EXIF", name)
+		}
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(clean)); err != nil || cfg.Width != 8 || cfg.Height != 6 {
+			t.Errorf("%s: stripped copy decodes as %+v, %v", name, cfg, err)
+		}
+	}
+}
+
+func TestServedPhotosHaveMetadataRemoved(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	router := a.newRouter()
+	original := testJPEGWithExif(t)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("photos", "private.jpg")
+	part.Write(original)
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/photos/upload", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var upload UploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &upload); err != nil || len(upload.Photos) != 1 {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	private, _ := a.catalog.Get(upload.Photos[0].ID)
+	if private.Metadata == nil || private.Metadata.Location != "51.500000,0.125000" {
+		t.Errorf("catalog metadata = %+v; want the location kept for clustering", private.Metadata)
+	}
+
+	const keeper = "user_keeps_metadata"
+	if err := putBlob(t.Context(), a.store, "shared.jpg", original, ""); err != nil {
+		t.Fatal(err)
+	}
+	entry := catalogEntry{Photo: Photo{ID: "shared", Filename: "shared.jpg", Width: 8, Height: 6}, Key: "shared.jpg", Owner: keeper}
+	if err := a.catalog.Add(t.Context(), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.saveUserSettings(t.Context(), keeper, UserSettings{KeepMetadata: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path string) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", path, rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	body := serve(a.signer.sign("/uploads/"+private.Key, time.Now()))
+	if bytes.Contains(body, []byte("TestCam")) {
+		t.Error("photo served with its EXIF data")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(body)); err != nil {
+		t.Errorf("served photo doesn't decode: %v", err)
+	}
+
+	if body := serve(a.signer.sign("/uploads/shared.jpg", time.Now())); !bytes.Equal(body, original) {
+		t.Error("owner who opted out wasn't served the original")
+	}
+}
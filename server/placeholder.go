@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// blurHashSize is the width the image is shrunk to before encoding; BlurHash only
+	// keeps a few low-frequency components, so more pixels just cost time
+	blurHashSize = 32
+	// blurHashComponents is the horizontal detail kept; the vertical follows the aspect ratio
+	blurHashComponents = 4
+)
+
+// placeholders computes a BlurHash and the dominant color of an image, for clients to
+// show while the photo itself loads
+func placeholders(img image.Image) (hash, color string) {
+	small := imaging.Resize(img, blurHashSize, 0, imaging.Box)
+	bounds := small.Bounds()
+
+	// Keep roughly square cells: fewer vertical components for landscape photos and vice versa
+	y := blurHashComponents * bounds.Dy() / max(bounds.Dx(), 1)
+	y = min(max(y, 1), 9)
+	x := blurHashComponents
+	if y > blurHashComponents {
+		x = max(blurHashComponents*bounds.Dx()/max(bounds.Dy(), 1), 1)
+	}
+
+	hash, err := blurhash.Encode(x, y, small)
+	if err != nil {
+		hash = ""
+	}
+	return hash, dominantColor(small)
+}
+
+// dominantColor buckets pixels into a coarse 4-bit-per-channel palette and returns the
+// average of the most populated bucket, so a photo of a blue sky over a small red boat
+// comes out blue rather than the muddy purple a plain average would give
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		bk, ok := buckets[key]
+		if !ok {
+			bk = &bucket{}
+			buckets[key] = bk
+		}
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		bk.n++
+		if best == nil || bk.n > best.n {
+			best = bk
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buckket/go-blurhash"
+)
+
+// splitImage returns a landscape image, red on the left and blue on the right
+func splitImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	draw.Draw(img, image.Rect(0, 0, 32, 32), image.NewUniform(color.NRGBA{200, 30, 30, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(32, 0, 64, 32), image.NewUniform(color.NRGBA{30, 30, 200, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPlaceholders(t *testing.T) {
+	hash, dominant := placeholders(splitImage())
+	if hash != "C#G}6v|TsRJqsqn~jsa}" {
+		t.Errorf("hash = %q", hash)
+	}
+	if dominant != "#c81e1e" {
+		t.Errorf("dominant color = %q; want the red; the halves tie and the first color seen wins", dominant)
+	}
+
+	// The preview keeps the left-right split
+	preview, err := blurhash.Decode(hash, 8, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, right := color.NRGBAModel.Convert(preview.At(0, 2)).(color.NRGBA), color.NRGBAModel.Convert(preview.At(7, 2)).(color.NRGBA)
+	if left.R <= left.B || right.B <= right.R {
+		t.Errorf("preview edges = %v, %v; want red on the left and blue on the right", left, right)
+	}
+}
+
+func TestPhotosCarryPlaceholders(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	router := a.newRouter()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, splitImage()); err != nil {
+		t.Fatal(err)
+	}
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("photos", "split.png")
+	part.Write(img.Bytes())
+	mw.Close()
+	req := httptest.NewRequest("POST", apiPrefix+"/photos/upload", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/photos", nil))
+	var photos []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &photos); err != nil || len(photos) != 1 {
+		t.Fatalf("photos = %d %s; want the upload", rec.Code, rec.Body)
+	}
+	if photos[0]["blurHash"] != "C#G}6v|TsRJqsqn~jsa}" || photos[0]["dominantColor"] != "#c81e1e" {
+		t.Errorf("photo JSON = %v; want its blurHash and dominantColor", photos[0])
+	}
+}
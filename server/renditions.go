@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+// maxConcurrentRenditions caps how many originals are decoded for renditions at once. A 100 MP
+// original takes 400 MB once decoded, so requests beyond this wait their turn.
+const maxConcurrentRenditions = 2
+
+// renditionTimeout bounds creating one rendition, including the wait for a decode slot. The work
+// is shared by every request for the rendition, so it doesn't stop when the first one goes away.
+const renditionTimeout = 2 * time.Minute
+
+// renditionWork makes concurrent requests for the same missing rendition share one decode and
+// bounds how many decodes run at once
+type renditionWork struct {
+	calls singleflight.Group
+	slots *semaphore.Weighted
+}
+
+// newRenditionWork returns the work limiter for renditions
+func newRenditionWork() *renditionWork {
+	return &renditionWork{slots: semaphore.NewWeighted(maxConcurrentRenditions)}
+}
+
+// renditionSize is a width photos are resized to for serving
+type renditionSize struct {
+	Name    string
+	Width   int
+	Quality int
+}
+
+// renditionSizes returns the sizes served at the configured widths, smallest first: grid
+// tiles, the page view, full screen and print. Requested widths are snapped to these so the
+// cache stays small.
+func renditionSizes(w RenditionWidths) []renditionSize {
+	return []renditionSize{
+		{Name: "tile", Width: w.Tile, Quality: 80},
+		{Name: "page", Width: w.Page, Quality: 85},
+		{Name: "full", Width: w.Full, Quality: 88},
+		{Name: "print", Width: w.Print, Quality: 92},
+	}
+}
+
+// renditionEncoder writes renditions in one image format
+type renditionEncoder struct {
+	ContentType string
+	Ext         string
+	encode      func(w io.Writer, img image.Image, quality int) error
+}
+
+// renditionEncoders lists output formats in order of preference; the first one the client
+// accepts is used. JPEG must stay last as the fallback every client can display. There is no
+// pure Go lossy WebP encoder, so WebP is only added ahead of it by builds with cgo and the libwebp
+// tag (renditions_webp.go). AVIF isn't offered, since neither has an AVIF encoder; default builds
+// serve every rendition as JPEG.
+var renditionEncoders = []renditionEncoder{
+	{ContentType: "image/jpeg", Ext: ".jpg", encode: func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}},
+}
+
+// findRenditionSize looks up a size by name
+func (a *App) findRenditionSize(name string) (renditionSize, bool) {
+	for _, s := range a.renditions {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return renditionSize{}, false
+}
+
+// snapRenditionWidth returns the smallest size at least w wide, or the largest size
+func (a *App) snapRenditionWidth(w int) renditionSize {
+	for _, s := range a.renditions {
+		if s.Width >= w {
+			return s
+		}
+	}
+	return a.renditions[len(a.renditions)-1]
+}
+
+// parseRenditionRequest reads ?size= or ?w= from the query. ok is false when neither is set.
+func (a *App) parseRenditionRequest(r *http.Request) (size renditionSize, ok bool, err error) {
+	q := r.URL.Query()
+	if name := q.Get("size"); name != "" {
+		size, ok = a.findRenditionSize(name)
+		if !ok {
+			return size, false, invalidField("size", fmt.Sprintf("invalid size %q: use tile, page, full or print", name))
+		}
+		return size, true, nil
+	}
+	if v := q.Get("w"); v != "" {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 1 {
+			return size, false, invalidField("w", fmt.Sprintf("invalid width %q", v))
+		}
+		return a.snapRenditionWidth(w), true, nil
+	}
+	return size, false, nil
+}
+
+// handleGetRenditions lists the widths and formats photos are served in, so clients can build
+// srcset lists without hard-coding the configured widths
+func (a *App) handleGetRenditions(w http.ResponseWriter, r *http.Request) {
+	response := RenditionsResponse{Formats: renditionFormats()}
+	for _, size := range a.renditions {
+		response.Sizes = append(response.Sizes, RenditionInfo{Name: size.Name, Width: size.Width})
+	}
+	SendJSON(w, response)
+}
+
+// renditionFormats lists the content types this build can serve renditions in
+func renditionFormats() []string {
+	types := make([]string, len(renditionEncoders))
+	for i, enc := range renditionEncoders {
+		types[i] = enc.ContentType
+	}
+	return types
+}
+
+// negotiateEncoder picks the preferred output format the client accepts
+func negotiateEncoder(r *http.Request) renditionEncoder {
+	accepted := parseAccept(r.Header.Get("Accept"))
+	for _, enc := range renditionEncoders {
+		if accepted[enc.ContentType] {
+			return enc
+		}
+	}
+	return renditionEncoders[len(renditionEncoders)-1]
+}
+
+// parseAccept returns the media types an Accept header allows, ignoring wildcards
+// and anything with q=0
+func parseAccept(header string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil || strings.Contains(mediaType, "*") {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		accepted[mediaType] = true
+	}
+	return accepted
+}
+
+// renditionKey is the storage key a rendition is cached under
+func renditionKey(photoID string, size renditionSize, enc renditionEncoder) string {
+	return photoID + "_" + size.Name + enc.Ext
+}
+
+// photoRenditionKeys lists every file that may be stored next to a photo's original: the
+// thumbnail, the JPEG served in place of HEIC, the resized renditions and the copy without metadata
+func (a *App) photoRenditionKeys(photoID string) []string {
+	keys := []string{photoID + "_thumb.jpg", displayRenditionKey(photoID)}
+	for _, size := range a.renditions {
+		for _, enc := range renditionEncoders {
+			keys = append(keys, renditionKey(photoID, size, enc))
+		}
+	}
+	for _, format := range imageFormats {
+		keys = append(keys, publicRenditionKey(photoID, format))
+	}
+	return keys
+}
+
+// photoRendition returns the storage key to serve for a photo at the given size, creating
+// and caching the rendition on first use. Photos no wider than the size are served as the
+// original when browsers can display it, since resizing would only upscale.
+func (a *App) photoRendition(ctx context.Context, photo catalogEntry, size renditionSize, enc renditionEncoder) (string, error) {
+	format, _ := formatForKey(photo.Key)
+	if photo.Width > 0 && photo.Width <= size.Width && browserSafe(format) {
+		return photo.Key, nil
+	}
+
+	key := renditionKey(photo.ID, size, enc)
+	if _, err := a.store.Stat(ctx, key); err == nil {
+		return key, nil
+	}
+
+	done := a.renditionWork.calls.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), renditionTimeout)
+		defer cancel()
+
+		// A request that was creating it when this one checked may have finished since
+		if _, err := a.store.Stat(ctx, key); err == nil {
+			return nil, nil
+		}
+		if err := a.renditionWork.slots.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer a.renditionWork.slots.Release(1)
+		return nil, a.createRendition(ctx, photo, key, size, enc)
+	})
+	select {
+	case res := <-done:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return key, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// createRendition decodes a photo's original and stores it resized and encoded under key
+func (a *App) createRendition(ctx context.Context, photo catalogEntry, key string, size renditionSize, enc renditionEncoder) error {
+	rc, _, err := a.store.Get(ctx, photo.Key)
+	if err != nil {
+		return fmt.Errorf("failed to open original: %w", err)
+	}
+	src, err := imaging.Decode(rc, imaging.AutoOrientation(true))
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode original: %w", err)
+	}
+
+	img := src
+	if src.Bounds().Dx() > size.Width {
+		img = imaging.Resize(src, size.Width, 0, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := enc.encode(&buf, img, size.Quality); err != nil {
+		return fmt.Errorf("failed to encode rendition: %w", err)
+	}
+	if err := putBlob(ctx, a.store, key, buf.Bytes(), enc.ContentType); err != nil {
+		return fmt.Errorf("failed to store rendition: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapRenditionWidth(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	for w, want := range map[int]string{1: "tile", 400: "tile", 401: "page", 1200: "page", 2000: "full", 3600: "print", 10000: "print"} {
+		if got := a.snapRenditionWidth(w).Name; got != want {
+			t.Errorf("snapRenditionWidth(%d) = %s; want %s", w, got, want)
+		}
+	}
+
+	for query, want := range map[string]string{"?w=640": "page", "?size=full": "full"} {
+		size, ok, err := a.parseRenditionRequest(httptest.NewRequest("GET", "/uploads/p.jpg"+query, nil))
+		if err != nil || !ok || size.Name != want {
+			t.Errorf("%s = %s, %v, %v; want %s", query, size.Name, ok, err, want)
+		}
+	}
+	for _, query := range []string{"?w=0", "?w=wide", "?size=huge"} {
+		if _, _, err := a.parseRenditionRequest(httptest.NewRequest("GET", "/uploads/p.jpg"+query, nil)); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+}
+
+func TestNegotiateEncoder(t *testing.T) {
+	jpeg := renditionEncoders[len(renditionEncoders)-1]
+	webp := renditionEncoder{ContentType: "image/webp", Ext: ".webp", encode: jpeg.encode}
+	defer func(encoders []renditionEncoder) { renditionEncoders = encoders }(renditionEncoders)
+	renditionEncoders = []renditionEncoder{webp, jpeg}
+
+	for accept, want := range map[string]string{
+		"":                                "image/jpeg",
+		"image/avif,image/webp,*/*;q=0.8": "image/webp",
+		"image/webp;q=0, image/jpeg":      "image/jpeg",
+		"image/*":                         "image/jpeg",
+		"text/html, image/webp;q=0.5":     "image/webp",
+		"image/avif":                      "image/jpeg",
+	} {
+		req := httptest.NewRequest("GET", "/uploads/p.jpg", nil)
+		req.Header.Set("Accept", accept)
+		if got := negotiateEncoder(req).ContentType; got != want {
+			t.Errorf("Accept %q = %s; want %s", accept, got, want)
+		}
+	}
+}
+
+// countingStore counts how often each object is opened
+type countingStore struct {
+	BlobStore
+	mu   sync.Mutex
+	gets map[string]int
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	s.mu.Lock()
+	s.gets[key]++
+	s.mu.Unlock()
+	return s.BlobStore.Get(ctx, key)
+}
+
+func TestConcurrentRenditionRequestsDecodeOnce(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	store := &countingStore{BlobStore: a.store, gets: make(map[string]int)}
+	a.store = store
+
+	a.renditions = renditionSizes(RenditionWidths{Tile: 2, Page: 4, Full: 6, Print: 8})
+	putTestBlob(t, a, "p.png", string(testPNG(t, 1)))
+	photo := catalogEntry{Photo: Photo{ID: "p", Width: 8, Height: 6}, Key: "p.png"}
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := a.photoRendition(t.Context(), photo, a.renditions[0], renditionEncoders[len(renditionEncoders)-1])
+			if err != nil || key != "p_tile.jpg" {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed.Load() > 0 {
+		t.Errorf("%d request(s) didn't get the rendition", failed.Load())
+	}
+	if n := store.gets["p.png"]; n != 1 {
+		t.Errorf("original decoded %d times; want once", n)
+	}
+}
+
+func TestRenditionOutlivesFirstRequest(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	a.renditions = renditionSizes(RenditionWidths{Tile: 2, Page: 4, Full: 6, Print: 8})
+	putTestBlob(t, a, "p.png", string(testPNG(t, 1)))
+	photo := catalogEntry{Photo: Photo{ID: "p", Width: 8, Height: 6}, Key: "p.png"}
+	enc := renditionEncoders[len(renditionEncoders)-1]
+
+	// Hold every decode slot so both requests wait on the same shared work
+	if err := a.renditionWork.slots.Acquire(t.Context(), maxConcurrentRenditions); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	first := make(chan error, 1)
+	go func() {
+		_, err := a.photoRendition(ctx, photo, a.renditions[0], enc)
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		_, err := a.photoRendition(t.Context(), photo, a.renditions[0], enc)
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled request = %v; want context.Canceled", err)
+	}
+	a.renditionWork.slots.Release(maxConcurrentRenditions)
+	if err := <-second; err != nil {
+		t.Errorf("request sharing the canceled one's work = %v; want the rendition", err)
+	}
+}
+
+func TestGetRenditions(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+	rec := httptest.NewRecorder()
+	a.newRouter().ServeHTTP(rec, httptest.NewRequest("GET", apiPrefix+"/renditions", nil))
+
+	var response RenditionsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("renditions = %d %s", rec.Code, rec.Body)
+	}
+	var widths []int
+	for _, size := range response.Sizes {
+		widths = append(widths, size.Width)
+	}
+	if !slices.Equal(widths, []int{400, 1200, 2048, 3600}) {
+		t.Errorf("widths = %v; want the configured ones", widths)
+	}
+	if !slices.Equal(response.Formats, renditionFormats()) || response.Formats[len(response.Formats)-1] != "image/jpeg" {
+		t.Errorf("formats = %v; want this build's, ending with JPEG", response.Formats)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build cgo && libwebp
+
+package main
+
+/*
+#cgo pkg-config: libwebp
+#include <webp/encode.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"io"
+	"unsafe"
+
+	"github.com/disintegration/imaging"
+)
+
+// Built with -tags libwebp, renditions are also offered as lossy WebP, which browsers that
+// accept it get in place of the larger JPEG
+func init() {
+	webp := renditionEncoder{ContentType: "image/webp", Ext: ".webp", encode: encodeWebP}
+	renditionEncoders = append([]renditionEncoder{webp}, renditionEncoders...)
+}
+
+// encodeWebP writes img as a lossy WebP using libwebp's simple encoding API
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	// WebPEncodeRGBA takes non-premultiplied 8-bit RGBA, which is what imaging works in
+	src := imaging.Clone(img)
+	b := src.Bounds()
+	if b.Empty() {
+		return errors.New("webp: empty image")
+	}
+
+	var out *C.uint8_t
+	n := C.WebPEncodeRGBA((*C.uint8_t)(unsafe.Pointer(&src.Pix[0])), C.int(b.Dx()), C.int(b.Dy()),
+		C.int(src.Stride), C.float(quality), &out)
+	if n == 0 {
+		return errors.New("webp: libwebp failed to encode the image")
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+
+	_, err := w.Write(unsafe.Slice((*byte)(unsafe.Pointer(out)), int(n)))
+	return err
+}
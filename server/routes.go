@@ -0,0 +1,191 @@
+package main
+
+import "net/http"
+
+const (
+	// apiPrefix is where the current version of the API is served
+	apiPrefix = "/api/v1"
+	// legacyAPIPrefix serves the same routes for clients written before the API was versioned
+	legacyAPIPrefix = "/api"
+)
+
+// middleware wraps a handler with behavior shared by several routes
+type middleware func(http.Handler) http.Handler
+
+// chain applies middleware to a handler; the first one listed runs first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// route is an API endpoint. The same table registers the handlers and generates the OpenAPI
+// document, so the published spec can't list routes the server doesn't have.
+type route struct {
+	Method       string
+	Path         string // Relative to the API prefix, e.g. /drafts/{id}
+	Handler      http.HandlerFunc
+	Middleware   []middleware
+	Summary      string
+	Query        []string // Query parameters the handler reads
+	Body         any      // Zero value of the JSON request body, nil when there is none
+	BodyType     string   // Media type of a non-JSON request body
+	Response     any      // Zero value of the JSON response body
+	Status       int      // Success status; 200 when unset
+	AlsoStatus   []int    // Other statuses answered with the same body, such as 207 when only some items succeeded
+	AdminOnly    bool     // Requires ADMIN_TOKEN as a bearer token
+	SignedInOnly bool     // Requires a Clerk session
+	UserScoped   bool     // Works on the caller's own photos and drafts; requires a Clerk session when sign-in is configured
+}
+
+// apiRoutes lists every endpoint served under the API prefix
+func (a *App) apiRoutes() []route {
+	return []route{
+		// Photos
+		{Method: "GET", Path: "/photos", Handler: a.HandleGetPhotos, Summary: "List your photos",
+			Response: []Photo{}, UserScoped: true},
+		{Method: "POST", Path: "/photos/upload", Handler: a.HandleUpload, Summary: "Upload photos",
+			BodyType: "multipart/form-data", Response: UploadResponse{}, AlsoStatus: []int{http.StatusMultiStatus}, UserScoped: true},
+		{Method: "POST", Path: "/photos/cluster", Handler: a.HandleClusterPhotos, Summary: "Group photos into page drafts",
+			Body: ClusterRequest{}, Response: ClusterResponse{}, UserScoped: true},
+		{Method: "POST", Path: "/photos/delete", Handler: a.handleDeletePhotos, Summary: "Move several photos to the trash",
+			Body: DeletePhotosRequest{}, Response: DeletePhotosResponse{}, AlsoStatus: []int{http.StatusMultiStatus}, UserScoped: true},
+		{Method: "GET", Path: "/photos/trash", Handler: a.handleListTrash, Summary: "List your photos in the trash",
+			Response: []TrashEntry{}, UserScoped: true},
+		{Method: "DELETE", Path: "/photos/{id}", Handler: a.handleDeletePhoto, Summary: "Move a photo to the trash",
+			Query: []string{"force"}, Response: PhotoDeleteResult{}, UserScoped: true},
+		{Method: "POST", Path: "/photos/{id}/restore", Handler: a.handleRestorePhoto, Summary: "Restore a photo from the trash",
+			Response: map[string]bool{}, UserScoped: true},
+		{Method: "GET", Path: "/renditions", Handler: a.handleGetRenditions, Summary: "List the sizes and formats photos are served in",
+			Response: RenditionsResponse{}},
+
+		// Resumable uploads. Chunk requests follow the tus protocol's headers: Upload-Offset must
+		// match the bytes received so far, and Upload-Checksum ("sha256 <base64 digest>") is
+		// verified if present. GET routes also answer HEAD, which is how clients find the offset.
+		{Method: "POST", Path: "/uploads", Handler: a.handleCreateUpload, Summary: "Start a resumable upload of one photo",
+			Body: CreateUploadRequest{}, Response: UploadSession{}, Status: http.StatusCreated, UserScoped: true},
+		{Method: "GET", Path: "/uploads/{id}", Handler: a.handleGetUpload, Summary: "Get the offset to resume an upload from",
+			Response: UploadSession{}, UserScoped: true},
+		{Method: "PATCH", Path: "/uploads/{id}", Handler: a.handleUploadChunk, Summary: "Append a chunk to an upload",
+			BodyType: "application/offset+octet-stream", Response: UploadSession{}, UserScoped: true},
+		{Method: "DELETE", Path: "/uploads/{id}", Handler: a.handleAbortUpload, Summary: "Abandon an upload",
+			Response: map[string]bool{}, UserScoped: true},
+		{Method: "POST", Path: "/uploads/{id}/finalize", Handler: a.handleFinalizeUpload, Summary: "Finish an upload and add the photo",
+			Response: UploadFileResult{}, Status: http.StatusCreated, AlsoStatus: []int{http.StatusOK}, UserScoped: true}, // 200 for a duplicate
+
+		// Page drafts
+		{Method: "GET", Path: "/drafts", Handler: a.handleListDrafts, Summary: "List drafts",
+			Query:    []string{"status", "theme", "book", "q", "from", "to", "sort", "order", "limit", "cursor"},
+			Response: DraftListResponse{}, UserScoped: true},
+		{Method: "POST", Path: "/drafts/merge", Handler: a.handleMergeDrafts, Summary: "Merge drafts into one",
+			Body: MergeDraftsRequest{}, Response: PageDraft{}, UserScoped: true},
+		{Method: "POST", Path: "/drafts/batch", Handler: a.handleBatchDrafts, Summary: "Apply several draft operations",
+			Body: BatchDraftsRequest{}, Response: BatchDraftsResponse{}, AlsoStatus: []int{http.StatusMultiStatus}, UserScoped: true},
+		{Method: "GET", Path: "/drafts/{id}", Handler: a.handleGetDraft, Summary: "Get a draft",
+			Response: PageDraft{}, UserScoped: true},
+		{Method: "PUT", Path: "/drafts/{id}", Handler: a.handleUpdateDraft, Summary: "Replace a draft",
+			Body: PageDraft{}, Response: PageDraft{}, UserScoped: true},
+		{Method: "DELETE", Path: "/drafts/{id}", Handler: a.handleDeleteDraft, Summary: "Delete a draft",
+			Response: map[string]bool{}, UserScoped: true},
+		{Method: "POST", Path: "/drafts/{id}/approve", Handler: a.handleApproveDraft, Summary: "Approve a draft as a page",
+			Response: PageDraft{}, UserScoped: true},
+		{Method: "PUT", Path: "/drafts/{id}/approve", Handler: a.handleApproveDraft, Summary: "Approve a draft as a page",
+			Response: PageDraft{}, UserScoped: true},
+		{Method: "PUT", Path: "/drafts/{id}/photos", Handler: a.handleReorderPhotos, Summary: "Reorder a draft's photos",
+			Body: ReorderPhotosRequest{}, Response: PageDraft{}, UserScoped: true},
+		{Method: "PUT", Path: "/drafts/{id}/cover", Handler: a.handleSetCover, Summary: "Choose a draft's cover photo",
+			Body: SetCoverRequest{}, Response: PageDraft{}, UserScoped: true},
+		{Method: "PUT", Path: "/drafts/{id}/layout", Handler: a.handleSetLayout, Summary: "Change a draft's layout",
+			Body: SetLayoutRequest{}, Response: PageDraft{}, UserScoped: true},
+		{Method: "POST", Path: "/drafts/{id}/split", Handler: a.handleSplitDraft, Summary: "Split photos off into a new draft",
+			Body: SplitDraftRequest{}, Response: SplitDraftResponse{}, UserScoped: true},
+		{Method: "POST", Path: "/drafts/{id}/photos/move", Handler: a.handleMovePhoto, Summary: "Move or copy a photo to another draft",
+			Body: MovePhotoRequest{}, Response: MovePhotoResponse{}, UserScoped: true},
+		{Method: "GET", Path: "/layouts", Handler: HandleGetLayouts, Summary: "List layout templates",
+			Response: []LayoutTemplate{}},
+
+		// Settings and administration
+		{Method: "GET", Path: "/settings", Handler: a.HandleGetSettings, Summary: "Get your settings",
+			Response: UserSettings{}, SignedInOnly: true},
+		{Method: "PUT", Path: "/settings", Handler: a.HandleUpdateSettings, Summary: "Change your settings",
+			Body: UserSettings{}, Response: UserSettings{}, SignedInOnly: true},
+		{Method: "GET", Path: "/admin/gc", Handler: a.HandleGCReport, Middleware: []middleware{a.requireAdmin},
+			Summary: "Report orphaned files", Response: GCReport{}, AdminOnly: true},
+		{Method: "POST", Path: "/admin/gc", Handler: a.HandleRunGC, Middleware: []middleware{a.requireAdmin},
+			Summary: "Delete orphaned files", Query: []string{"dryRun"}, Response: GCReport{}, AdminOnly: true},
+	}
+}
+
+// newRouter returns the handler for every route. Middleware shared by all routes, such as
+// CORS and session verification, wraps the router once; route-specific middleware is chained where the route is registered.
+func (a *App) newRouter() http.Handler {
+	mux := http.NewServeMux()
+
+	routes := a.apiRoutes()
+	for _, rt := range routes {
+		mws := rt.Middleware
+		if rt.UserScoped {
+			mws = append([]middleware{a.requireSession}, mws...)
+		}
+		h := chain(rt.Handler, mws...)
+		mux.Handle(rt.Method+" "+apiPrefix+rt.Path, h)
+		mux.Handle(rt.Method+" "+legacyAPIPrefix+rt.Path, h)
+	}
+	// Drafts used to be listed at /api/drafts/
+	mux.Handle("GET "+legacyAPIPrefix+"/drafts/{$}", a.requireSession(http.HandlerFunc(a.handleListDrafts)))
+
+	openAPI := HandleOpenAPI(routes)
+	mux.Handle("GET "+apiPrefix+"/openapi.json", openAPI)
+	mux.Handle("GET /openapi.json", openAPI)
+	mux.HandleFunc("GET /uploads/{path...}", a.HandleServePhoto)
+
+	return chain(withJSONRouteErrors(mux), RequestIDMiddleware, CorsMiddleware(a.cors), a.identifySession)
+}
+
+// withJSONRouteErrors answers requests no route matches with the usual JSON error body instead
+// of ServeMux's plain-text one: 405 with an Allow header when the path exists under other
+// methods, and 404 otherwise
+func withJSONRouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Let the mux decide between 404, 405 and a redirect to the canonical path, keeping the
+		// headers it sets (Allow, Location) but not its body
+		rec := &statusRecorder{header: w.Header()}
+		h.ServeHTTP(rec, r)
+		switch rec.status {
+		case http.StatusMethodNotAllowed:
+			SendError(w, codeMethodNotAllowed, "Method not allowed", http.StatusMethodNotAllowed)
+		case http.StatusNotFound:
+			SendError(w, codeRouteNotFound, "Not found", http.StatusNotFound)
+		default:
+			w.WriteHeader(rec.status)
+		}
+	})
+}
+
+// statusRecorder records the status a handler responds with and discards the body
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (s *statusRecorder) Header() http.Header { return s.header }
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
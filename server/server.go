@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// goJob runs work outside any request in the background. Jobs must return soon after ctx is
+// canceled, leaving what they did in a state the next run can continue from; shutdown waits
+// for them.
+func (a *App) goJob(ctx context.Context, job func(ctx context.Context)) {
+	a.jobs.Add(1)
+	go func() {
+		defer a.jobs.Done()
+		job(ctx)
+	}()
+}
+
+// newServer returns the HTTP server for the API. The timeouts close connections that send
+// their request too slowly or sit idle, so they can't tie up the server.
+func (a *App) newServer() *http.Server {
+	return &http.Server{
+		Addr:              a.cfg.Addr,
+		Handler:           a.newRouter(),
+		ReadHeaderTimeout: a.cfg.ReadHeaderTimeout,
+		ReadTimeout:       a.cfg.ReadTimeout,
+		WriteTimeout:      a.cfg.WriteTimeout,
+		IdleTimeout:       a.cfg.IdleTimeout,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+// serve handles requests until ctx is canceled, then stops accepting connections and waits up
+// to shutdownTimeout for requests in flight, such as uploads and clustering, and for background
+// jobs to stop. Requests still running after that are cut off.
+func (a *App) serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", a.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return a.serveOn(ctx, a.newServer(), ln)
+}
+
+// serveOn is serve with the server and the listener it accepts connections from
+func (a *App) serveOn(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	errc := make(chan error, 1)
+	go func() {
+		if a.cfg.TLSCertFile != "" {
+			log.Printf("Server starting on %s (HTTPS)", ln.Addr())
+			errc <- srv.ServeTLS(ln, a.cfg.TLSCertFile, a.cfg.TLSKeyFile)
+		} else {
+			log.Printf("Server starting on %s", ln.Addr())
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down; waiting up to %s for requests and background jobs", a.cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: cutting off requests still running: %v", err)
+		srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	jobsDone := make(chan struct{})
+	go func() {
+		a.jobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+	}
+	select {
+	case <-jobsDone:
+		log.Println("Server stopped")
+	default:
+		log.Printf("Warning: background jobs still running after %s", a.cfg.ShutdownTimeout)
+	}
+	return nil
+}
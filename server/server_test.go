@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServer serves handler on a local port until the returned cancel is called, and
+// reports what serve returned on the channel
+func startTestServer(t *testing.T, a *App, handler http.Handler) (url string, cancel context.CancelFunc, served <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := a.newServer()
+	srv.Handler = handler
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	go func() { errc <- a.serveOn(ctx, srv, ln) }()
+	return "http://" + ln.Addr().String(), cancel, errc
+}
+
+func TestServeWaitsForRequestsAndJobs(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = 5 * time.Second
+	a := newTestApp(t, cfg)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	url, cancel, served := startTestServer(t, a, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		response <- string(body)
+	}()
+	<-started
+
+	jobStopped := make(chan struct{})
+	a.goJob(t.Context(), func(ctx context.Context) {
+		<-release
+		close(jobStopped)
+	})
+
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v with a request and a job still running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return once the request and job finished")
+	}
+	if got := <-response; got != "done" {
+		t.Errorf("in-flight request got %q; want it to finish", got)
+	}
+	select {
+	case <-jobStopped:
+	default:
+		t.Error("serve returned before the background job stopped")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = 200 * time.Millisecond
+	a := newTestApp(t, cfg)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	url, cancel, served := startTestServer(t, a, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go http.Get(url)
+	<-started
+	a.goJob(t.Context(), func(ctx context.Context) { <-release }) // Ignores cancellation
+
+	begin := time.Now()
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept waiting past the shutdown timeout")
+	}
+	if waited := time.Since(begin); waited < cfg.ShutdownTimeout {
+		t.Errorf("serve returned after %s; want it to wait the %s timeout", waited, cfg.ShutdownTimeout)
+	}
+}
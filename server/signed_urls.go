@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// signedURLTTL is the shortest time a signed photo URL stays valid
+	signedURLTTL = 24 * time.Hour
+	// signedURLWindow is what expiry times are rounded up to, so the same photo gets the same
+	// URL (and the browser cache hit that goes with it) across page loads
+	signedURLWindow = 12 * time.Hour
+)
+
+// mediaPath is the path of a file served under /uploads/. Paths the server resolves are created
+// with uploadPath and signed whenever they are encoded to JSON, so clients can use them directly in
+// <img> tags and shared links. Paths decoded from a request, e.g. a draft sent back by the client,
+// lose their signature and are never signed again; they only identify a file. Records persisted
+// as JSON leave it out so links don't end up in storage.
+type mediaPath struct {
+	path   string
+	signer *urlSigner // Nil for paths that came from a client
+}
+
+// MarshalJSON encodes the path, with an expiring signature when the server resolved it
+func (p mediaPath) MarshalJSON() ([]byte, error) {
+	if p.signer == nil {
+		return json.Marshal(p.path)
+	}
+	return json.Marshal(p.signer.sign(p.path, time.Now()))
+}
+
+// UnmarshalJSON decodes a path, removing any signature
+func (p *mediaPath) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s, _, _ = strings.Cut(s, "?")
+	*p = mediaPath{path: s}
+	return nil
+}
+
+// IsZero reports whether the path is empty, for omitzero
+func (p mediaPath) IsZero() bool {
+	return p.path == ""
+}
+
+// String returns the unsigned path
+func (p mediaPath) String() string {
+	return p.path
+}
+
+// key returns the storage key of the file the path refers to
+func (p mediaPath) key() (string, bool) {
+	return strings.CutPrefix(p.path, "/uploads/")
+}
+
+// uploadPath is the signed path a stored file is served at
+func (a *App) uploadPath(key string) mediaPath {
+	return mediaPath{path: "/uploads/" + key, signer: a.signer}
+}
+
+// urlSigner signs and verifies photo URLs with an HMAC key
+type urlSigner struct {
+	key []byte
+}
+
+// newURLSigner returns a signer keyed by the photoUrlSecret setting. Without it a random key is
+// used, and links handed out stop working when the server restarts.
+func newURLSigner(secret string) *urlSigner {
+	if secret != "" {
+		return &urlSigner{key: []byte(secret)}
+	}
+	log.Println("Warning: PHOTO_URL_SECRET is not set; photo links will stop working when the server restarts")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &urlSigner{key: key}
+}
+
+// sign appends an expiry and signature to a path. Query parameters added after them,
+// such as ?w= for a rendition, are not covered, so one link works for every size.
+func (s *urlSigner) sign(path string, now time.Time) string {
+	if path == "" {
+		return ""
+	}
+	expires := now.Add(signedURLTTL).Truncate(signedURLWindow).Add(signedURLWindow).Unix()
+	return path + "?exp=" + strconv.FormatInt(expires, 10) + "&sig=" + s.signature(path, expires)
+}
+
+// signature is the URL-safe HMAC of a path and its expiry
+func (s *urlSigner) signature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature on a request for a signed path and returns when it expires.
+// ok is false when the signature is missing, wrong or expired.
+func (s *urlSigner) verify(r *http.Request) (expires time.Time, ok bool) {
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires = time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(s.signature(r.URL.Path, exp))) {
+		return time.Time{}, false
+	}
+	return expires, true
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrBlobNotFound is returned when a key does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored object
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// BlobStore stores photos, renditions and backgrounds by key.
+// Keys are slash-separated paths relative to the store root, e.g. "abc.jpg" or "backgrounds/bg_love_1234.png".
+// Objects are never linked to directly: clients get signed /uploads/ URLs, and HandleServePhoto
+// reads the object so it can remove metadata first.
+type BlobStore interface {
+	// Put writes an object, replacing any existing one. size may be -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens an object for reading. The reader also implements io.Seeker when the backend supports it.
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix, including those in nested "directories"
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// newBlobStore creates the store selected by the storageBackend setting ("local" or "s3")
+func newBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.StorageBackend {
+	case "local":
+		return NewLocalStore(cfg.UploadDir)
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// readBlob reads a whole object into memory
+func readBlob(ctx context.Context, store BlobStore, key string) ([]byte, error) {
+	rc, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// putBlob writes a byte slice as an object
+func putBlob(ctx context.Context, store BlobStore, key string, data []byte, contentType string) error {
+	return store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// moveBlob copies an object to a new key and deletes the original
+func moveBlob(ctx context.Context, store BlobStore, src, dst string) error {
+	rc, info, err := store.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	err = store.Put(ctx, dst, rc, info.Size, info.ContentType)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, src)
+}
+
+// contentTypeForKey guesses a MIME type from the key's extension
+func contentTypeForKey(key string) string {
+	if ct := mime.TypeByExtension(strings.ToLower(path.Ext(key))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// LocalStore keeps objects as files under a root directory
+type LocalStore struct {
+	dir *os.Root // Every file operation goes through the root so symlinks can't lead outside it
+}
+
+// NewLocalStore creates a store rooted at dir, creating it if needed
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage directory: %w", err)
+	}
+	return &LocalStore{dir: root}, nil
+}
+
+// name converts a key to a file name within the root, refusing keys that would escape it
+func (s *LocalStore) name(key string) (string, error) {
+	if key == "" || !fs.ValidPath(key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.FromSlash(key), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if err := s.dir.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so readers never see a partial object
+	tmpName := filepath.Join(dir, ".tmp-"+rand.Text())
+	tmp, err := s.dir.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		s.dir.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		s.dir.Remove(tmpName)
+		return err
+	}
+	if err := s.dir.Rename(tmpName, name); err != nil {
+		s.dir.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := s.dir.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	return f, s.info(key, info), nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := s.dir.Stat(name)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.IsDir()) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return s.info(key, info), nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	if err := s.dir.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Drop directories left empty, e.g. a restored trash entry
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if s.dir.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var infos []BlobInfo
+	err := fs.WalkDir(s.dir.FS(), ".", func(key string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Only walk directories that can hold keys with the prefix
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Removed while walking
+		}
+		infos = append(infos, s.info(key, info))
+		return nil
+	})
+	return infos, err
+}
+
+func (s *LocalStore) info(key string, fi fs.FileInfo) BlobInfo {
+	return BlobInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		ContentType: contentTypeForKey(key),
+	}
+}
+
+// S3Config holds connection settings for an S3-compatible service (AWS S3, MinIO, R2, ...)
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint" env:"S3_ENDPOINT" flag:"s3-endpoint" usage:"S3 host[:port]"` // e.g. "localhost:9000" for a local MinIO
+	Bucket          string `yaml:"bucket" env:"S3_BUCKET" flag:"s3-bucket" usage:"S3 bucket"`
+	AccessKeyID     string `yaml:"accessKeyId" env:"S3_ACCESS_KEY_ID" usage:"S3 access key ID"`
+	SecretAccessKey string `yaml:"secretAccessKey" env:"S3_SECRET_ACCESS_KEY" secret:"true" usage:"S3 secret access key"`
+	Region          string `yaml:"region" env:"S3_REGION" flag:"s3-region" usage:"S3 region"`
+	Prefix          string `yaml:"prefix" env:"S3_PREFIX" flag:"s3-prefix" usage:"Key prefix so several deployments can share a bucket"`
+	UseSSL          bool   `yaml:"useSsl" env:"S3_USE_SSL" flag:"s3-use-ssl" usage:"Connect to S3 over HTTPS"`
+}
+
+// S3Store keeps objects in an S3-compatible bucket
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Store connects to the bucket, creating it if it doesn't exist
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %w", cfg.Bucket, err)
+		}
+		log.Printf("Created bucket %s", cfg.Bucket)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Store{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+func (s *S3Store) objectName(key string) string {
+	return s.prefix + key
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if contentType == "" {
+		contentType = contentTypeForKey(key)
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.objectName(key), r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, s.mapError(err)
+	}
+	// GetObject is lazy; Stat performs the request and surfaces missing keys
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, BlobInfo{}, s.mapError(err)
+	}
+	return obj, s.info(key, stat), nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s.mapError(err)
+	}
+	return s.info(key, stat), nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var infos []BlobInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.objectName(prefix), Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		infos = append(infos, s.info(strings.TrimPrefix(obj.Key, s.prefix), obj))
+	}
+	return infos, nil
+}
+
+func (s *S3Store) info(key string, obj minio.ObjectInfo) BlobInfo {
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = contentTypeForKey(key)
+	}
+	return BlobInfo{
+		Key:         key,
+		Size:        obj.Size,
+		ModTime:     obj.LastModified,
+		ContentType: contentType,
+	}
+}
+
+// mapError converts S3 "not found" responses to ErrBlobNotFound
+func (s *S3Store) mapError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrBlobNotFound
+	}
+	return err
+}
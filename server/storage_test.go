@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobStores returns every store the conformance test runs against. The S3 store needs a
+// reachable service, e.g. a local MinIO, and only runs when TEST_S3_ENDPOINT is set.
+func testBlobStores(t *testing.T) map[string]BlobStore {
+	t.Helper()
+	local, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]BlobStore{"local": local}
+
+	if endpoint := os.Getenv("TEST_S3_ENDPOINT"); endpoint != "" {
+		s3, err := NewS3Store(S3Config{
+			Endpoint:        endpoint,
+			Bucket:          os.Getenv("TEST_S3_BUCKET"),
+			AccessKeyID:     os.Getenv("TEST_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("TEST_S3_SECRET_ACCESS_KEY"),
+			Region:          os.Getenv("TEST_S3_REGION"),
+			Prefix:          "conformance-" + rand.Text(), // Keep runs from seeing each other's objects
+			UseSSL:          os.Getenv("TEST_S3_USE_SSL") == "true",
+		})
+		if err != nil {
+			t.Fatalf("S3 store: %v", err)
+		}
+		stores["s3"] = s3
+	}
+	return stores
+}
+
+func TestBlobStoreConformance(t *testing.T) {
+	for name, store := range testBlobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := t.Context()
+			t.Cleanup(func() {
+				blobs, _ := store.List(context.Background(), "")
+				for _, blob := range blobs {
+					store.Delete(context.Background(), blob.Key)
+				}
+			})
+
+			content := []byte("not really a photo")
+			if err := store.Put(ctx, "a.jpg", bytes.NewReader(content), int64(len(content)), "image/jpeg"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if err := store.Put(ctx, "backgrounds/b.png", strings.NewReader("bg"), -1, ""); err != nil {
+				t.Fatalf("Put with unknown size: %v", err)
+			}
+
+			r, info, err := store.Get(ctx, "a.jpg")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("Get read %q, %v; want %q", got, err, content)
+			}
+			if info.Key != "a.jpg" || info.Size != int64(len(content)) || info.ContentType != "image/jpeg" {
+				t.Errorf("Get info = %+v", info)
+			}
+
+			info, err = store.Stat(ctx, "backgrounds/b.png")
+			if err != nil || info.Size != 2 || info.ContentType != "image/png" || time.Since(info.ModTime) > time.Hour {
+				t.Errorf("Stat = %+v, %v", info, err)
+			}
+
+			// Replacing an object leaves only the new content
+			if err := store.Put(ctx, "a.jpg", strings.NewReader("new"), 3, "image/jpeg"); err != nil {
+				t.Fatalf("Put over existing: %v", err)
+			}
+			if info, err := store.Stat(ctx, "a.jpg"); err != nil || info.Size != 3 {
+				t.Errorf("Stat after replace = %+v, %v", info, err)
+			}
+
+			for prefix, want := range map[string][]string{
+				"":             {"a.jpg", "backgrounds/b.png"},
+				"backgrounds/": {"backgrounds/b.png"},
+				"back":         {"backgrounds/b.png"},
+				"a":            {"a.jpg"},
+				"missing/":     nil,
+			} {
+				blobs, err := store.List(ctx, prefix)
+				if err != nil {
+					t.Fatalf("List(%q): %v", prefix, err)
+				}
+				var keys []string
+				for _, blob := range blobs {
+					keys = append(keys, blob.Key)
+				}
+				slices.Sort(keys)
+				if !slices.Equal(keys, want) {
+					t.Errorf("List(%q) = %v; want %v", prefix, keys, want)
+				}
+			}
+
+			if err := store.Delete(ctx, "backgrounds/b.png"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if err := store.Delete(ctx, "backgrounds/b.png"); err != nil {
+				t.Errorf("Delete of a missing key: %v", err)
+			}
+			if _, err := store.Stat(ctx, "backgrounds/b.png"); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("Stat after Delete: %v; want ErrBlobNotFound", err)
+			}
+			if _, _, err := store.Get(ctx, "missing.jpg"); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("Get of a missing key: %v; want ErrBlobNotFound", err)
+			}
+		})
+	}
+}
+
+func TestLocalStoreStaysInsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "uploads")
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := t.Context()
+
+	for _, key := range []string{"../outside.jpg", "/etc/outside.jpg", "a/../../outside.jpg", ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+
+	// A symlink planted in the store must not redirect writes outside it
+	if err := os.Symlink(parent, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "escape/outside.jpg", strings.NewReader("x"), 1, ""); err == nil {
+		t.Error("Put through a symlink out of the root succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "outside.jpg")); err == nil {
+		t.Error("file written outside the store")
+	}
+}
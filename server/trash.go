@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	trashDirName   = ".trash"
+	trashEntryFile = "entry.json"
+	trashRetention = 30 * 24 * time.Hour
+)
+
+var (
+	errPhotoNotFound  = errors.New("photo not found")
+	errPhotoApproved  = errors.New("photo is on an approved page")
+	errTrashNotFound  = errors.New("photo is not in the trash")
+	errTrashExpired   = errors.New("photo's trash retention has expired")
+	errPhotoIDInvalid = errors.New("invalid photo ID")
+	errPhotoNotYours  = errors.New("photo belongs to another user")
+	errPhotoBusy      = errors.New("photo is already being deleted or restored")
+	errPhotoUploaded  = errors.New("photo was uploaded again after it was deleted")
+)
+
+// trashPrefix returns the storage key prefix holding a trashed photo's files
+func trashPrefix(photoID string) string {
+	return trashDirName + "/" + photoID + "/"
+}
+
+// validPhotoID rejects IDs that could escape the upload directory
+func validPhotoID(photoID string) bool {
+	return photoID != "" && !strings.ContainsAny(photoID, `/\.`)
+}
+
+// photoFiles returns the keys of the original and every rendition stored for a photo
+func (a *App) photoFiles(ctx context.Context, photoID string) ([]string, error) {
+	blobs, err := a.store.List(ctx, photoID)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, blob := range blobs {
+		name := blob.Key
+		if strings.Contains(name, "/") {
+			continue
+		}
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if base == photoID || strings.HasPrefix(name, photoID+"_") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// trashPhoto moves a user's photo and its renditions to the trash and removes it from every draft.
+// Photos on approved pages are only deleted when force is set. It takes draftsMu only to read
+// and update the drafts, so moving the files doesn't hold up other draft operations.
+func (a *App) trashPhoto(ctx context.Context, user, photoID string, force bool) (PhotoDeleteResult, error) {
+	result := PhotoDeleteResult{PhotoID: photoID}
+
+	if !validPhotoID(photoID) {
+		return result, errPhotoIDInvalid
+	}
+	record, ok := a.catalog.Get(photoID)
+	if !ok {
+		return result, errPhotoNotFound
+	}
+	if !record.visibleTo(user) {
+		return result, errPhotoNotYours
+	}
+	if _, busy := a.trashing.LoadOrStore(photoID, true); busy {
+		return result, errPhotoBusy
+	}
+	defer a.trashing.Delete(photoID)
+
+	// Check for approved pages before touching anything
+	a.draftsMu.Lock()
+	_, result.AffectedDrafts, result.Warnings = a.photoDraftRefs(photoID)
+	a.draftsMu.Unlock()
+	if len(result.Warnings) > 0 && !force {
+		return result, errPhotoApproved
+	}
+
+	files, err := a.photoFiles(ctx, photoID)
+	if err != nil {
+		return result, fmt.Errorf("failed to list photo files: %w", err)
+	}
+
+	// Photo IDs come from the owner and content, so a photo uploaded again after it was deleted
+	// has the same ID as its trashed copy. The copy holds the same bytes and is replaced.
+	if old, err := a.readTrashEntry(ctx, photoID); err == nil {
+		if err := a.deleteTrashEntry(ctx, old); err != nil {
+			return result, fmt.Errorf("failed to replace trashed copy: %w", err)
+		}
+	}
+
+	prefix := trashPrefix(photoID)
+	var moved []string
+	for _, name := range files {
+		if err := moveBlob(ctx, a.store, name, prefix+name); err != nil {
+			// Put back what was already moved so the photo isn't left half deleted
+			for _, m := range moved {
+				moveBlob(ctx, a.store, prefix+m, m)
+			}
+			return result, fmt.Errorf("failed to move %s to trash: %w", name, err)
+		}
+		moved = append(moved, name)
+	}
+
+	// The drafts may have changed while the files moved, so the references are found again
+	a.draftsMu.Lock()
+	var refs []TrashDraftRef
+	refs, result.AffectedDrafts, result.Warnings = a.photoDraftRefs(photoID)
+	for _, ref := range refs {
+		d := a.drafts[ref.DraftID]
+		d.PhotoIds = append(d.PhotoIds[:ref.Position:ref.Position], d.PhotoIds[ref.Position+1:]...)
+		if ref.WasCover {
+			d.CoverPhotoID = ""
+		}
+		if len(d.PhotoIds) == 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Page %q has no photos left", d.Title))
+		}
+		a.refreshDraft(&d)
+		a.drafts[d.ID] = d
+	}
+	a.draftsMu.Unlock()
+
+	now := time.Now()
+	photo := record.Photo
+	photo.Path = mediaPath{} // Set again from the key on restore
+	entry := TrashEntry{
+		PhotoID:   photoID,
+		Files:     moved,
+		DraftRefs: refs,
+		Photo:     &photo,
+		Owner:     record.Owner,
+		DeletedAt: now,
+		ExpiresAt: now.Add(trashRetention),
+	}
+	if err := a.writeTrashEntry(ctx, entry); err != nil {
+		log.Printf("Warning: failed to record trash entry for %s: %v", photoID, err)
+	}
+	if err := a.catalog.Remove(ctx, photoID); err != nil {
+		log.Printf("Warning: failed to remove %s from catalog: %v", photoID, err)
+	}
+
+	result.Success = true
+	result.ExpiresAt = entry.ExpiresAt.Format(time.RFC3339)
+	log.Printf("Moved photo %s to trash (%d files, %d drafts)", photoID, len(moved), len(refs))
+	return result, nil
+}
+
+// photoDraftRefs finds every draft using a photo, with a warning for each approved page.
+// Callers must hold draftsMu.
+func (a *App) photoDraftRefs(photoID string) (refs []TrashDraftRef, draftIDs, warnings []string) {
+	for _, d := range a.drafts {
+		if pos := indexOf(d.PhotoIds, photoID); pos != -1 {
+			refs = append(refs, TrashDraftRef{DraftID: d.ID, Position: pos, WasCover: d.CoverPhotoID == photoID})
+			draftIDs = append(draftIDs, d.ID)
+			if d.Status == "approved" {
+				warnings = append(warnings, fmt.Sprintf("Photo was on approved page %q", d.Title))
+			}
+		}
+	}
+	sort.Strings(draftIDs)
+	return refs, draftIDs, warnings
+}
+
+// restorePhoto moves a user's photo back out of the trash and puts it back on the drafts that
+// still exist. Like trashPhoto, it only holds draftsMu while it updates the drafts.
+func (a *App) restorePhoto(ctx context.Context, user, photoID string) error {
+	if !validPhotoID(photoID) {
+		return errPhotoIDInvalid
+	}
+	if _, busy := a.trashing.LoadOrStore(photoID, true); busy {
+		return errPhotoBusy
+	}
+	defer a.trashing.Delete(photoID)
+
+	entry, err := a.readTrashEntry(ctx, photoID)
+	if err != nil {
+		return errTrashNotFound
+	}
+	if !entry.visibleTo(user) {
+		return errPhotoNotYours
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return errTrashExpired
+	}
+	// Restoring over a photo uploaded again since would overwrite its files
+	if _, live := a.catalog.Get(photoID); live {
+		return errPhotoUploaded
+	}
+
+	prefix := trashPrefix(photoID)
+	var restored []string
+	for _, name := range entry.Files {
+		if err := moveBlob(ctx, a.store, prefix+name, name); err != nil {
+			// Put back what was already restored so the trash entry stays whole
+			for _, r := range restored {
+				moveBlob(ctx, a.store, r, prefix+r)
+			}
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		restored = append(restored, name)
+	}
+	a.store.Delete(ctx, prefix+trashEntryFile)
+
+	if err := a.catalog.Add(ctx, a.trashedPhotoRecord(ctx, entry)); err != nil {
+		log.Printf("Warning: failed to add %s back to catalog: %v", photoID, err)
+	}
+
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+	for _, ref := range entry.DraftRefs {
+		d, ok := a.drafts[ref.DraftID]
+		if !ok || !d.visibleTo(user) || indexOf(d.PhotoIds, photoID) != -1 {
+			continue
+		}
+		pos := min(ref.Position, len(d.PhotoIds))
+		photoIds := make([]string, 0, len(d.PhotoIds)+1)
+		photoIds = append(photoIds, d.PhotoIds[:pos]...)
+		photoIds = append(photoIds, photoID)
+		photoIds = append(photoIds, d.PhotoIds[pos:]...)
+		d.PhotoIds = photoIds
+		if ref.WasCover && d.CoverPhotoID == "" {
+			d.CoverPhotoID = photoID
+		}
+		a.refreshDraft(&d)
+		a.drafts[d.ID] = d
+	}
+
+	log.Printf("Restored photo %s from trash", photoID)
+	return nil
+}
+
+// trashedPhotoRecord rebuilds the catalog record of a restored photo. Entries written before
+// the catalog existed don't carry one, so it is recomputed from the original.
+func (a *App) trashedPhotoRecord(ctx context.Context, entry TrashEntry) catalogEntry {
+	e := catalogEntry{Owner: entry.Owner}
+	for _, name := range entry.Files {
+		if strings.TrimSuffix(name, filepath.Ext(name)) == entry.PhotoID {
+			e.Key = name
+		}
+	}
+
+	if entry.Photo != nil {
+		e.Photo = *entry.Photo
+		e.Path = a.uploadPath(e.Key)
+		return e
+	}
+
+	e.Photo = Photo{
+		ID:         entry.PhotoID,
+		Filename:   e.Key,
+		Path:       a.uploadPath(e.Key),
+		UploadedAt: entry.DeletedAt,
+	}
+	if data, err := readBlob(ctx, a.store, e.Key); err == nil {
+		e.Size = int64(len(data))
+		describeImage(&e.Photo, data)
+	}
+	return e
+}
+
+// visibleTo reports whether a user may see and restore a trashed photo, as for catalogEntry.visibleTo
+func (e TrashEntry) visibleTo(user string) bool {
+	return e.Owner == user
+}
+
+// listTrash returns every trashed photo, most recently deleted first
+func (a *App) listTrash(ctx context.Context) ([]TrashEntry, error) {
+	blobs, err := a.store.List(ctx, trashDirName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []TrashEntry{}
+	for _, blob := range blobs {
+		if path.Base(blob.Key) != trashEntryFile {
+			continue
+		}
+		photoID := path.Base(path.Dir(blob.Key))
+		entry, err := a.readTrashEntry(ctx, photoID)
+		if err != nil {
+			log.Printf("Warning: unreadable trash entry %s: %v", photoID, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// purgeExpiredTrash permanently deletes trashed photos past their retention window
+func (a *App) purgeExpiredTrash(ctx context.Context) (int, error) {
+	entries, err := a.listTrash(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	now := time.Now()
+	for _, entry := range entries {
+		if now.Before(entry.ExpiresAt) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break // The rest are purged on the next start
+		}
+		if err := a.deleteTrashEntry(ctx, entry); err != nil {
+			log.Printf("Warning: failed to purge trashed photo %s: %v", entry.PhotoID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// deleteTrashEntry permanently removes a trashed photo's files and its entry
+func (a *App) deleteTrashEntry(ctx context.Context, entry TrashEntry) error {
+	prefix := trashPrefix(entry.PhotoID)
+	for _, name := range entry.Files {
+		if err := a.store.Delete(ctx, prefix+name); err != nil {
+			return err
+		}
+	}
+	return a.store.Delete(ctx, prefix+trashEntryFile)
+}
+
+func (a *App) writeTrashEntry(ctx context.Context, entry TrashEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return putBlob(ctx, a.store, trashPrefix(entry.PhotoID)+trashEntryFile, data, "application/json")
+}
+
+func (a *App) readTrashEntry(ctx context.Context, photoID string) (TrashEntry, error) {
+	var entry TrashEntry
+	data, err := readBlob(ctx, a.store, trashPrefix(photoID)+trashEntryFile)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// deleteProblem returns the status, error code and message a trash error is reported with
+func deleteProblem(err error) (status int, code, message string) {
+	switch {
+	case errors.Is(err, errPhotoNotFound):
+		return http.StatusNotFound, codePhotoNotFound, err.Error()
+	case errors.Is(err, errTrashNotFound):
+		return http.StatusNotFound, codeTrashNotFound, err.Error()
+	case errors.Is(err, errPhotoApproved):
+		return http.StatusConflict, codePhotoApproved, err.Error()
+	case errors.Is(err, errTrashExpired):
+		return http.StatusGone, codeTrashExpired, err.Error()
+	case errors.Is(err, errPhotoIDInvalid):
+		return http.StatusBadRequest, codeInvalidPhotoID, err.Error()
+	case errors.Is(err, errPhotoNotYours):
+		return http.StatusForbidden, codeForbidden, err.Error()
+	case errors.Is(err, errPhotoBusy):
+		return http.StatusConflict, codePhotoBusy, err.Error()
+	case errors.Is(err, errPhotoUploaded):
+		return http.StatusConflict, codePhotoUploaded, err.Error()
+	default:
+		log.Printf("Error moving photo to or from trash: %v", err)
+		return http.StatusInternalServerError, codeInternal, "Failed to move photo"
+	}
+}
+
+// sendDeleteError reports a trash error with its status and error code
+func sendDeleteError(w http.ResponseWriter, err error) {
+	status, code, message := deleteProblem(err)
+	SendError(w, code, message, status)
+}
+
+func (a *App) handleDeletePhoto(w http.ResponseWriter, r *http.Request) {
+	photoID := r.PathValue("id")
+	force := r.URL.Query().Get("force") == "1"
+
+	result, err := a.trashPhoto(r.Context(), a.requestUser(r), photoID, force)
+	if err != nil {
+		sendDeleteError(w, err)
+		return
+	}
+	SendJSON(w, result)
+}
+
+func (a *App) handleDeletePhotos(w http.ResponseWriter, r *http.Request) {
+	var req DeletePhotosRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.PhotoIds) == 0 {
+		sendValidationError(w, invalidField("photoIds", "No photo IDs provided"))
+		return
+	}
+
+	user := a.requestUser(r)
+	response := DeletePhotosResponse{Results: make([]PhotoDeleteResult, 0, len(req.PhotoIds))}
+	failed := 0
+	for _, photoID := range req.PhotoIds {
+		result, err := a.trashPhoto(r.Context(), user, photoID, req.Force)
+		if err != nil {
+			_, result.Code, result.Error = deleteProblem(err)
+			failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	if failed > 0 {
+		SendJSONStatus(w, response, http.StatusMultiStatus)
+		return
+	}
+	SendJSON(w, response)
+}
+
+func (a *App) handleRestorePhoto(w http.ResponseWriter, r *http.Request) {
+	photoID := r.PathValue("id")
+
+	if err := a.restorePhoto(r.Context(), a.requestUser(r), photoID); err != nil {
+		sendDeleteError(w, err)
+		return
+	}
+	SendJSON(w, map[string]bool{"success": true})
+}
+
+func (a *App) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	entries, err := a.listTrash(r.Context())
+	if err != nil {
+		SendError(w, codeInternal, "Failed to read trash", http.StatusInternalServerError)
+		return
+	}
+
+	user := a.requestUser(r)
+	visible := []TrashEntry{}
+	for _, entry := range entries {
+		if entry.visibleTo(user) {
+			visible = append(visible, entry)
+		}
+	}
+	SendJSON(w, visible)
+}
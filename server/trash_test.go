@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrashAndRestorePhoto(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	putTestBlob(t, a, "a1.png", "original")
+	putTestBlob(t, a, "a1_thumb.jpg", "thumbnail")
+	d := a.drafts["da1"]
+	d.CoverPhotoID = "a1"
+	a.drafts["da1"] = d
+
+	if rec := sendAs(t, router, sign, "user_bob", "DELETE", "/photos/a1", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("bob deleting alice's photo = %d; want 403", rec.Code)
+	}
+
+	rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+	if d := a.drafts["da1"]; indexOf(d.PhotoIds, "a1") != -1 || d.CoverPhotoID != "" {
+		t.Errorf("draft after delete: %+v; want a1 removed and no cover", d)
+	}
+	if _, ok := a.catalog.Get("a1"); ok {
+		t.Error("deleted photo still in the catalog")
+	}
+	for _, key := range []string{"a1.png", "a1_thumb.jpg"} {
+		if _, err := a.store.Stat(t.Context(), key); err == nil {
+			t.Errorf("%s still stored after delete", key)
+		}
+		if _, err := a.store.Stat(t.Context(), trashPrefix("a1")+key); err != nil {
+			t.Errorf("%s not in the trash: %v", key, err)
+		}
+	}
+
+	if rec := sendAs(t, router, sign, "user_bob", "GET", "/photos/trash", ""); strings.Contains(rec.Body.String(), "a1") {
+		t.Errorf("bob's trash lists alice's photo: %s", rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "GET", "/photos/trash", ""); !strings.Contains(rec.Body.String(), `"photoId":"a1"`) {
+		t.Errorf("alice's trash: %s; want a1", rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_bob", "POST", "/photos/a1/restore", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("bob restoring alice's photo = %d; want 403", rec.Code)
+	}
+
+	if rec := sendAs(t, router, sign, "user_alice", "POST", "/photos/a1/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("restore = %d %s", rec.Code, rec.Body)
+	}
+	if d := a.drafts["da1"]; len(d.PhotoIds) != 2 || d.PhotoIds[0] != "a1" || d.CoverPhotoID != "a1" {
+		t.Errorf("draft after restore: %+v; want a1 back first and as the cover", d)
+	}
+	if e, ok := a.catalog.Get("a1"); !ok || e.Owner != "user_alice" {
+		t.Errorf("catalog after restore: %+v, %v; want alice's photo", e, ok)
+	}
+	if _, err := a.store.Stat(t.Context(), "a1.png"); err != nil {
+		t.Errorf("original after restore: %v", err)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "POST", "/photos/a1/restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("restoring twice = %d; want 404", rec.Code)
+	}
+}
+
+func TestTrashKeepsPhotosOnApprovedPages(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	putTestBlob(t, a, "a3.png", "original")
+	d := a.drafts["da2"]
+	d.Status = "approved"
+	a.drafts["da2"] = d
+
+	if rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a3", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("delete from an approved page = %d %s; want 409", rec.Code, rec.Body)
+	}
+	if _, err := a.store.Stat(t.Context(), "a3.png"); err != nil {
+		t.Errorf("refused delete moved the original: %v", err)
+	}
+
+	rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a3?force=1", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "has no photos left") {
+		t.Errorf("forced delete = %d %s; want it done with a warning about the empty page", rec.Code, rec.Body)
+	}
+}
+
+func TestRestoreRefusesPhotoUploadedAgain(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	putTestBlob(t, a, "a1.png", "original")
+	if rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+
+	// The same file uploaded again gets the same ID
+	putTestBlob(t, a, "a1.png", "uploaded again")
+	if err := a.catalog.Add(t.Context(), catalogEntry{Photo: Photo{ID: "a1", Filename: "a1.png"}, Key: "a1.png", Owner: "user_alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "POST", "/photos/a1/restore", ""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), codePhotoUploaded) {
+		t.Errorf("restore over the live photo = %d %s; want 409 %s", rec.Code, rec.Body, codePhotoUploaded)
+	}
+	if data, err := readBlob(t.Context(), a.store, "a1.png"); err != nil || string(data) != "uploaded again" {
+		t.Errorf("live original = %q, %v; want it untouched", data, err)
+	}
+
+	// Deleting it again replaces the trashed copy
+	if rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("second delete = %d %s", rec.Code, rec.Body)
+	}
+	if data, err := readBlob(t.Context(), a.store, trashPrefix("a1")+"a1.png"); err != nil || string(data) != "uploaded again" {
+		t.Errorf("trashed copy = %q, %v; want the latest upload", data, err)
+	}
+}
+
+func TestRestoreRollsBackPartialMove(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+	putTestBlob(t, a, "a1.png", "original")
+	putTestBlob(t, a, "a1_thumb.jpg", "thumbnail")
+	if rec := sendAs(t, router, sign, "user_alice", "DELETE", "/photos/a1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+	if err := a.store.Delete(t.Context(), trashPrefix("a1")+"a1_thumb.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := sendAs(t, router, sign, "user_alice", "POST", "/photos/a1/restore", "")
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "a1_thumb") {
+		t.Errorf("failed restore = %d %s; want 500 without internal details", rec.Code, rec.Body)
+	}
+	if _, err := a.store.Stat(t.Context(), "a1.png"); err == nil {
+		t.Error("original restored although the restore failed")
+	}
+	if _, err := a.store.Stat(t.Context(), trashPrefix("a1")+"a1.png"); err != nil {
+		t.Errorf("original not put back in the trash: %v", err)
+	}
+	if _, ok := a.catalog.Get("a1"); ok {
+		t.Error("failed restore added the photo to the catalog")
+	}
+}
+
+func TestDeletePhotosReportsEachFailure(t *testing.T) {
+	a, sign := draftTestApp(t)
+	putTestBlob(t, a, "a1.png", "original")
+
+	rec := sendAs(t, a.newRouter(), sign, "user_alice", "POST", "/photos/delete", `{"photoIds":["a1","b1","missing"]}`)
+	var response DeletePhotosResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusMultiStatus {
+		t.Fatalf("delete = %d %s; want 207", rec.Code, rec.Body)
+	}
+	want := []struct {
+		success bool
+		code    string
+	}{{true, ""}, {false, codeForbidden}, {false, codePhotoNotFound}}
+	if len(response.Results) != len(want) {
+		t.Fatalf("results = %+v; want one per photo", response.Results)
+	}
+	for i, w := range want {
+		if got := response.Results[i]; got.Success != w.success || got.Code != w.code || (w.code != "" && got.Error == "") {
+			t.Errorf("result %d = %+v; want success %v, code %q", i, got, w.success, w.code)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// In-progress resumable uploads are kept in the uploadSessionDir setting. Chunks are appended
+// to a local file whatever the storage backend, since object stores can't append.
+const (
+	uploadSessionTTL = 24 * time.Hour
+
+	// statusChecksumMismatch is the tus protocol's status for a chunk that failed its checksum
+	statusChecksumMismatch = 460
+)
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadExpired  = errors.New("upload has expired")
+	errUploadNotYours = errors.New("upload was started by another user")
+)
+
+// uploadLocks serializes the requests that change a session. A session's lock is dropped when
+// the last request holding or waiting for it lets go, so a request can never be handed a fresh
+// lock while another still holds the old one.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	refs int // Requests holding or waiting for the lock; guarded by uploadLocks.mu
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locks: make(map[string]*uploadLock)}
+}
+
+// lock waits for a session's lock and returns the function that releases it
+func (u *uploadLocks) lock(id string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		u.locks[id] = l
+	}
+	l.refs++
+	u.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		u.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(u.locks, id)
+		}
+		u.mu.Unlock()
+	}
+}
+
+// uploadSessionPaths returns the metadata and data files for a session
+func (a *App) uploadSessionPaths(id string) (meta, data string) {
+	base := filepath.Join(a.cfg.UploadSessionDir, id)
+	return base + ".json", base + ".part"
+}
+
+// loadUploadSession reads a session, refusing IDs that aren't UUIDs so they can't escape the directory
+func (a *App) loadUploadSession(id string) (UploadSession, error) {
+	var session UploadSession
+	if _, err := uuid.Parse(id); err != nil {
+		return session, errUploadNotFound
+	}
+
+	metaPath, _ := a.uploadSessionPaths(id)
+	data, err := os.ReadFile(metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return session, errUploadNotFound
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		return session, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return session, errUploadExpired
+	}
+	return session, nil
+}
+
+// loadOwnUploadSession reads a session for a request, refusing sessions another user started.
+// An expired session is returned along with errUploadExpired so it can still be aborted.
+func (a *App) loadOwnUploadSession(r *http.Request, id string) (UploadSession, error) {
+	session, err := a.loadUploadSession(id)
+	if err != nil && !errors.Is(err, errUploadExpired) {
+		return session, err
+	}
+	if session.Owner != a.requestUser(r) {
+		return session, errUploadNotYours
+	}
+	return session, err
+}
+
+// saveUploadSession writes a session's metadata atomically
+func (a *App) saveUploadSession(session UploadSession) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	metaPath, _ := a.uploadSessionPaths(session.ID)
+	tmp := metaPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath)
+}
+
+// removeUploadSession deletes a session's files. Callers must hold the session's lock,
+// unless no one else can know its ID yet.
+func (a *App) removeUploadSession(id string) {
+	metaPath, dataPath := a.uploadSessionPaths(id)
+	os.Remove(dataPath)
+	os.Remove(metaPath)
+}
+
+// removeExpiredUploadSession deletes a session if it is still expired once no request is using it;
+// a chunk may have arrived and extended it since it was found
+func (a *App) removeExpiredUploadSession(id string) {
+	unlock := a.uploadLocks.lock(id)
+	defer unlock()
+	if _, err := a.loadUploadSession(id); errors.Is(err, errUploadExpired) {
+		a.removeUploadSession(id)
+	}
+}
+
+// expiredUploadSessions returns the sessions past their expiry
+func (a *App) expiredUploadSessions() ([]UploadSession, error) {
+	files, err := os.ReadDir(a.cfg.UploadSessionDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []UploadSession
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		session, err := a.loadUploadSession(id)
+		if errors.Is(err, errUploadExpired) {
+			expired = append(expired, session)
+		}
+	}
+	return expired, nil
+}
+
+// sendUploadError reports a session error with its status and error code
+func sendUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		SendError(w, codeUploadNotFound, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errUploadExpired):
+		SendError(w, codeUploadExpired, err.Error(), http.StatusGone)
+	case errors.Is(err, errUploadNotYours):
+		SendError(w, codeForbidden, err.Error(), http.StatusForbidden)
+	default:
+		SendError(w, codeInternal, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *App) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req CreateUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Filename == "" {
+		sendValidationError(w, invalidField("filename", "filename is required"))
+		return
+	}
+	if req.Size <= 0 {
+		sendValidationError(w, invalidField("size", "size must be positive"))
+		return
+	}
+	if req.Size > int64(a.cfg.MaxFileSize) {
+		SendError(w, codeRequestTooLarge, fmt.Sprintf("File is %d bytes; the maximum is %d", req.Size, a.cfg.MaxFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.SHA256 != "" {
+		if sum, err := hex.DecodeString(req.SHA256); err != nil || len(sum) != sha256.Size {
+			sendValidationError(w, invalidField("sha256", "sha256 must be a hex SHA-256 digest"))
+			return
+		}
+	}
+
+	if err := os.MkdirAll(a.cfg.UploadSessionDir, 0755); err != nil {
+		log.Printf("Error creating upload session directory: %v", err)
+		SendError(w, codeInternal, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	session := UploadSession{
+		ID:        uuid.New().String(),
+		Filename:  filepath.Base(req.Filename),
+		Size:      req.Size,
+		SHA256:    strings.ToLower(req.SHA256),
+		Owner:     a.requestUser(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(uploadSessionTTL),
+	}
+
+	_, dataPath := a.uploadSessionPaths(session.ID)
+	if err := os.WriteFile(dataPath, nil, 0644); err != nil {
+		log.Printf("Error creating upload file: %v", err)
+		SendError(w, codeInternal, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := a.saveUploadSession(session); err != nil {
+		a.removeUploadSession(session.ID)
+		log.Printf("Error saving upload session: %v", err)
+		SendError(w, codeInternal, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", apiPrefix+"/uploads/"+session.ID)
+	SendJSONStatus(w, session, http.StatusCreated)
+}
+
+func (a *App) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	session, err := a.loadOwnUploadSession(r, id)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	SendJSON(w, session)
+}
+
+func (a *App) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	unlock := a.uploadLocks.lock(id)
+	defer unlock()
+
+	session, err := a.loadOwnUploadSession(r, id)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		sendValidationError(w, invalidField("Upload-Offset", "Upload-Offset header is required"))
+		return
+	}
+	if offset != session.Offset {
+		// The client lost track, e.g. after a dropped response; it should HEAD and resume
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		SendError(w, codeOffsetMismatch, fmt.Sprintf("Upload-Offset %d does not match the %d bytes received", offset, session.Offset), http.StatusConflict)
+		return
+	}
+
+	var wantSum []byte
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		algo, digest, _ := strings.Cut(v, " ")
+		if algo != "sha256" {
+			sendValidationError(w, invalidField("Upload-Checksum", "Upload-Checksum must use sha256"))
+			return
+		}
+		if wantSum, err = base64.StdEncoding.DecodeString(digest); err != nil || len(wantSum) != sha256.Size {
+			sendValidationError(w, invalidField("Upload-Checksum", "Upload-Checksum digest must be base64"))
+			return
+		}
+	}
+
+	_, dataPath := a.uploadSessionPaths(id)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY, 0)
+	if err != nil {
+		log.Printf("Error opening upload %s: %v", id, err)
+		SendError(w, codeInternal, "Failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Read one byte past the remaining length to detect chunks that overrun the declared size
+	remaining := session.Size - session.Offset
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(f, offset), hash), io.LimitReader(r.Body, remaining+1))
+
+	// Anything short of a complete, verified chunk is discarded so the offset stays trustworthy
+	discard := func() { f.Truncate(offset) }
+	if err != nil {
+		discard()
+		log.Printf("Error receiving chunk for upload %s: %v", id, err)
+		SendError(w, codeInvalidBody, "Failed to receive chunk", http.StatusBadRequest)
+		return
+	}
+	if n > remaining {
+		discard()
+		SendError(w, codeRequestTooLarge, fmt.Sprintf("Chunk overruns the declared size of %d bytes", session.Size), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if wantSum != nil && !bytes.Equal(hash.Sum(nil), wantSum) {
+		discard()
+		SendError(w, codeChecksumMismatch, "Chunk checksum mismatch", statusChecksumMismatch)
+		return
+	}
+
+	session.Offset += n
+	session.ExpiresAt = time.Now().Add(uploadSessionTTL)
+	if err := a.saveUploadSession(session); err != nil {
+		discard()
+		log.Printf("Error saving upload session %s: %v", id, err)
+		SendError(w, codeInternal, "Failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	SendJSON(w, session)
+}
+
+func (a *App) handleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	unlock := a.uploadLocks.lock(id)
+	defer unlock()
+
+	session, err := a.loadOwnUploadSession(r, id)
+	if err != nil {
+		sendUploadError(w, err)
+		return
+	}
+	if session.Offset != session.Size {
+		SendError(w, codeUploadIncomplete, fmt.Sprintf("Upload is incomplete: %d of %d bytes received", session.Offset, session.Size), http.StatusConflict)
+		return
+	}
+
+	_, dataPath := a.uploadSessionPaths(id)
+	f, err := os.Open(dataPath)
+	if err != nil {
+		log.Printf("Error reading upload %s: %v", id, err)
+		SendError(w, codeInternal, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		f.Close()
+		log.Printf("Error reading upload %s: %v", id, err)
+		SendError(w, codeInternal, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if session.SHA256 != "" && sum != session.SHA256 {
+		// Keep nothing: the client has to start over since we can't tell which chunk was bad
+		f.Close()
+		a.removeUploadSession(id)
+		SendError(w, codeChecksumMismatch, "File checksum mismatch", statusChecksumMismatch)
+		return
+	}
+
+	result := a.ingestUpload(r.Context(), a.requestUser(r), session.Filename, f, session.Size, sum)
+	f.Close()
+	a.removeUploadSession(id)
+
+	switch result.Status {
+	case "rejected":
+		SendProblem(w, ErrorResponse{
+			Status: http.StatusUnprocessableEntity,
+			Code:   codeUploadRejected,
+			Detail: result.Reason,
+			Errors: rejectedFiles([]UploadFileResult{result}),
+		})
+	case "duplicate":
+		SendJSON(w, result)
+	default:
+		SendJSONStatus(w, result, http.StatusCreated)
+	}
+}
+
+func (a *App) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	unlock := a.uploadLocks.lock(id)
+	defer unlock()
+
+	if _, err := a.loadOwnUploadSession(r, id); err != nil && !errors.Is(err, errUploadExpired) {
+		sendUploadError(w, err)
+		return
+	}
+	a.removeUploadSession(id)
+	SendJSON(w, map[string]bool{"success": true})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploadTestClient sends resumable upload requests through the router as a signed-in user
+type uploadTestClient struct {
+	t      *testing.T
+	router http.Handler
+	sign   func(user string) string
+}
+
+func newUploadTestClient(t *testing.T) (*App, *uploadTestClient) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.ClerkJWKSURL = "http://jwks.invalid/jwks.json"
+	a := newTestApp(t, cfg)
+	return a, &uploadTestClient{t: t, router: a.newRouter(), sign: useTestSessionKey(t, a)}
+}
+
+func (c *uploadTestClient) send(user, method, path string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, apiPrefix+path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+c.sign(user))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	c.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// create starts an upload of data, declaring its whole-file hash when sum is set
+func (c *uploadTestClient) create(user string, data []byte, sum string) UploadSession {
+	c.t.Helper()
+	body, _ := json.Marshal(CreateUploadRequest{Filename: "photo.png", Size: int64(len(data)), SHA256: sum})
+	rec := c.send(user, "POST", "/uploads", body, map[string]string{"Content-Type": "application/json"})
+	var session UploadSession
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &session) != nil {
+		c.t.Fatalf("create upload = %d %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Location") != apiPrefix+"/uploads/"+session.ID {
+		c.t.Errorf("Location = %q", rec.Header().Get("Location"))
+	}
+	return session
+}
+
+func (c *uploadTestClient) patch(user, id string, offset int64, chunk []byte, checksum string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	header := map[string]string{"Upload-Offset": strconv.FormatInt(offset, 10), "Content-Type": "application/offset+octet-stream"}
+	if checksum != "" {
+		header["Upload-Checksum"] = checksum
+	}
+	return c.send(user, "PATCH", "/uploads/"+id, chunk, header)
+}
+
+func chunkChecksum(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestResumableUpload(t *testing.T) {
+	a, c := newUploadTestClient(t)
+	data := testPNG(t, 1)
+	sum := sha256.Sum256(data)
+	session := c.create("user_alice", data, hex.EncodeToString(sum[:]))
+	half := int64(len(data) / 2)
+
+	if rec := c.patch("user_alice", session.ID, 0, data[:half], chunkChecksum(data[:half])); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != strconv.FormatInt(half, 10) {
+		t.Fatalf("first chunk = %d %s, offset %q", rec.Code, rec.Body, rec.Header().Get("Upload-Offset"))
+	}
+
+	// A client that lost track is told where to resume instead of corrupting the file
+	rec := c.patch("user_alice", session.ID, 0, data[:half], "")
+	if rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != strconv.FormatInt(half, 10) {
+		t.Errorf("chunk at a stale offset = %d, offset %q; want 409 with the current offset", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	rec = c.send("user_alice", "HEAD", "/uploads/"+session.ID, nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != strconv.FormatInt(half, 10) || rec.Header().Get("Upload-Length") != strconv.Itoa(len(data)) {
+		t.Errorf("HEAD = %d, offset %q, length %q", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	// Rejected chunks leave the offset where it was
+	if rec := c.patch("user_alice", session.ID, half, data[half:], chunkChecksum(data[:half])); rec.Code != statusChecksumMismatch {
+		t.Errorf("chunk with a bad checksum = %d; want %d", rec.Code, statusChecksumMismatch)
+	}
+	if rec := c.patch("user_alice", session.ID, half, append(data[half:], 0), ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk past the declared size = %d; want 413", rec.Code)
+	}
+	if rec := c.send("user_alice", "POST", "/uploads/"+session.ID+"/finalize", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("finalize of an incomplete upload = %d; want 409", rec.Code)
+	}
+
+	if rec := c.patch("user_alice", session.ID, half, data[half:], chunkChecksum(data[half:])); rec.Code != http.StatusOK {
+		t.Fatalf("last chunk = %d %s", rec.Code, rec.Body)
+	}
+	rec = c.send("user_alice", "POST", "/uploads/"+session.ID+"/finalize", nil, nil)
+	var result UploadFileResult
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &result) != nil || result.Photo == nil {
+		t.Fatalf("finalize = %d %s", rec.Code, rec.Body)
+	}
+	if entry, ok := a.catalog.Get(result.Photo.ID); !ok || entry.Owner != "user_alice" || entry.Size != int64(len(data)) {
+		t.Errorf("catalog entry = %+v, %v; want alice's photo", entry, ok)
+	}
+	if rec := c.send("user_alice", "HEAD", "/uploads/"+session.ID, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after finalize = %d; want 404", rec.Code)
+	}
+}
+
+func TestResumableUploadFileChecksumMismatch(t *testing.T) {
+	a, c := newUploadTestClient(t)
+	data := testPNG(t, 1)
+	other := sha256.Sum256(testPNG(t, 2))
+	session := c.create("user_alice", data, hex.EncodeToString(other[:]))
+
+	if rec := c.patch("user_alice", session.ID, 0, data, ""); rec.Code != http.StatusOK {
+		t.Fatalf("chunk = %d %s", rec.Code, rec.Body)
+	}
+	if rec := c.send("user_alice", "POST", "/uploads/"+session.ID+"/finalize", nil, nil); rec.Code != statusChecksumMismatch {
+		t.Errorf("finalize with the wrong file hash = %d %s; want %d", rec.Code, rec.Body, statusChecksumMismatch)
+	}
+	if photos := a.catalog.All("user_alice"); len(photos) != 0 {
+		t.Errorf("catalog has %d photo(s); want none", len(photos))
+	}
+	// The upload can't be trusted any more, so it is gone
+	if rec := c.send("user_alice", "HEAD", "/uploads/"+session.ID, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after a failed finalize = %d; want 404", rec.Code)
+	}
+}
+
+func TestResumableUploadBelongsToItsCreator(t *testing.T) {
+	_, c := newUploadTestClient(t)
+	data := testPNG(t, 1)
+	session := c.create("user_alice", data, "")
+
+	for _, tc := range []struct {
+		method, path string
+		body         []byte
+		header       map[string]string
+	}{
+		{"HEAD", "/uploads/" + session.ID, nil, nil},
+		{"PATCH", "/uploads/" + session.ID, data, map[string]string{"Upload-Offset": "0"}},
+		{"POST", "/uploads/" + session.ID + "/finalize", nil, nil},
+		{"DELETE", "/uploads/" + session.ID, nil, nil},
+	} {
+		if rec := c.send("user_bob", tc.method, tc.path, tc.body, tc.header); rec.Code != http.StatusForbidden {
+			t.Errorf("bob: %s %s = %d; want 403", tc.method, tc.path, rec.Code)
+		}
+	}
+	if rec := c.send("user_alice", "HEAD", "/uploads/"+session.ID, nil, nil); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("alice's upload after bob's attempts = %d, offset %q; want it untouched", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := c.send("user_alice", "HEAD", "/uploads/not-a-uuid", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of an unknown upload = %d; want 404", rec.Code)
+	}
+}
+
+func TestResumableUploadSerializesChunks(t *testing.T) {
+	_, c := newUploadTestClient(t)
+	data := testPNG(t, 1)
+	session := c.create("user_alice", data, "")
+
+	// Chunks racing for the same offset are written one at a time; only one can win it
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- c.patch("user_alice", session.ID, 0, data, "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("racing chunk = %d; want 200 or 409", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d racing chunks were accepted; want 1", won)
+	}
+}
+
+func TestExpiredUploadsAreCollected(t *testing.T) {
+	a, c := newUploadTestClient(t)
+	data := testPNG(t, 1)
+	expired := c.create("user_alice", data, "")
+	extended := c.create("user_alice", data, "")
+	for _, session := range []UploadSession{expired, extended} {
+		session.ExpiresAt = time.Now().Add(-time.Minute)
+		if err := a.saveUploadSession(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rec := c.patch("user_alice", expired.ID, 0, data, ""); rec.Code != http.StatusGone {
+		t.Errorf("chunk for an expired upload = %d; want 410", rec.Code)
+	}
+
+	// A session that is extended after GC found it is kept
+	sessions, err := a.expiredUploadSessions()
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expired sessions = %v, %v; want both", sessions, err)
+	}
+	extended.ExpiresAt = time.Now().Add(time.Hour)
+	if err := a.saveUploadSession(extended); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		a.removeExpiredUploadSession(session.ID)
+	}
+
+	for id, want := range map[string]bool{expired.ID: false, extended.ID: true} {
+		metaPath, dataPath := a.uploadSessionPaths(id)
+		for _, p := range []string{metaPath, dataPath} {
+			if _, err := os.Stat(p); (err == nil) != want {
+				t.Errorf("%s exists = %v; want %v", p, err == nil, want)
+			}
+		}
+	}
+
+	report := a.collectGarbage(t.Context(), false, false)
+	if len(report.ExpiredUploads) != 0 {
+		t.Errorf("GC found %s; want nothing left to collect", fmt.Sprint(report.ExpiredUploads))
+	}
+}
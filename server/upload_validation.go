@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// uploadSpoolPattern names the temp files uploads are streamed to
+const uploadSpoolPattern = "upload-spool-*"
+
+// maxImagePixels caps decoded image size so a small, highly compressed file can't
+// expand into gigabytes of memory (a decompression bomb)
+const maxImagePixels = 100_000_000
+
+// Upload rejection codes returned to the client
+const (
+	rejectUnsupportedType = "unsupported_type"
+	rejectTypeMismatch    = "type_mismatch"
+	rejectCorrupt         = "corrupt_image"
+	rejectTooLarge        = "file_too_large"
+	rejectTooManyPixels   = "too_many_pixels"
+	rejectTooManyFiles    = "too_many_files"
+	rejectReadFailed      = "read_failed"
+	rejectStoreFailed     = "storage_failed"
+)
+
+// uploadError explains why an uploaded file was not accepted
+type uploadError struct {
+	Code    string
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func rejectFile(code, format string, args ...any) *uploadError {
+	return &uploadError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// imageFormat is an image type recognised from its content
+type imageFormat struct {
+	Ext         string   // Canonical extension used for the stored key
+	ContentType string   // MIME type the file is stored and served with
+	Extensions  []string // File extensions that may carry this format
+}
+
+var (
+	formatJPEG = imageFormat{".jpg", "image/jpeg", []string{".jpg", ".jpeg"}}
+	formatPNG  = imageFormat{".png", "image/png", []string{".png"}}
+	formatGIF  = imageFormat{".gif", "image/gif", []string{".gif"}}
+	formatWebP = imageFormat{".webp", "image/webp", []string{".webp"}}
+	formatHEIC = imageFormat{".heic", "image/heic", []string{".heic", ".heif"}}
+)
+
+// imageFormats lists every supported format
+var imageFormats = []imageFormat{formatJPEG, formatPNG, formatGIF, formatWebP, formatHEIC}
+
+// formatForKey returns the format of a stored original from its extension
+func formatForKey(key string) (imageFormat, bool) {
+	ext := strings.ToLower(filepath.Ext(key))
+	for _, f := range imageFormats {
+		if indexOf(f.Extensions, ext) != -1 {
+			return f, true
+		}
+	}
+	return imageFormat{}, false
+}
+
+// heifBrands are the ftyp brands used by HEIC/HEIF stills
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// sniffImageFormat identifies an image from its magic bytes
+func sniffImageFormat(data []byte) (imageFormat, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return formatJPEG, true
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return formatPNG, true
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return formatGIF, true
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return formatWebP, true
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		// ISO base media files list their major brand after "ftyp"
+		brand := string(data[8:12])
+		for _, b := range heifBrands {
+			if brand == b {
+				return formatHEIC, true
+			}
+		}
+	}
+	return imageFormat{}, false
+}
+
+// validateUpload checks that a file really is a supported image matching its extension,
+// isn't truncated or corrupt, and isn't too large to decode safely. It returns the decoded image.
+func validateUpload(filename string, src io.ReadSeeker) (imageFormat, image.Image, *uploadError) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return imageFormat{}, nil, rejectFile(rejectReadFailed, "File could not be read")
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return imageFormat{}, nil, rejectFile(rejectReadFailed, "File could not be read")
+	}
+
+	format, ok := sniffImageFormat(head[:n])
+	if !ok {
+		return format, nil, rejectFile(rejectUnsupportedType, "File is not a supported image (JPEG, PNG, GIF, WebP or HEIC)")
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != "" && indexOf(format.Extensions, ext) == -1 {
+		return format, nil, rejectFile(rejectTypeMismatch, "File extension %s does not match its %s content", ext, format.ContentType)
+	}
+
+	// Check dimensions from the header before allocating anything for the pixels
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return format, nil, rejectFile(rejectReadFailed, "File could not be read")
+	}
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return format, nil, rejectFile(rejectCorrupt, "Image header could not be read")
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return format, nil, rejectFile(rejectCorrupt, "Image has no pixels")
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return format, nil, rejectFile(rejectTooManyPixels, "Image is %dx%d; the maximum is %d megapixels", cfg.Width, cfg.Height, maxImagePixels/1_000_000)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return format, nil, rejectFile(rejectReadFailed, "File could not be read")
+	}
+	// Oriented as displayed, so dimensions, hashes and placeholders match what users see
+	img, err := imaging.Decode(src, imaging.AutoOrientation(true))
+	if err != nil {
+		return format, nil, rejectFile(rejectCorrupt, "Image is truncated or corrupt")
+	}
+	return format, img, nil
+}
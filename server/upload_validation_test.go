@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testPNG returns a small valid PNG; different seeds give different content
+func testPNG(t testing.TB, seed int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7 * seed)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testGIFBomb returns a tiny GIF whose header claims 65535x65535 pixels
+func testGIFBomb(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 1, 1), []color.Color{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	copy(data[6:10], []byte{0xFF, 0xFF, 0xFF, 0xFF}) // Logical screen width and height
+	return data
+}
+
+func TestValidateUpload(t *testing.T) {
+	pngData := testPNG(t, 1)
+	for _, tc := range []struct {
+		name     string
+		filename string
+		data     []byte
+		wantCode string
+	}{
+		{"valid", "photo.png", pngData, ""},
+		{"no extension", "photo", pngData, ""},
+		{"upper-case extension", "PHOTO.PNG", pngData, ""},
+		{"renamed executable", "photo.jpg", []byte("MZ\x90\x00\x03\x00\x00\x00 not an image"), rejectUnsupportedType},
+		{"html", "photo.png", []byte("<!DOCTYPE html><script>alert(1)</script>"), rejectUnsupportedType},
+		{"empty", "photo.png", nil, rejectUnsupportedType},
+		{"extension mismatch", "photo.jpg", pngData, rejectTypeMismatch},
+		{"truncated", "photo.png", pngData[:len(pngData)/2], rejectCorrupt},
+		{"bad header", "photo.jpg", []byte("\xFF\xD8\xFF garbage"), rejectCorrupt},
+		{"decompression bomb", "bomb.gif", testGIFBomb(t), rejectTooManyPixels},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			format, img, rejection := validateUpload(tc.filename, bytes.NewReader(tc.data))
+			if tc.wantCode == "" {
+				if rejection != nil {
+					t.Fatalf("rejected: %v", rejection)
+				}
+				if format.ContentType != "image/png" || img.Bounds().Dx() != 8 {
+					t.Errorf("format %v, image %v; want the decoded PNG", format, img.Bounds())
+				}
+				return
+			}
+			if rejection == nil || rejection.Code != tc.wantCode {
+				t.Errorf("rejection = %+v; want code %s", rejection, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestUploadReportsEachRejectedFile(t *testing.T) {
+	a := newTestApp(t, defaultConfig())
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"good.png", testPNG(t, 1)},
+		{"evil.png", []byte("<html><body>hi</body></html>")},
+		{"renamed.gif", testPNG(t, 2)},
+	} {
+		part, _ := mw.CreateFormFile("photos", f.name)
+		part.Write(f.data)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/photos/upload", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	a.newRouter().ServeHTTP(rec, req)
+
+	var resp UploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusMultiStatus {
+		t.Fatalf("upload = %d %s; want 207", rec.Code, rec.Body)
+	}
+	want := []struct{ filename, status, code string }{
+		{"good.png", "accepted", ""},
+		{"evil.png", "rejected", rejectUnsupportedType},
+		{"renamed.gif", "rejected", rejectTypeMismatch},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("results = %+v; want one per file", resp.Results)
+	}
+	for i, w := range want {
+		got := resp.Results[i]
+		if got.Filename != w.filename || got.Status != w.status || got.Code != w.code || (w.code != "" && got.Reason == "") {
+			t.Errorf("result %d = %+v; want %s %s %s with a reason", i, got, w.filename, w.status, w.code)
+		}
+	}
+	if len(resp.Photos) != 1 || len(a.catalog.All("")) != 1 {
+		t.Errorf("stored %d photo(s), catalog has %d; want only the valid one", len(resp.Photos), len(a.catalog.All("")))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// settingsPrefix is the storage key prefix for per-user settings
+const settingsPrefix = "settings/"
+
+// validUserID matches the user IDs Clerk issues, e.g. user_2abc...
+var validUserID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// settingsCache keeps the settings read so far. Photo requests check the owner's settings, so
+// stored settings are read once per user rather than on every request.
+type settingsCache struct {
+	mu     sync.Mutex
+	byUser map[string]UserSettings
+	reads  singleflight.Group // Requests for a user whose settings aren't cached share one read
+}
+
+func newSettingsCache() *settingsCache {
+	return &settingsCache{byUser: make(map[string]UserSettings)}
+}
+
+// settingsKey is where a user's settings are stored
+func settingsKey(userID string) string {
+	return settingsPrefix + userID + ".json"
+}
+
+// loadUserSettings returns a user's settings, or the defaults when they never changed them
+func (a *App) loadUserSettings(ctx context.Context, userID string) (UserSettings, error) {
+	c := a.settings
+	c.mu.Lock()
+	s, ok := c.byUser[userID]
+	c.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	// The read is shared, so it outlives any one request that is canceled
+	ctx = context.WithoutCancel(ctx)
+	v, err, _ := c.reads.Do(userID, func() (any, error) {
+		var s UserSettings
+		data, err := readBlob(ctx, a.store, settingsKey(userID))
+		if err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return s, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &s); err != nil {
+				return s, fmt.Errorf("failed to parse settings: %w", err)
+			}
+		}
+
+		// Settings saved while this read ran are newer than what it found
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if saved, ok := c.byUser[userID]; ok {
+			return saved, nil
+		}
+		c.byUser[userID] = s
+		return s, nil
+	})
+	if err != nil {
+		return UserSettings{}, err
+	}
+	return v.(UserSettings), nil
+}
+
+// saveUserSettings stores a user's settings
+func (a *App) saveUserSettings(ctx context.Context, userID string, s UserSettings) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Saves hold the lock while writing so the cache ends up with the settings stored last
+	c := a.settings
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := putBlob(ctx, a.store, settingsKey(userID), data, "application/json"); err != nil {
+		return err
+	}
+	c.byUser[userID] = s
+	return nil
+}
+
+// servesMetadata reports whether a photo's owner chose to share originals with their metadata.
+// Photos without an owner, and owners whose settings can't be read, get metadata removed.
+func (a *App) servesMetadata(ctx context.Context, owner string) bool {
+	if owner == "" {
+		return false
+	}
+	s, err := a.loadUserSettings(ctx, owner)
+	if err != nil {
+		log.Printf("Warning: failed to load settings for %s: %v", owner, err)
+		return false
+	}
+	return s.KeepMetadata
+}
+
+// settingsUser returns the signed-in user whose settings a request is for, or sends an error
+func (a *App) settingsUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := a.requestUser(r)
+	if userID == "" {
+		SendError(w, codeSignInRequired, "Sign in to change settings", http.StatusUnauthorized)
+		return "", false
+	}
+	if !validUserID.MatchString(userID) {
+		SendError(w, codeInvalidUserID, "Invalid user ID", http.StatusBadRequest)
+		return "", false
+	}
+	return userID, true
+}
+
+// HandleGetSettings returns the signed-in user's settings
+func (a *App) HandleGetSettings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.settingsUser(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := a.loadUserSettings(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading settings for %s: %v", userID, err)
+		SendError(w, codeInternal, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+	SendJSON(w, s)
+}
+
+// HandleUpdateSettings replaces the signed-in user's settings
+func (a *App) HandleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.settingsUser(w, r)
+	if !ok {
+		return
+	}
+
+	var s UserSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		SendError(w, codeInvalidBody, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := a.saveUserSettings(r.Context(), userID, s); err != nil {
+		log.Printf("Error saving settings for %s: %v", userID, err)
+		SendError(w, codeInternal, "Failed to save settings", http.StatusInternalServerError)
+		return
+	}
+	SendJSON(w, s)
+}
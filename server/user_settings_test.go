@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUserSettings(t *testing.T) {
+	a, sign := draftTestApp(t)
+	router := a.newRouter()
+
+	if rec := sendAs(t, router, sign, "user_alice", "GET", "/settings", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"keepMetadata":false`) {
+		t.Errorf("settings before any change = %d %s; want the defaults", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_alice", "PUT", "/settings", `{"keepMetadata":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("save = %d %s", rec.Code, rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user_bob", "GET", "/settings", ""); !strings.Contains(rec.Body.String(), `"keepMetadata":false`) {
+		t.Errorf("bob's settings = %s; want his own defaults", rec.Body)
+	}
+	if rec := sendAs(t, router, sign, "user.alice", "GET", "/settings", ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), codeInvalidUserID) {
+		t.Errorf("settings for a malformed user ID = %d %s; want 400 %s", rec.Code, rec.Body, codeInvalidUserID)
+	}
+
+	// A fresh cache reads the stored settings, once for all the requests waiting on them
+	b := newApp(a.cfg, a.store)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			if s, err := b.loadUserSettings(t.Context(), "user_alice"); err != nil || !s.KeepMetadata {
+				t.Errorf("stored settings = %+v, %v; want keepMetadata", s, err)
+			}
+		})
+	}
+	wg.Wait()
+}